@@ -0,0 +1,82 @@
+// Package capfile reads and writes the binary capture format of ib-exporter.
+//
+// A capture is a sequence of ticks, each holding the value of a set of
+// series at one point in time. A series is one counter of one device. The
+// file starts with a fixed header followed by the body, which is optionally
+// a zstd stream:
+//
+//	header:  "IBCAP" | uvarint schema version | flags byte (bit 0: zstd body)
+//	body:    record*
+//	record:  0x01 series | 0x02 block
+//	series:  ib_dev | net_dev | link_type | counter, each uvarint length + bytes
+//	block:   uvarint ticks | timestamps | uvarint series | series ids | columns
+//
+// Series are numbered in the order their records appear and are defined
+// before the first block that uses them. A block is columnar: the
+// timestamps of its ticks, the ids of the series present in every tick in
+// ascending order (as uvarint gaps), then the values of each series.
+//
+// Timestamps are Unix nanoseconds stored as zigzag varint of the change of
+// the delta to the previous tick, which is 0 or close to it at a fixed
+// interval. A value that is an integer, like every cumulative counter, and
+// whose previous value in the series was one too is stored as uvarint of
+// zigzag(delta)<<1. Anything else is stored as uvarint 1 followed by the 8
+// bytes of the float64, little endian. The previous timestamp and values
+// carry over from block to block and start at 0.
+package capfile
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// SchemaVersion is the version written by Writer. Reader accepts it and
+	// every older version.
+	SchemaVersion = 1
+
+	magic = "IBCAP"
+
+	flagZstd = 1 << 0
+
+	recordSeries = 0x01
+	recordBlock  = 0x02
+
+	// maxExactInteger is the largest integer up to which every integer is a
+	// float64.
+	maxExactInteger = 1 << 53
+	maxStringLength = 4096
+	maxBlockTicks   = 1 << 20
+)
+
+var (
+	ErrNotCapture         = errors.New("not a binary capture file")
+	ErrUnsupportedVersion = errors.New("unsupported capture schema version")
+	ErrCorrupt            = errors.New("corrupt capture file")
+)
+
+// Series identifies one counter of one device.
+type Series struct {
+	IBDev    string
+	NetDev   string
+	LinkType string
+	Counter  string
+}
+
+// Value is the value of a series in one tick.
+type Value struct {
+	Series
+	Value float64
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func isExactInteger(v float64) bool {
+	return v == math.Trunc(v) && math.Abs(v) <= maxExactInteger
+}
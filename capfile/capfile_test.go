@@ -0,0 +1,303 @@
+package capfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	rcvData   = Series{IBDev: "mlx5_0", NetDev: "eth0", LinkType: "Ethernet", Counter: "port_rcv_data"}
+	xmitData  = Series{IBDev: "mlx5_0", NetDev: "eth0", LinkType: "Ethernet", Counter: "port_xmit_data"}
+	qpNum     = Series{IBDev: "mlx5_0", NetDev: "eth0", LinkType: "Ethernet", Counter: "QPNum"}
+	ibRcvData = Series{IBDev: "mlx5_1", LinkType: "InfiniBand", Counter: "port_rcv_data"}
+)
+
+// testTicks has ticks at an irregular interval, a series set that changes in
+// the middle of a block and values that don't fit the integer encoding.
+func testTicks() []Tick {
+	start := time.Unix(1760000000, 123456789)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	return []Tick{
+		{at(0), []Value{{rcvData, 0}, {xmitData, 10}}},
+		{at(100 * time.Millisecond), []Value{{rcvData, 1000}, {xmitData, 2000}}},
+		{at(200 * time.Millisecond), []Value{{rcvData, 3000}, {xmitData, 2500}}},
+		// a series appears
+		{at(300 * time.Millisecond), []Value{{rcvData, 3500}, {xmitData, 2600}, {qpNum, 12}}},
+		// a gauge going down, a counter reset
+		{at(401 * time.Millisecond), []Value{{rcvData, 10}, {xmitData, 2700}, {qpNum, 3}}},
+		// a series disappears, another one appears
+		{at(499 * time.Millisecond), []Value{{rcvData, 20}, {ibRcvData, 7}}},
+		// beyond 2^53, where not every integer is a float64
+		{at(600 * time.Millisecond), []Value{{rcvData, 1 << 60}, {ibRcvData, 1<<53 + 2}}},
+		{at(700 * time.Millisecond), []Value{{rcvData, 1<<60 + 1<<10}, {ibRcvData, 1 << 53}}},
+		{at(800 * time.Millisecond), []Value{{rcvData, math.MaxUint64}, {ibRcvData, 1<<53 - 1}}},
+		// non-integers, back to integers
+		{at(900 * time.Millisecond), []Value{{rcvData, 0.5}, {ibRcvData, -1.25}}},
+		{at(time.Second), []Value{{rcvData, math.Inf(1)}, {ibRcvData, math.NaN()}}},
+		{at(1100 * time.Millisecond), []Value{{rcvData, -42}, {ibRcvData, 1e-300}}},
+		{at(1200 * time.Millisecond), []Value{{rcvData, -40}, {ibRcvData, 5}}},
+		// a timestamp going backwards, e.g. after a clock step
+		{at(1150 * time.Millisecond), []Value{{rcvData, -38}, {ibRcvData, 6}}},
+		{at(time.Hour), []Value{{rcvData, 0}, {ibRcvData, 0}}},
+	}
+}
+
+func writeTicks(t *testing.T, ticks []Tick, opts Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tick := range ticks {
+		if err := w.WriteTick(tick.Time, tick.Values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readTicks reads ticks until an error, which is nil at the end of the file.
+func readTicks(data []byte) ([]Tick, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var ticks []Tick
+	for {
+		tick, err := r.Next()
+		if err == io.EOF {
+			return ticks, nil
+		}
+		if err != nil {
+			return ticks, err
+		}
+		ticks = append(ticks, tick)
+	}
+}
+
+func sameValue(a, b float64) bool {
+	return math.Float64bits(a) == math.Float64bits(b) || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+// sameTick compares the values of two ticks regardless of their order.
+func sameTick(a, b Tick) bool {
+	if !a.Time.Equal(b.Time) || len(a.Values) != len(b.Values) {
+		return false
+	}
+	values := map[Series]float64{}
+	for _, v := range a.Values {
+		values[v.Series] = v.Value
+	}
+	for _, v := range b.Values {
+		if w, ok := values[v.Series]; !ok || !sameValue(v.Value, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkTicks(t *testing.T, got, want []Tick) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d ticks, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !sameTick(got[i], want[i]) {
+			t.Errorf("tick %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"plain", Options{}},
+		{"zstd", Options{Zstd: true}},
+		{"plain blocks of 3", Options{BlockTicks: 3}},
+		{"zstd blocks of 3", Options{Zstd: true, BlockTicks: 3}},
+		{"plain blocks of 1", Options{BlockTicks: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := testTicks()
+			data := writeTicks(t, want, tc.opts)
+			r, err := NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Version() != SchemaVersion || r.Compressed() != tc.opts.Zstd {
+				t.Errorf("version %d, compressed %v, want %d and %v", r.Version(), r.Compressed(), SchemaVersion, tc.opts.Zstd)
+			}
+			r.Close()
+			got, err := readTicks(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTicks(t, got, want)
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	data := writeTicks(t, testTicks(), Options{})
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := r.Next(); err != nil {
+			break
+		}
+	}
+	want := []Series{rcvData, xmitData, qpNum, ibRcvData}
+	got := r.Series()
+	if len(got) != len(want) {
+		t.Fatalf("series %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("series %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDuplicateSeriesKeepsLastValue(t *testing.T) {
+	at := time.Unix(0, 1000)
+	data := writeTicks(t, []Tick{{at, []Value{{rcvData, 1}, {xmitData, 2}, {rcvData, 3}}}}, Options{})
+	got, err := readTicks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTicks(t, got, []Tick{{at, []Value{{rcvData, 3}, {xmitData, 2}}}})
+}
+
+func TestFlushMakesTicksReadable(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Options{Zstd: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testTicks()[:2]
+	for _, tick := range want {
+		if err := w.WriteTick(tick.Time, tick.Values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// the zstd stream is not ended, like a capture still being written
+	got, err := readTicks(bytes.Clone(buf.Bytes()))
+	if len(got) != len(want) {
+		t.Fatalf("read %d ticks (%v) of a flushed capture, want %d", len(got), err, len(want))
+	}
+	checkTicks(t, got, want)
+	w.Close()
+}
+
+func TestTruncated(t *testing.T) {
+	for _, opts := range []Options{{BlockTicks: 2}, {Zstd: true, BlockTicks: 2}} {
+		want := testTicks()
+		data := writeTicks(t, want, opts)
+		header := len(magic) + 2
+		for n := 0; n < len(data); n++ {
+			got, err := readTicks(data[:n])
+			if n < header {
+				if !errors.Is(err, ErrNotCapture) {
+					t.Errorf("zstd %v: %d of %d bytes: %v, want %v", opts.Zstd, n, len(data), err, ErrNotCapture)
+				}
+				continue
+			}
+			if len(got) > len(want) {
+				t.Fatalf("zstd %v: %d of %d bytes: read %d ticks, more than written", opts.Zstd, n, len(data), len(got))
+			}
+			checkTicks(t, got, want[:len(got)])
+			if len(got) == len(want) && err == nil {
+				t.Errorf("zstd %v: %d of %d bytes read as complete", opts.Zstd, n, len(data))
+			}
+			if !opts.Zstd && err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%d of %d bytes: %v, want %v", n, len(data), err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	header := func(version uint64, flags byte) []byte {
+		return append(binary.AppendUvarint([]byte(magic), version), flags)
+	}
+	str := func(b []byte, s string) []byte {
+		return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+	}
+	series := func(b []byte) []byte {
+		b = append(b, recordSeries)
+		for _, s := range []string{"mlx5_0", "eth0", "Ethernet", "port_rcv_data"} {
+			b = str(b, s)
+		}
+		return b
+	}
+	// a block of one tick at 0 with series 0, its value following
+	block := func(b []byte) []byte {
+		return append(b, recordBlock, 1, 0, 1, 0)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNotCapture},
+		{"other magic", []byte("IBCAX\x01\x00"), ErrNotCapture},
+		{"csv", []byte("1760000000000000000,mlx5_0,eth0,Ethernet,port_rcv_data,1\n"), ErrNotCapture},
+		{"version 0", header(0, 0), ErrUnsupportedVersion},
+		{"newer version", header(SchemaVersion+1, 0), ErrUnsupportedVersion},
+		{"not zstd", append(header(SchemaVersion, flagZstd), series(nil)...), nil},
+		{"unknown record", append(header(SchemaVersion, 0), 0x7f), ErrCorrupt},
+		{"long string", binary.AppendUvarint(append(header(SchemaVersion, 0), recordSeries), maxStringLength+1), ErrCorrupt},
+		{"no ticks", append(series(header(SchemaVersion, 0)), recordBlock, 0), ErrCorrupt},
+		{"too many ticks", binary.AppendUvarint(append(series(header(SchemaVersion, 0)), recordBlock), maxBlockTicks+1), ErrCorrupt},
+		{"undefined series", append(header(SchemaVersion, 0), recordBlock, 1, 0, 1, 0, 0), ErrCorrupt},
+		{"series id past the defined", append(series(header(SchemaVersion, 0)), recordBlock, 1, 0, 1, 1, 0), ErrCorrupt},
+		{"more series than defined", append(series(header(SchemaVersion, 0)), recordBlock, 1, 0, 2, 0, 0, 0, 0), ErrCorrupt},
+		{"value code", append(block(series(header(SchemaVersion, 0))), 3), ErrCorrupt},
+		{"value cut", append(block(series(header(SchemaVersion, 0))), 1, 0, 0), io.ErrUnexpectedEOF},
+		{"series cut", append(header(SchemaVersion, 0), recordSeries, 6, 'm'), io.ErrUnexpectedEOF},
+	} {
+		_, err := readTicks(tc.data)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%s: read without an error", tc.name)
+			}
+			continue
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+// TestCorruptBytes flips every byte of a capture; reading it may fail but
+// must not panic or run away.
+func TestCorruptBytes(t *testing.T) {
+	for _, opts := range []Options{{BlockTicks: 4}, {Zstd: true, BlockTicks: 4}} {
+		data := writeTicks(t, testTicks(), opts)
+		for i := range data {
+			for _, flip := range []byte{0x01, 0x80, 0xff} {
+				corrupt := bytes.Clone(data)
+				corrupt[i] ^= flip
+				readTicks(corrupt)
+			}
+		}
+	}
+}
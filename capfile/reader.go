@@ -0,0 +1,222 @@
+package capfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Tick is the values of all series present at one point in time.
+type Tick struct {
+	Time   time.Time
+	Values []Value
+}
+
+// Reader reads a capture tick by tick.
+type Reader struct {
+	br         *bufio.Reader
+	dec        *zstd.Decoder
+	version    int
+	compressed bool
+
+	series    []Series
+	prevValue []float64
+	prevTime  int64
+	prevDelta int64
+
+	pending []Tick
+}
+
+// NewReader reads the header from r. It returns ErrNotCapture when r does
+// not start with one and ErrUnsupportedVersion for files written by a newer
+// version.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil || string(head) != magic {
+		return nil, ErrNotCapture
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, ErrNotCapture
+	}
+	if version == 0 || version > SchemaVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, version)
+	}
+	flags, err := br.ReadByte()
+	if err != nil {
+		return nil, ErrNotCapture
+	}
+
+	cr := &Reader{br: br, version: int(version), compressed: flags&flagZstd != 0}
+	if cr.compressed {
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		cr.dec = dec
+		cr.br = bufio.NewReader(dec)
+	}
+	return cr, nil
+}
+
+// Version is the schema version of the file.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Compressed reports whether the body is zstd compressed.
+func (r *Reader) Compressed() bool {
+	return r.compressed
+}
+
+// Series returns the series defined so far, in id order.
+func (r *Reader) Series() []Series {
+	return r.series
+}
+
+// Next returns the next tick, or io.EOF after the last one. A file that ends
+// in the middle of a record, e.g. because the writer was killed, returns
+// io.ErrUnexpectedEOF after the last complete block.
+func (r *Reader) Next() (Tick, error) {
+	for len(r.pending) == 0 {
+		kind, err := r.br.ReadByte()
+		if err != nil {
+			return Tick{}, err
+		}
+		switch kind {
+		case recordSeries:
+			err = r.readSeries()
+		case recordBlock:
+			err = r.readBlock()
+		default:
+			err = fmt.Errorf("%w: unknown record type %#x", ErrCorrupt, kind)
+		}
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return Tick{}, err
+		}
+	}
+	tick := r.pending[0]
+	r.pending = r.pending[1:]
+	return tick, nil
+}
+
+// Close releases the zstd decoder. It does not close the underlying reader.
+func (r *Reader) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return nil
+}
+
+func (r *Reader) readString() (string, error) {
+	n, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return "", err
+	}
+	if n > maxStringLength {
+		return "", fmt.Errorf("%w: string of %d bytes", ErrCorrupt, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (r *Reader) readSeries() error {
+	var s Series
+	for _, field := range []*string{&s.IBDev, &s.NetDev, &s.LinkType, &s.Counter} {
+		var err error
+		if *field, err = r.readString(); err != nil {
+			return err
+		}
+	}
+	r.series = append(r.series, s)
+	r.prevValue = append(r.prevValue, 0)
+	return nil
+}
+
+func (r *Reader) readBlock() error {
+	ticks, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return err
+	}
+	if ticks == 0 || ticks > maxBlockTicks {
+		return fmt.Errorf("%w: block of %d ticks", ErrCorrupt, ticks)
+	}
+	block := make([]Tick, ticks)
+	for i := range block {
+		dod, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return err
+		}
+		r.prevDelta += unzigzag(dod)
+		r.prevTime += r.prevDelta
+		block[i].Time = time.Unix(0, r.prevTime)
+	}
+
+	count, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return err
+	}
+	if count > uint64(len(r.series)) {
+		return fmt.Errorf("%w: block of %d series, %d defined", ErrCorrupt, count, len(r.series))
+	}
+	ids := make([]uint64, count)
+	next := uint64(0)
+	for i := range ids {
+		gap, err := binary.ReadUvarint(r.br)
+		if err != nil {
+			return err
+		}
+		ids[i] = next + gap
+		if ids[i] >= uint64(len(r.series)) || ids[i] < next {
+			return fmt.Errorf("%w: undefined series %d", ErrCorrupt, ids[i])
+		}
+		next = ids[i] + 1
+	}
+
+	for i := range block {
+		block[i].Values = make([]Value, count)
+	}
+	for j, id := range ids {
+		for i := range block {
+			v, err := r.readValue(r.prevValue[id])
+			if err != nil {
+				return err
+			}
+			r.prevValue[id] = v
+			block[i].Values[j] = Value{Series: r.series[id], Value: v}
+		}
+	}
+	r.pending = block
+	return nil
+}
+
+func (r *Reader) readValue(prev float64) (float64, error) {
+	code, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		return 0, err
+	}
+	if code&1 == 0 {
+		return float64(int64(prev) + unzigzag(code>>1)), nil
+	}
+	if code != 1 {
+		return 0, fmt.Errorf("%w: value code %d", ErrCorrupt, code)
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(r.br, b[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+}
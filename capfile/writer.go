@@ -0,0 +1,197 @@
+package capfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultBlockTicks is how many ticks a Writer buffers before it writes a
+// block, about 13 seconds at 100ms.
+const DefaultBlockTicks = 128
+
+// Options configure a Writer.
+type Options struct {
+	// Zstd compresses the body.
+	Zstd bool
+	// BlockTicks is the number of ticks per block, DefaultBlockTicks when 0.
+	BlockTicks int
+}
+
+// Writer writes a capture. Ticks are buffered until a block is full, the set
+// of series changes, or Flush or Close is called.
+type Writer struct {
+	bw         *bufio.Writer
+	enc        *zstd.Encoder
+	blockTicks int
+
+	ids       map[Series]uint64
+	prevValue []float64
+	prevTime  int64
+	prevDelta int64
+
+	// the current block
+	times   []int64
+	set     []uint64
+	columns [][]float64
+
+	scratch []byte
+	err     error
+}
+
+// NewWriter writes the header to w and returns a Writer for the body.
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	header := binary.AppendUvarint([]byte(magic), SchemaVersion)
+	var flags byte
+	if opts.Zstd {
+		flags |= flagZstd
+	}
+	if _, err := w.Write(append(header, flags)); err != nil {
+		return nil, err
+	}
+
+	cw := &Writer{blockTicks: opts.BlockTicks, ids: map[Series]uint64{}}
+	if cw.blockTicks <= 0 {
+		cw.blockTicks = DefaultBlockTicks
+	}
+	if opts.Zstd {
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		cw.enc = enc
+		cw.bw = bufio.NewWriter(enc)
+	} else {
+		cw.bw = bufio.NewWriter(w)
+	}
+	return cw, nil
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.bw.Write(b)
+	}
+}
+
+func (w *Writer) appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// id returns the id of the series, writing its record when it is new.
+func (w *Writer) id(s Series) uint64 {
+	if id, ok := w.ids[s]; ok {
+		return id
+	}
+	id := uint64(len(w.prevValue))
+	w.ids[s] = id
+	w.prevValue = append(w.prevValue, 0)
+	b := append(w.scratch[:0], recordSeries)
+	b = w.appendString(b, s.IBDev)
+	b = w.appendString(b, s.NetDev)
+	b = w.appendString(b, s.LinkType)
+	b = w.appendString(b, s.Counter)
+	w.write(b)
+	w.scratch = b
+	return id
+}
+
+// WriteTick adds the values of one point in time. A series listed twice
+// keeps the last value.
+func (w *Writer) WriteTick(at time.Time, values []Value) error {
+	if w.err != nil {
+		return w.err
+	}
+	byID := make(map[uint64]float64, len(values))
+	set := make([]uint64, 0, len(values))
+	for _, v := range values {
+		id := w.id(v.Series)
+		if _, ok := byID[id]; !ok {
+			set = append(set, id)
+		}
+		byID[id] = v.Value
+	}
+	slices.Sort(set)
+
+	if len(w.times) > 0 && !slices.Equal(set, w.set) {
+		w.writeBlock()
+	}
+	if len(w.times) == 0 {
+		w.set = set
+		w.columns = make([][]float64, len(set))
+	}
+	w.times = append(w.times, at.UnixNano())
+	for i, id := range w.set {
+		w.columns[i] = append(w.columns[i], byID[id])
+	}
+	if len(w.times) >= w.blockTicks {
+		w.writeBlock()
+	}
+	return w.err
+}
+
+func (w *Writer) writeBlock() {
+	if len(w.times) == 0 {
+		return
+	}
+	b := append(w.scratch[:0], recordBlock)
+	b = binary.AppendUvarint(b, uint64(len(w.times)))
+	for _, t := range w.times {
+		delta := t - w.prevTime
+		b = binary.AppendUvarint(b, zigzag(delta-w.prevDelta))
+		w.prevTime, w.prevDelta = t, delta
+	}
+	b = binary.AppendUvarint(b, uint64(len(w.set)))
+	next := uint64(0)
+	for _, id := range w.set {
+		b = binary.AppendUvarint(b, id-next)
+		next = id + 1
+	}
+	for i, id := range w.set {
+		for _, v := range w.columns[i] {
+			b = w.appendValue(b, w.prevValue[id], v)
+			w.prevValue[id] = v
+		}
+	}
+	w.write(b)
+	w.scratch = b
+	w.times, w.set, w.columns = w.times[:0], nil, nil
+}
+
+func (w *Writer) appendValue(b []byte, prev, v float64) []byte {
+	if isExactInteger(v) && isExactInteger(prev) {
+		return binary.AppendUvarint(b, zigzag(int64(v)-int64(prev))<<1)
+	}
+	b = binary.AppendUvarint(b, 1)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// Flush writes the buffered ticks, so that a reader sees everything written
+// so far.
+func (w *Writer) Flush() error {
+	w.writeBlock()
+	if w.err == nil {
+		w.err = w.bw.Flush()
+	}
+	if w.err == nil && w.enc != nil {
+		w.err = w.enc.Flush()
+	}
+	return w.err
+}
+
+// Close flushes the Writer and ends the zstd stream. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	w.Flush()
+	if w.enc != nil {
+		if err := w.enc.Close(); w.err == nil {
+			w.err = err
+		}
+	}
+	return w.err
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"ib-exporter/capfile"
+)
+
+// The counter classes match the error highlighting of the dashboard.
+const (
+	counterClassDiscard = "discard"
+	counterClassPause   = "pause"
+	counterClassError   = "error"
+)
+
+var (
+	analyzeDiscardCounter = regexp.MustCompile(`discard|drop`)
+	analyzePauseCounter   = regexp.MustCompile(`pause`)
+	analyzeErrorCounter   = regexp.MustCompile(`err|out_of_sequence|downed|recovery|timeout|retry_exceeded|duplicate_request|local_ack`)
+)
+
+// counterClass is discard, pause or error for the counters that indicate
+// trouble when they increase, "" for the others.
+func counterClass(name string) string {
+	switch {
+	case analyzeDiscardCounter.MatchString(name):
+		return counterClassDiscard
+	case analyzePauseCounter.MatchString(name):
+		return counterClassPause
+	case analyzeErrorCounter.MatchString(name):
+		return counterClassError
+	}
+	return ""
+}
+
+// Stats summarises the values of a series; P50 and P99 are nearest-rank
+// percentiles.
+type Stats struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+func summarize(values []float64) Stats {
+	if len(values) == 0 {
+		return Stats{}
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	return Stats{
+		Min:  sorted[0],
+		Mean: sum / float64(len(sorted)),
+		P50:  percentile(sorted, 0.5),
+		P99:  percentile(sorted, 0.99),
+		Max:  sorted[len(sorted)-1],
+	}
+}
+
+// CounterRates are the per second rates of a cumulative counter between
+// consecutive samples. Driver resets are skipped.
+type CounterRates struct {
+	Counter   string  `json:"counter"`
+	Increase  float64 `json:"increase"`
+	PerSecond Stats   `json:"per_second"`
+}
+
+// Throughput is a byte or IB data counter in bytes and Gb/s; the 4-byte words
+// of port_rcv_data and port_xmit_data are already scaled.
+type Throughput struct {
+	Counter string  `json:"counter"`
+	Bytes   float64 `json:"bytes"`
+	Gbps    Stats   `json:"gbps"`
+}
+
+type CounterIncrease struct {
+	Counter  string  `json:"counter"`
+	Increase float64 `json:"increase"`
+}
+
+// DeviceAnalysis lists only the error, discard and pause counters that
+// increased; Rates has every cumulative counter.
+type DeviceAnalysis struct {
+	IBDev      string            `json:"ib_dev"`
+	NetDev     string            `json:"net_dev"`
+	LinkType   string            `json:"link_type"`
+	Throughput []Throughput      `json:"throughput"`
+	Errors     []CounterIncrease `json:"errors"`
+	Discards   []CounterIncrease `json:"discards"`
+	Pauses     []CounterIncrease `json:"pauses"`
+	Rates      []CounterRates    `json:"rates"`
+}
+
+// SamplingAnalysis describes the time between samples. Jitter is the
+// distance of each interval from the median one, gaps are intervals longer
+// than 1.5 times the median, i.e. missed samples.
+type SamplingAnalysis struct {
+	Samples               int     `json:"samples"`
+	MedianIntervalSeconds float64 `json:"median_interval_seconds"`
+	MeanIntervalSeconds   float64 `json:"mean_interval_seconds"`
+	JitterSeconds         Stats   `json:"jitter_seconds"`
+	Gaps                  int     `json:"gaps"`
+}
+
+type CaptureAnalysis struct {
+	Capture         string           `json:"capture"`
+	Start           time.Time        `json:"start"`
+	End             time.Time        `json:"end"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	Sampling        SamplingAnalysis `json:"sampling"`
+	Devices         []DeviceAnalysis `json:"devices"`
+}
+
+type AnalysisReport struct {
+	Captures []CaptureAnalysis `json:"captures"`
+}
+
+type seriesKey struct {
+	IBDev   string
+	Counter string
+}
+
+type seriesTrack struct {
+	netDev   string
+	linkType string
+	prev     float64
+	prevAt   time.Time
+	// the capture prev was read from, rates are not computed across captures
+	capture int
+	rates   []float64
+	// when each rate's interval ended and how long it was
+	times     []time.Time
+	intervals []float64
+	increase  float64
+}
+
+// captureAnalyzer accumulates the rates of one or more captures; analyze
+// uses one per capture, compare one per side.
+type captureAnalyzer struct {
+	tracks    map[seriesKey]*seriesTrack
+	intervals []float64
+	captures  int
+	samples   int
+	start     time.Time
+	end       time.Time
+	seconds   float64
+}
+
+func newCaptureAnalyzer() *captureAnalyzer {
+	return &captureAnalyzer{tracks: map[seriesKey]*seriesTrack{}}
+}
+
+// tickGroups tells apart the ticks the groups of a capture, and the
+// devices of the precise sampler, write on their own: by the group of the
+// capture's metadata the counters of a tick belong to and the devices of
+// the tick.
+type tickGroups struct {
+	// counter to the group listing it, the others are in catchAll
+	groups   map[string]string
+	catchAll string
+}
+
+func newTickGroups(meta *CaptureInfo) tickGroups {
+	g := tickGroups{groups: map[string]string{}}
+	if meta == nil {
+		return g
+	}
+	for _, group := range meta.Groups {
+		if len(group.Counters) == 0 {
+			g.catchAll = group.Name
+		}
+		for _, counter := range group.Counters {
+			g.groups[counter] = group.Name
+		}
+	}
+	return g
+}
+
+// key is "<group>/<device>,..." of a tick with values.
+func (g tickGroups) key(tick capfile.Tick) string {
+	group, ok := g.groups[tick.Values[0].Counter]
+	if !ok {
+		group = g.catchAll
+	}
+	var devices []string
+	for _, v := range tick.Values {
+		if !slices.Contains(devices, v.IBDev) {
+			devices = append(devices, v.IBDev)
+		}
+	}
+	sort.Strings(devices)
+	return group + "/" + strings.Join(devices, ",")
+}
+
+// read adds a whole capture; meta, if known, tells its groups apart.
+func (a *captureAnalyzer) read(r tickReader, meta *CaptureInfo) error {
+	a.captures++
+	var first, last time.Time
+	ticks := 0
+	// the samples and sampling are those of the group with the most ticks
+	groups := newTickGroups(meta)
+	groupTicks := map[string]int{}
+	groupLast := map[string]time.Time{}
+	groupIntervals := map[string][]float64{}
+	for {
+		tick, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ticks == 0 || tick.Time.Before(first) {
+			first = tick.Time
+		}
+		if tick.Time.After(last) {
+			last = tick.Time
+		}
+		ticks++
+		if len(tick.Values) > 0 {
+			group := groups.key(tick)
+			if prev, ok := groupLast[group]; ok {
+				groupIntervals[group] = append(groupIntervals[group], tick.Time.Sub(prev).Seconds())
+			}
+			groupLast[group] = tick.Time
+			groupTicks[group]++
+		}
+
+		for _, v := range tick.Values {
+			if isGaugeCounter(v.Counter) {
+				continue
+			}
+			key := seriesKey{IBDev: v.IBDev, Counter: v.Counter}
+			t, ok := a.tracks[key]
+			if !ok {
+				t = &seriesTrack{netDev: v.NetDev, linkType: v.LinkType}
+				a.tracks[key] = t
+			}
+			if seconds := tick.Time.Sub(t.prevAt).Seconds(); t.capture == a.captures && seconds > 0 && v.Value >= t.prev {
+				t.rates = append(t.rates, (v.Value-t.prev)/seconds)
+				t.times = append(t.times, tick.Time)
+				t.intervals = append(t.intervals, seconds)
+				t.increase += v.Value - t.prev
+			}
+			t.prev, t.prevAt, t.capture = v.Value, tick.Time, a.captures
+		}
+	}
+	if ticks == 0 {
+		return errors.New("no samples")
+	}
+	samples := 0
+	var intervals []float64
+	for group, n := range groupTicks {
+		if n > samples {
+			samples, intervals = n, groupIntervals[group]
+		}
+	}
+	a.intervals = append(a.intervals, intervals...)
+	if a.samples == 0 || first.Before(a.start) {
+		a.start = first
+	}
+	if last.After(a.end) {
+		a.end = last
+	}
+	a.samples += samples
+	a.seconds += last.Sub(first).Seconds()
+	return nil
+}
+
+func (a *captureAnalyzer) sampling() SamplingAnalysis {
+	s := SamplingAnalysis{Samples: a.samples}
+	if len(a.intervals) == 0 {
+		return s
+	}
+	median := summarize(a.intervals).P50
+	jitter := make([]float64, len(a.intervals))
+	sum := 0.0
+	for i, interval := range a.intervals {
+		jitter[i] = math.Abs(interval - median)
+		sum += interval
+		if interval > 1.5*median {
+			s.Gaps++
+		}
+	}
+	s.MedianIntervalSeconds = median
+	s.MeanIntervalSeconds = sum / float64(len(a.intervals))
+	s.JitterSeconds = summarize(jitter)
+	return s
+}
+
+// keys returns the series sorted by device and counter.
+func (a *captureAnalyzer) keys() []seriesKey {
+	keys := make([]seriesKey, 0, len(a.tracks))
+	for key := range a.tracks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].IBDev != keys[j].IBDev {
+			return keys[i].IBDev < keys[j].IBDev
+		}
+		return keys[i].Counter < keys[j].Counter
+	})
+	return keys
+}
+
+// gbps converts the rates of a byte counter to Gb/s, nil for other counters.
+func (t *seriesTrack) gbps(counter string) []float64 {
+	unit := counterBytesPerUnit(counter)
+	if unit == 0 {
+		return nil
+	}
+	gbps := make([]float64, len(t.rates))
+	for i, rate := range t.rates {
+		gbps[i] = rate * unit * 8 / 1e9
+	}
+	return gbps
+}
+
+func (a *captureAnalyzer) devices() []DeviceAnalysis {
+	devices := []DeviceAnalysis{}
+	for _, key := range a.keys() {
+		t := a.tracks[key]
+		if len(devices) == 0 || devices[len(devices)-1].IBDev != key.IBDev {
+			devices = append(devices, DeviceAnalysis{
+				IBDev:      key.IBDev,
+				NetDev:     t.netDev,
+				LinkType:   t.linkType,
+				Throughput: []Throughput{},
+				Errors:     []CounterIncrease{},
+				Discards:   []CounterIncrease{},
+				Pauses:     []CounterIncrease{},
+				Rates:      []CounterRates{},
+			})
+		}
+		dev := &devices[len(devices)-1]
+		dev.Rates = append(dev.Rates, CounterRates{Counter: key.Counter, Increase: t.increase, PerSecond: summarize(t.rates)})
+
+		if gbps := t.gbps(key.Counter); gbps != nil {
+			dev.Throughput = append(dev.Throughput, Throughput{Counter: key.Counter, Bytes: t.increase * counterBytesPerUnit(key.Counter), Gbps: summarize(gbps)})
+		}
+		if t.increase <= 0 {
+			continue
+		}
+		increase := CounterIncrease{Counter: key.Counter, Increase: t.increase}
+		switch counterClass(key.Counter) {
+		case counterClassDiscard:
+			dev.Discards = append(dev.Discards, increase)
+		case counterClassPause:
+			dev.Pauses = append(dev.Pauses, increase)
+		case counterClassError:
+			dev.Errors = append(dev.Errors, increase)
+		}
+	}
+	return devices
+}
+
+func (a *captureAnalyzer) analysis(name string) CaptureAnalysis {
+	return CaptureAnalysis{
+		Capture:         name,
+		Start:           a.start,
+		End:             a.end,
+		DurationSeconds: a.seconds,
+		Sampling:        a.sampling(),
+		Devices:         a.devices(),
+	}
+}
+
+// formatBytes prints a byte count with a decimal unit.
+func formatBytes(b float64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB", "PB"}
+	i := 0
+	for b >= 1000 && i < len(units)-1 {
+		b /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", b, units[i])
+}
+
+func formatIncreases(increases []CounterIncrease) string {
+	if len(increases) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(increases))
+	for i, c := range increases {
+		parts[i] = fmt.Sprintf("%s +%g", c.Counter, c.Increase)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func milliseconds(seconds float64) string {
+	return fmt.Sprintf("%.3fms", seconds*1000)
+}
+
+func writeAnalysisText(w io.Writer, report AnalysisReport, all bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, a := range report.Captures {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		s := a.Sampling
+		fmt.Fprintf(tw, "Capture %s\n", a.Capture)
+		fmt.Fprintf(tw, "  %s to %s, %.1fs, %d samples\n", a.Start.Format(time.RFC3339Nano), a.End.Format(time.RFC3339Nano), a.DurationSeconds, s.Samples)
+		fmt.Fprintf(tw, "  Sampling: interval %s median, %s mean; jitter p50 %s, p99 %s, max %s; %d gaps\n",
+			milliseconds(s.MedianIntervalSeconds), milliseconds(s.MeanIntervalSeconds),
+			milliseconds(s.JitterSeconds.P50), milliseconds(s.JitterSeconds.P99), milliseconds(s.JitterSeconds.Max), s.Gaps)
+		for _, dev := range a.Devices {
+			fmt.Fprintf(tw, "\n  %s (%s, %s)\n", dev.IBDev, dev.NetDev, dev.LinkType)
+			if len(dev.Throughput) > 0 {
+				fmt.Fprintf(tw, "    Gb/s\tmin\tmean\tp50\tp99\tmax\ttotal\t\n")
+				for _, t := range dev.Throughput {
+					fmt.Fprintf(tw, "    %s\t%.3f\t%.3f\t%.3f\t%.3f\t%.3f\t%s\t\n", t.Counter, t.Gbps.Min, t.Gbps.Mean, t.Gbps.P50, t.Gbps.P99, t.Gbps.Max, formatBytes(t.Bytes))
+				}
+			}
+			fmt.Fprintf(tw, "    Errors: %s\n", formatIncreases(dev.Errors))
+			fmt.Fprintf(tw, "    Discards: %s\n", formatIncreases(dev.Discards))
+			fmt.Fprintf(tw, "    Pauses: %s\n", formatIncreases(dev.Pauses))
+			if all {
+				fmt.Fprintf(tw, "    per second\tmin\tmean\tp50\tp99\tmax\tincrease\t\n")
+				for _, r := range dev.Rates {
+					fmt.Fprintf(tw, "    %s\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%g\t\n", r.Counter, r.PerSecond.Min, r.PerSecond.Mean, r.PerSecond.P50, r.PerSecond.P99, r.PerSecond.Max, r.Increase)
+				}
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func writeAnalysisMarkdown(w io.Writer, report AnalysisReport, all bool) error {
+	var b strings.Builder
+	for _, a := range report.Captures {
+		s := a.Sampling
+		fmt.Fprintf(&b, "## %s\n\n", a.Capture)
+		fmt.Fprintf(&b, "%s to %s, %.1fs, %d samples\n\n", a.Start.Format(time.RFC3339Nano), a.End.Format(time.RFC3339Nano), a.DurationSeconds, s.Samples)
+		fmt.Fprintf(&b, "| interval median | interval mean | jitter p50 | jitter p99 | jitter max | gaps |\n|---|---|---|---|---|---|\n")
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s | %d |\n\n",
+			milliseconds(s.MedianIntervalSeconds), milliseconds(s.MeanIntervalSeconds),
+			milliseconds(s.JitterSeconds.P50), milliseconds(s.JitterSeconds.P99), milliseconds(s.JitterSeconds.Max), s.Gaps)
+		for _, dev := range a.Devices {
+			fmt.Fprintf(&b, "### %s (%s, %s)\n\n", dev.IBDev, dev.NetDev, dev.LinkType)
+			if len(dev.Throughput) > 0 {
+				fmt.Fprintf(&b, "| Gb/s | min | mean | p50 | p99 | max | total |\n|---|---|---|---|---|---|---|\n")
+				for _, t := range dev.Throughput {
+					fmt.Fprintf(&b, "| %s | %.3f | %.3f | %.3f | %.3f | %.3f | %s |\n", t.Counter, t.Gbps.Min, t.Gbps.Mean, t.Gbps.P50, t.Gbps.P99, t.Gbps.Max, formatBytes(t.Bytes))
+				}
+				b.WriteString("\n")
+			}
+			fmt.Fprintf(&b, "- Errors: %s\n- Discards: %s\n- Pauses: %s\n\n", formatIncreases(dev.Errors), formatIncreases(dev.Discards), formatIncreases(dev.Pauses))
+			if all {
+				fmt.Fprintf(&b, "| per second | min | mean | p50 | p99 | max | increase |\n|---|---|---|---|---|---|---|\n")
+				for _, r := range dev.Rates {
+					fmt.Fprintf(&b, "| %s | %.2f | %.2f | %.2f | %.2f | %.2f | %g |\n", r.Counter, r.PerSecond.Min, r.PerSecond.Mean, r.PerSecond.P50, r.PerSecond.P99, r.PerSecond.Max, r.Increase)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// runAnalyze implements "ib-exporter analyze [-format text|json|markdown]
+// [-all] <file|archive>...".
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	format := fs.String("format", "text", "Output format: text, json or markdown")
+	all := fs.Bool("all", false, "Also print the rates of every counter in text and markdown; json always has them")
+	files, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("usage: ib-exporter analyze [-format text|json|markdown] [-all] <file|archive>...")
+	}
+	if *format != "text" && *format != "json" && *format != "markdown" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	report := AnalysisReport{Captures: []CaptureAnalysis{}}
+	for _, path := range files {
+		err := forEachCapture(path, func(name string, r tickReader, meta *CaptureInfo) error {
+			a := newCaptureAnalyzer()
+			if err := a.read(r, meta); err != nil {
+				return err
+			}
+			report.Captures = append(report.Captures, a.analysis(name))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "markdown":
+		return writeAnalysisMarkdown(os.Stdout, report, *all)
+	}
+	return writeAnalysisText(os.Stdout, report, *all)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"ib-exporter/capfile"
+)
+
+// ticksReader is a capture of ticks.
+type ticksReader struct {
+	ticks []capfile.Tick
+}
+
+func (r *ticksReader) Next() (capfile.Tick, error) {
+	if len(r.ticks) == 0 {
+		return capfile.Tick{}, io.EOF
+	}
+	tick := r.ticks[0]
+	r.ticks = r.ticks[1:]
+	return tick, nil
+}
+
+func (r *ticksReader) Close() error { return nil }
+
+func value(dev, counter string, v float64) capfile.Value {
+	return capfile.Value{Series: capfile.Series{IBDev: dev, NetDev: "eth" + dev[len(dev)-1:], LinkType: "Ethernet", Counter: counter}, Value: v}
+}
+
+var analyzeStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) time.Time {
+	return analyzeStart.Add(d)
+}
+
+func analyzeTicks(t *testing.T, ticks []capfile.Tick, meta *CaptureInfo) CaptureAnalysis {
+	t.Helper()
+	a := newCaptureAnalyzer()
+	if err := a.read(&ticksReader{ticks: ticks}, meta); err != nil {
+		t.Fatal(err)
+	}
+	return a.analysis("test")
+}
+
+func TestSummarize(t *testing.T) {
+	var hundred []float64
+	for i := 100; i >= 1; i-- {
+		hundred = append(hundred, float64(i))
+	}
+	for _, tc := range []struct {
+		name   string
+		values []float64
+		want   Stats
+	}{
+		{"none", nil, Stats{}},
+		{"one", []float64{3}, Stats{Min: 3, Mean: 3, P50: 3, P99: 3, Max: 3}},
+		// nearest rank: the 50th and 99th of 100
+		{"hundred", hundred, Stats{Min: 1, Mean: 50.5, P50: 50, P99: 99, Max: 100}},
+		{"even", []float64{4, 1, 3, 2}, Stats{Min: 1, Mean: 2.5, P50: 2, P99: 4, Max: 4}},
+	} {
+		if got := summarize(tc.values); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAnalyzeRates(t *testing.T) {
+	// 1 GB in port_rcv_data's 4-byte words, 8 Gb/s in the first second and
+	// 16 in the next two
+	words := 1e9 / apiInfiniBandDataUnit
+	ticks := []capfile.Tick{
+		{Time: at(0), Values: []capfile.Value{
+			value("mlx5_0", "port_rcv_data", 0), value("mlx5_0", "tx_bytes", 0), value("mlx5_0", "rx_discards_phy", 5),
+			value("mlx5_0", "rx_pause_ctrl_phy", 0), value("mlx5_0", "QPNum", 10)}},
+		{Time: at(time.Second), Values: []capfile.Value{
+			value("mlx5_0", "port_rcv_data", words), value("mlx5_0", "tx_bytes", 500), value("mlx5_0", "rx_discards_phy", 7),
+			value("mlx5_0", "rx_pause_ctrl_phy", 0), value("mlx5_0", "QPNum", 20)}},
+		{Time: at(3 * time.Second), Values: []capfile.Value{
+			value("mlx5_0", "port_rcv_data", 5*words), value("mlx5_0", "tx_bytes", 100), value("mlx5_0", "rx_discards_phy", 10),
+			value("mlx5_0", "rx_pause_ctrl_phy", 0), value("mlx5_0", "QPNum", 5)}},
+	}
+	a := analyzeTicks(t, ticks, nil)
+	if a.Sampling.Samples != 3 || a.DurationSeconds != 3 {
+		t.Errorf("%d samples over %gs", a.Sampling.Samples, a.DurationSeconds)
+	}
+	if len(a.Devices) != 1 {
+		t.Fatalf("devices %+v", a.Devices)
+	}
+	dev := a.Devices[0]
+	if dev.IBDev != "mlx5_0" || dev.NetDev != "eth0" || dev.LinkType != "Ethernet" {
+		t.Errorf("device %s (%s, %s)", dev.IBDev, dev.NetDev, dev.LinkType)
+	}
+
+	throughput := map[string]Throughput{}
+	for _, tp := range dev.Throughput {
+		throughput[tp.Counter] = tp
+	}
+	if len(throughput) != 2 {
+		t.Errorf("throughput of %+v", dev.Throughput)
+	}
+	// the words are scaled to bytes
+	if rcv := throughput["port_rcv_data"]; rcv.Bytes != 5e9 || rcv.Gbps != (Stats{Min: 8, Mean: 12, P50: 8, P99: 16, Max: 16}) {
+		t.Errorf("port_rcv_data %+v", rcv)
+	}
+	// the reset interval is skipped
+	if tx := throughput["tx_bytes"]; tx.Bytes != 500 || tx.Gbps.Max != 500*8/1e9 {
+		t.Errorf("tx_bytes %+v", tx)
+	}
+
+	if len(dev.Discards) != 1 || dev.Discards[0] != (CounterIncrease{"rx_discards_phy", 5}) {
+		t.Errorf("discards %+v", dev.Discards)
+	}
+	if len(dev.Pauses) != 0 || len(dev.Errors) != 0 {
+		t.Errorf("pauses %+v, errors %+v", dev.Pauses, dev.Errors)
+	}
+	// the gauge has no rates
+	var counters []string
+	for _, r := range dev.Rates {
+		counters = append(counters, r.Counter)
+	}
+	if want := []string{"port_rcv_data", "rx_discards_phy", "rx_pause_ctrl_phy", "tx_bytes"}; !slices.Equal(counters, want) {
+		t.Errorf("rates of %q, want %q", counters, want)
+	}
+	if r := dev.Rates[1]; r.Increase != 5 || r.PerSecond.Min != 1.5 || r.PerSecond.Max != 2 {
+		t.Errorf("rx_discards_phy rates %+v", r)
+	}
+}
+
+// A capture with a precise group, a tick per device every 10ms, and a full
+// group every 50ms.
+func groupTicks() []capfile.Tick {
+	var ticks []capfile.Tick
+	for i := range 20 {
+		for d, dev := range []string{"mlx5_0", "mlx5_1"} {
+			tick := capfile.Tick{Time: at(time.Duration(i)*10*time.Millisecond + time.Duration(d)*time.Millisecond)}
+			// a read error leaves out a counter
+			if i != 7 {
+				tick.Values = append(tick.Values, value(dev, "port_rcv_data", float64(i)))
+			}
+			tick.Values = append(tick.Values, value(dev, "port_xmit_data", float64(i)))
+			ticks = append(ticks, tick)
+		}
+		if i%5 == 0 {
+			ticks = append(ticks, capfile.Tick{Time: at(time.Duration(i)*10*time.Millisecond + 5*time.Millisecond),
+				Values: []capfile.Value{value("mlx5_0", "np_cnp_sent", float64(i)), value("mlx5_1", "np_cnp_sent", float64(i))}})
+		}
+	}
+	return ticks
+}
+
+func TestAnalyzeGroups(t *testing.T) {
+	meta := &CaptureInfo{Groups: []CaptureGroupInfo{
+		{CaptureGroupRequest: CaptureGroupRequest{Name: "data", Interval: "10ms", Counters: []string{"port_rcv_data", "port_xmit_data"}, Sampler: captureSamplerPrecise}},
+		{CaptureGroupRequest: CaptureGroupRequest{Name: "rest", Interval: "50ms", Sampler: captureSamplerFull}},
+	}}
+	for _, tc := range []struct {
+		name string
+		meta *CaptureInfo
+	}{
+		{"groups", meta},
+		// the devices still tell the precise ticks apart
+		{"no metadata", nil},
+	} {
+		s := analyzeTicks(t, groupTicks(), tc.meta).Sampling
+		if s.Samples != 20 || s.Gaps != 0 {
+			t.Errorf("%s: %d samples, %d gaps", tc.name, s.Samples, s.Gaps)
+		}
+		if math.Abs(s.MedianIntervalSeconds-0.01) > 1e-9 || s.JitterSeconds.Max > 1e-9 {
+			t.Errorf("%s: interval %gs, jitter up to %gs", tc.name, s.MedianIntervalSeconds, s.JitterSeconds.Max)
+		}
+	}
+
+	// the full group alone
+	var full []capfile.Tick
+	for _, tick := range groupTicks() {
+		if tick.Values[0].Counter == "np_cnp_sent" {
+			full = append(full, tick)
+		}
+	}
+	if s := analyzeTicks(t, full, meta).Sampling; s.Samples != 4 || math.Abs(s.MedianIntervalSeconds-0.05) > 1e-9 {
+		t.Errorf("full group: %d samples, interval %gs", s.Samples, s.MedianIntervalSeconds)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The JSON API is versioned in its path and in every response body; fields
+// are only ever added within a version. The schema is documented in docs/api.md.
+const (
+	apiVersion            = "v1"
+	apiDefaultRateWindow  = time.Second
+	apiMaxRateWindow      = time.Minute
+	apiMinRateWindow      = 100 * time.Millisecond
+	apiInfiniBandDataUnit = 4 // port_rcv_data and port_xmit_data count 4-byte words
+	// requests this close share a collection
+	apiSnapshotMaxAge = time.Second
+)
+
+var (
+	lastSnapshot snapshotHistory
+
+	// apiCollectMu lets one request at a time collect, the others find its
+	// snapshot
+	apiCollectMu sync.Mutex
+)
+
+// snapshotHistory remembers the latest collection so rates can be computed
+// against it without sampling twice.
+type snapshotHistory struct {
+	mu   sync.Mutex
+	last *Snapshot
+}
+
+func (h *snapshotHistory) advance(snap *Snapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = snap
+}
+
+func (h *snapshotHistory) get() *Snapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+type APIError struct {
+	APIVersion string `json:"api_version"`
+	Error      string `json:"error"`
+}
+
+// APIDevice is an inventory entry plus the identity read from sysfs when the
+// identity collector is enabled.
+type APIDevice struct {
+	IBDevice
+	Identity *DeviceIdentity `json:"identity,omitempty"`
+}
+
+type DevicesResponse struct {
+	APIVersion  string      `json:"api_version"`
+	CollectedAt time.Time   `json:"collected_at"`
+	Devices     []APIDevice `json:"devices"`
+}
+
+type CountersResponse struct {
+	APIVersion  string      `json:"api_version"`
+	CollectedAt time.Time   `json:"collected_at"`
+	Counters    []IBCounter `json:"counters"`
+}
+
+// CounterRate is the change of a cumulative counter between two collections.
+// Gbps is only set for byte and data counters.
+type CounterRate struct {
+	IBDev       string   `json:"ib_dev"`
+	NetDev      string   `json:"net_dev"`
+	CounterName string   `json:"counter_name"`
+	Delta       float64  `json:"delta"`
+	PerSecond   float64  `json:"per_second"`
+	Gbps        *float64 `json:"gbps,omitempty"`
+}
+
+type RatesResponse struct {
+	APIVersion      string        `json:"api_version"`
+	CollectedAt     time.Time     `json:"collected_at"`
+	IntervalSeconds float64       `json:"interval_seconds"`
+	Rates           []CounterRate `json:"rates"`
+}
+
+// isGaugeCounter reports counters that hold a current value rather than a
+// running total, they have no meaningful rate.
+func isGaugeCounter(name string) bool {
+	switch name {
+	case "portSpeed", "QPNum", "MRNum":
+		return true
+	}
+	return strings.HasPrefix(name, "module_")
+}
+
+// counterBytesPerUnit is the number of bytes one unit of the counter stands
+// for, 0 for counters that don't count bytes.
+func counterBytesPerUnit(name string) float64 {
+	switch {
+	case name == "port_rcv_data" || name == "port_xmit_data":
+		return apiInfiniBandDataUnit
+	case strings.HasSuffix(name, "_bytes"):
+		return 1
+	}
+	return 0
+}
+
+// computeRates pairs up the cumulative counters of two collections. Counters
+// that went backwards were reset by the driver and are left out.
+func computeRates(prev, cur []IBCounter, seconds float64) []CounterRate {
+	rates := []CounterRate{}
+	if seconds <= 0 {
+		return rates
+	}
+	previous := make(map[string]float64, len(prev))
+	for _, c := range prev {
+		previous[c.IBDev+"/"+c.CounterName] = c.CounterValue
+	}
+	for _, c := range cur {
+		if isGaugeCounter(c.CounterName) {
+			continue
+		}
+		before, ok := previous[c.IBDev+"/"+c.CounterName]
+		if !ok || c.CounterValue < before {
+			continue
+		}
+		rate := CounterRate{
+			IBDev:       c.IBDev,
+			NetDev:      c.NetDev,
+			CounterName: c.CounterName,
+			Delta:       c.CounterValue - before,
+			PerSecond:   (c.CounterValue - before) / seconds,
+		}
+		if unit := counterBytesPerUnit(c.CounterName); unit > 0 {
+			gbps := rate.PerSecond * unit * 8 / 1e9
+			rate.Gbps = &gbps
+		}
+		rates = append(rates, rate)
+	}
+	return rates
+}
+
+// counterSelector narrows counters down to the requested devices and counter
+// names. Query parameters may repeat or hold comma separated lists.
+type counterSelector struct {
+	devices map[string]bool
+	names   map[string]bool
+	// names never selected, those of the other groups of a capture
+	exclude map[string]bool
+}
+
+func stringSet(values []string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				set[item] = true
+			}
+		}
+	}
+	return set
+}
+
+func queryList(r *http.Request, key string) map[string]bool {
+	return stringSet(r.URL.Query()[key])
+}
+
+func newCounterSelector(devices, names []string) counterSelector {
+	return counterSelector{devices: stringSet(devices), names: stringSet(names)}
+}
+
+func selectorFromRequest(r *http.Request) counterSelector {
+	return newCounterSelector(r.URL.Query()["device"], r.URL.Query()["name"])
+}
+
+func (s counterSelector) match(IBDev, name string) bool {
+	if len(s.devices) > 0 && !s.devices[IBDev] {
+		return false
+	}
+	if s.exclude[name] {
+		return false
+	}
+	return len(s.names) == 0 || s.names[name]
+}
+
+func (s counterSelector) counters(counters []IBCounter) []IBCounter {
+	selected := []IBCounter{}
+	for _, c := range counters {
+		if s.match(c.IBDev, c.CounterName) {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("fail to encode api response: %v", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeAPIJSON(w, status, APIError{APIVersion: apiVersion, Error: fmt.Sprintf(format, args...)})
+}
+
+// apiGet answers a request with another method than GET.
+func apiGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return false
+	}
+	return true
+}
+
+// apiSnapshot returns the last collection for a GET request when it is
+// younger than maxAge and collects otherwise, without the MRRS fix, which
+// is left to the scrapes. It answers the request itself when that fails.
+func apiSnapshot(w http.ResponseWriter, r *http.Request, maxAge time.Duration) (*Snapshot, bool) {
+	if !apiGet(w, r) {
+		return nil, false
+	}
+	apiCollectMu.Lock()
+	defer apiCollectMu.Unlock()
+	if snap := lastSnapshot.get(); snap != nil && time.Since(snap.CollectedAt) < maxAge {
+		return snap, true
+	}
+	snap, err := collectSnapshot(false)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "collection failed: %v", err)
+		return nil, false
+	}
+	return snap, true
+}
+
+func apiDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	snap, ok := apiSnapshot(w, r, apiSnapshotMaxAge)
+	if !ok {
+		return
+	}
+	identities := make(map[string]*DeviceIdentity, len(snap.Identities))
+	for i := range snap.Identities {
+		identities[snap.Identities[i].Device] = &snap.Identities[i]
+	}
+	wanted := queryList(r, "device")
+	resp := DevicesResponse{APIVersion: apiVersion, CollectedAt: snap.CollectedAt, Devices: []APIDevice{}}
+	for _, dev := range snap.Devices {
+		if len(wanted) > 0 && !wanted[dev.Name] {
+			continue
+		}
+		resp.Devices = append(resp.Devices, APIDevice{IBDevice: dev, Identity: identities[dev.Name]})
+	}
+	sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].Name < resp.Devices[j].Name })
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+func apiCountersHandler(w http.ResponseWriter, r *http.Request) {
+	snap, ok := apiSnapshot(w, r, apiSnapshotMaxAge)
+	if !ok {
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, CountersResponse{
+		APIVersion:  apiVersion,
+		CollectedAt: snap.CollectedAt,
+		Counters:    selectorFromRequest(r).counters(snap.Counters),
+	})
+}
+
+// apiRatesHandler computes rates against the previous collection, whoever
+// triggered it, collecting at most once. With ?interval=, or without a
+// previous collection at least apiMinRateWindow old, it reads the sysfs and
+// ethtool counters twice, interval apart, like the stream: the counters a
+// full collection adds are gauges without a rate.
+func apiRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiGet(w, r) {
+		return
+	}
+	window := time.Duration(0)
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < apiMinRateWindow || d > apiMaxRateWindow {
+			writeAPIError(w, http.StatusBadRequest, "interval must be a duration between %s and %s", apiMinRateWindow, apiMaxRateWindow)
+			return
+		}
+		window = d
+	}
+
+	prev := lastSnapshot.get()
+	if window == 0 && (prev == nil || time.Since(prev.CollectedAt) < apiMinRateWindow) {
+		window = apiDefaultRateWindow
+	}
+	var snap *Snapshot
+	if window > 0 {
+		var err error
+		if prev, err = sampleCounters(); err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "counter sample failed: %v", err)
+			return
+		}
+		select {
+		case <-time.After(window):
+		case <-r.Context().Done():
+			return
+		}
+		if snap, err = sampleCounters(); err != nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "counter sample failed: %v", err)
+			return
+		}
+	} else {
+		var ok bool
+		// a collection apiMinRateWindow after prev, by another request in
+		// between or this one
+		if snap, ok = apiSnapshot(w, r, time.Since(prev.CollectedAt)-apiMinRateWindow); !ok {
+			return
+		}
+	}
+
+	selector := selectorFromRequest(r)
+	seconds := snap.CollectedAt.Sub(prev.CollectedAt).Seconds()
+	writeAPIJSON(w, http.StatusOK, RatesResponse{
+		APIVersion:      apiVersion,
+		CollectedAt:     snap.CollectedAt,
+		IntervalSeconds: seconds,
+		Rates:           computeRates(selector.counters(prev.Counters), selector.counters(snap.Counters), seconds),
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHelper answers helper requests with counters of value and records
+// the requests.
+type fakeHelper struct {
+	mu       sync.Mutex
+	requests []HelperRequest
+	value    float64
+}
+
+func startFakeHelper(t *testing.T, value float64) *fakeHelper {
+	t.Helper()
+	h := &fakeHelper{value: value}
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var req HelperRequest
+			json.NewDecoder(conn).Decode(&req)
+			h.mu.Lock()
+			h.requests = append(h.requests, req)
+			value := h.value
+			h.value += 100
+			h.mu.Unlock()
+			json.NewEncoder(conn).Encode(&Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now(),
+				Counters: []IBCounter{{IBDev: "mlx5_0", CounterName: "port_rcv_data", CounterValue: value}}})
+			conn.Close()
+		}
+	}()
+	c := *cfg()
+	c.Helper.Socket = socket
+	previous := cfg()
+	currentConfig.Store(&c)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return h
+}
+
+func (h *fakeHelper) methods() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var methods []string
+	for _, req := range h.requests {
+		methods = append(methods, req.Method)
+	}
+	return methods
+}
+
+// useLastSnapshot makes a collection of value, age old, the last one.
+func useLastSnapshot(t *testing.T, value float64, age time.Duration) {
+	previous := lastSnapshot.get()
+	lastSnapshot.advance(&Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now().Add(-age),
+		Counters: []IBCounter{{IBDev: "mlx5_0", CounterName: "port_rcv_data", CounterValue: value}}})
+	t.Cleanup(func() { lastSnapshot.advance(previous) })
+}
+
+func apiGetJSON(t *testing.T, handler http.HandlerFunc, url string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("%s: %v", url, err)
+	}
+	return rec.Code
+}
+
+func TestAPICountersSnapshot(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		age     time.Duration
+		value   float64
+		methods []string
+	}{
+		{"recent", 100 * time.Millisecond, 1, nil},
+		{"stale", 2 * apiSnapshotMaxAge, 7, []string{helperMethodSnapshot}},
+	} {
+		helper := startFakeHelper(t, 7)
+		useLastSnapshot(t, 1, tc.age)
+		var resp CountersResponse
+		if code := apiGetJSON(t, apiCountersHandler, "/api/v1/counters", &resp); code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.name, code)
+		}
+		if len(resp.Counters) != 1 || resp.Counters[0].CounterValue != tc.value {
+			t.Errorf("%s: counters %+v", tc.name, resp.Counters)
+		}
+		if methods := helper.methods(); !slices.Equal(methods, tc.methods) {
+			t.Errorf("%s: helper requests %q, want %q", tc.name, methods, tc.methods)
+		}
+		// the scrapes fix the MRRS, not the API
+		helper.mu.Lock()
+		for _, req := range helper.requests {
+			if !req.SkipMRRS {
+				t.Errorf("%s: API collection fixes the MRRS", tc.name)
+			}
+		}
+		helper.mu.Unlock()
+	}
+}
+
+func TestAPIRatesSnapshots(t *testing.T) {
+	for _, tc := range []struct {
+		name, url string
+		age       time.Duration
+		methods   []string
+		delta     float64
+	}{
+		// against the previous collection, with one more
+		{"previous", "/api/v1/rates", time.Second, []string{helperMethodSnapshot}, 600},
+		// two counter samples, no collection
+		{"interval", "/api/v1/rates?interval=100ms", time.Second, []string{helperMethodCounters, helperMethodCounters}, 100},
+		{"previous too recent", "/api/v1/rates", 10 * time.Millisecond, []string{helperMethodCounters, helperMethodCounters}, 100},
+	} {
+		helper := startFakeHelper(t, 1000)
+		useLastSnapshot(t, 400, tc.age)
+		var resp RatesResponse
+		if code := apiGetJSON(t, apiRatesHandler, tc.url, &resp); code != http.StatusOK {
+			t.Fatalf("%s: status %d", tc.name, code)
+		}
+		if methods := helper.methods(); !slices.Equal(methods, tc.methods) {
+			t.Errorf("%s: helper requests %q, want %q", tc.name, methods, tc.methods)
+		}
+		if len(resp.Rates) != 1 || resp.Rates[0].Delta != tc.delta || resp.IntervalSeconds <= 0 {
+			t.Errorf("%s: rates %+v over %gs", tc.name, resp.Rates, resp.IntervalSeconds)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	archiveFormatZip    = "zip"
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatTarZst = "tar.zst"
+	archivePrefix       = "ibtestdata_"
+	// every archive ends with a manifest in the format of sha256sum, so
+	// "sha256sum -c SHA256SUMS" checks an extracted archive
+	archiveManifestName = "SHA256SUMS"
+
+	// data files without metadata written to this recently may belong to a
+	// capture of another process, like -runonce next to the daemon
+	archiveSettleTime = time.Minute
+
+	archiveDeletedCount = "count"
+	archiveDeletedAge   = "age"
+	archiveDeletedSize  = "size"
+)
+
+var archiveFormats = []string{archiveFormatZip, archiveFormatTarGz, archiveFormatTarZst}
+
+var (
+	archivesCreatedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_archives_created_total",
+		Help: "Capture archives created",
+	})
+	archivesDeletedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ib_archives_deleted_total",
+		Help: "Capture archives deleted by retention, by the limit that deleted them",
+	}, []string{"reason"})
+	archiveFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_archive_failures_total",
+		Help: "Archive checks that failed",
+	})
+	archivesAwaitingUploadGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ib_archives_awaiting_upload",
+		Help: "Archives beyond the retention limits kept because they are not uploaded yet",
+	})
+)
+
+// activeCaptureFiles are the data files still being written. createCaptureFile
+// adds them and writeCaptureMetadata removes them once the capture is
+// complete, so archiving never takes a capture apart from its metadata.
+var activeCaptureFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+func holdCaptureFile(path string) {
+	activeCaptureFiles.Lock()
+	defer activeCaptureFiles.Unlock()
+	activeCaptureFiles.paths[path] = true
+}
+
+func releaseCaptureFile(path string) {
+	activeCaptureFiles.Lock()
+	defer activeCaptureFiles.Unlock()
+	delete(activeCaptureFiles.paths, path)
+}
+
+func captureFileActive(path string) bool {
+	activeCaptureFiles.Lock()
+	defer activeCaptureFiles.Unlock()
+	return activeCaptureFiles.paths[path]
+}
+
+// segmentedCaptures are the running captures the archiver can rotate into
+// a new segment to archive what they have written so far.
+var segmentedCaptures = struct {
+	sync.Mutex
+	writers map[*segmentedCaptureWriter]bool
+}{writers: map[*segmentedCaptureWriter]bool{}}
+
+func trackSegmentedCapture(w *segmentedCaptureWriter) {
+	segmentedCaptures.Lock()
+	defer segmentedCaptures.Unlock()
+	segmentedCaptures.writers[w] = true
+}
+
+func untrackSegmentedCapture(w *segmentedCaptureWriter) {
+	segmentedCaptures.Lock()
+	defer segmentedCaptures.Unlock()
+	delete(segmentedCaptures.writers, w)
+}
+
+// rotateCaptures starts a new segment in every running capture writing to
+// dataDir, so the segments they close can be archived.
+func rotateCaptures(dataDir string) {
+	segmentedCaptures.Lock()
+	var writers []*segmentedCaptureWriter
+	for w := range segmentedCaptures.writers {
+		if filepath.Dir(w.segment().path) == filepath.Clean(dataDir) {
+			writers = append(writers, w)
+		}
+	}
+	segmentedCaptures.Unlock()
+	for _, w := range writers {
+		if err := w.rotate(); err != nil {
+			log.Printf("Could not rotate a running capture: %v", err)
+		}
+	}
+}
+
+// archiveWriter writes the entries of one archive.
+type archiveWriter interface {
+	Create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a zipArchiveWriter) Create(name string, _ int64, modTime time.Time) (io.Writer, error) {
+	return a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+}
+
+func (a zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (a tarArchiveWriter) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	err := a.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+	return a.tw, err
+}
+
+func (a tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if closeErr := a.compressor.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case archiveFormatZip:
+		return zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	case archiveFormatTarGz:
+		gz := gzip.NewWriter(w)
+		return tarArchiveWriter{tw: tar.NewWriter(gz), compressor: gz}, nil
+	case archiveFormatTarZst:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return tarArchiveWriter{tw: tar.NewWriter(enc), compressor: enc}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// isArchiveFile matches the archives manageDataArchives writes.
+func isArchiveFile(name string) bool {
+	base := filepath.Base(name)
+	if !strings.HasPrefix(base, archivePrefix) {
+		return false
+	}
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(base, "."+format) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveEntry is a file read out of an archive.
+type archiveEntry struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (e *archiveEntry) Close() error {
+	var err error
+	for _, c := range slices.Backward(e.closers) {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openArchiveEntry opens the file name in the archive at path, in any of
+// the archive formats, and returns its size and modification time. A
+// missing archive or entry is os.ErrNotExist.
+func openArchiveEntry(path, name string) (io.ReadCloser, int64, time.Time, error) {
+	if strings.HasSuffix(path, "."+archiveFormatZip) {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		for _, f := range zr.File {
+			if f.Name != name {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				zr.Close()
+				return nil, 0, time.Time{}, err
+			}
+			return &archiveEntry{Reader: rc, closers: []io.Closer{zr, rc}}, int64(f.UncompressedSize64), f.Modified, nil
+		}
+		zr.Close()
+		return nil, 0, time.Time{}, fmt.Errorf("%s in %s: %w", name, filepath.Base(path), os.ErrNotExist)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	entry := &archiveEntry{closers: []io.Closer{f}}
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(path, "."+archiveFormatTarGz):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			entry.Close()
+			return nil, 0, time.Time{}, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+		}
+		entry.closers = append(entry.closers, gz)
+		r = gz
+	case strings.HasSuffix(path, "."+archiveFormatTarZst):
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			entry.Close()
+			return nil, 0, time.Time{}, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+		}
+		entry.closers = append(entry.closers, dec.IOReadCloser())
+		r = dec
+	default:
+		entry.Close()
+		return nil, 0, time.Time{}, fmt.Errorf("%s is no archive", filepath.Base(path))
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			entry.Close()
+			return nil, 0, time.Time{}, fmt.Errorf("%s in %s: %w", name, filepath.Base(path), os.ErrNotExist)
+		}
+		if err != nil {
+			entry.Close()
+			return nil, 0, time.Time{}, fmt.Errorf("read %s: %w", filepath.Base(path), err)
+		}
+		if hdr.Name == name {
+			entry.Reader = tr
+			return entry, hdr.Size, hdr.ModTime, nil
+		}
+	}
+}
+
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+func unsettled(dataFile string) bool {
+	if _, err := os.Stat(captureMetadataName(dataFile)); err == nil {
+		return false
+	}
+	info, err := os.Stat(dataFile)
+	return err == nil && time.Since(info.ModTime()) < archiveSettleTime
+}
+
+// archivableFiles are the finished capture files and their metadata in
+// dataDir, in name order.
+func archivableFiles(dataDir string) ([]string, error) {
+	var files []string
+	for _, ext := range []string{captureFileExtension, captureBinaryExtension, captureMetaExtension} {
+		matches, err := filepath.Glob(filepath.Join(dataDir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			if ext == captureMetaExtension {
+				// the metadata goes with its data file
+				base := strings.TrimSuffix(path, ext)
+				if captureFileActive(base+captureFileExtension) || captureFileActive(base+captureBinaryExtension) ||
+					unsettled(base+captureFileExtension) || unsettled(base+captureBinaryExtension) {
+					continue
+				}
+			} else if captureFileActive(path) || unsettled(path) {
+				continue
+			}
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// addArchiveEntry copies a file into the archive and returns its SHA-256.
+func addArchiveEntry(a archiveWriter, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	entry, err := a.Create(filepath.Base(path), stat.Size(), stat.ModTime())
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(entry, hash), f, stat.Size()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// archiveCaptures moves the finished captures of dataDir into a new archive
+// in archiveDir and returns its path, "" when there was nothing to archive.
+// The archive is written under a temporary name and renamed once complete;
+// the captures are only removed after that.
+func archiveCaptures(dataDir, archiveDir, format string) (string, error) {
+	files, err := archivableFiles(dataDir)
+	if err != nil {
+		return "", fmt.Errorf("could not find files to archive: %w", err)
+	}
+	if len(files) == 0 {
+		return "", nil
+	}
+
+	name := archivePrefix + time.Now().Format("20060102_150405")
+	archivePath := filepath.Join(archiveDir, name+"."+format)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+			break
+		}
+		archivePath = filepath.Join(archiveDir, fmt.Sprintf("%s_%d.%s", name, i, format))
+	}
+	tmpPath := archivePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("could not create archive file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	a, err := newArchiveWriter(f, format)
+	if err != nil {
+		return "", err
+	}
+	var manifest strings.Builder
+	var archived []string
+	for _, path := range files {
+		sum, err := addArchiveEntry(a, path)
+		if err != nil {
+			// a file that can't be read is left in place for the next archive,
+			// but a failed write leaves the archive unusable
+			if _, statErr := os.Stat(path); statErr != nil {
+				log.Printf("Skipping %s: %v", filepath.Base(path), err)
+				continue
+			}
+			return "", fmt.Errorf("could not archive %s: %w", filepath.Base(path), err)
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", sum, filepath.Base(path))
+		archived = append(archived, path)
+	}
+	entry, err := a.Create(archiveManifestName, int64(manifest.Len()), time.Now())
+	if err == nil {
+		_, err = io.WriteString(entry, manifest.String())
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write the manifest: %w", err)
+	}
+	if err := a.Close(); err != nil {
+		return "", fmt.Errorf("could not write archive: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", fmt.Errorf("could not write archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("could not write archive: %w", err)
+	}
+	if err := os.Rename(tmpPath, archivePath); err != nil {
+		return "", fmt.Errorf("could not rename archive: %w", err)
+	}
+	for _, path := range archived {
+		os.Remove(path)
+	}
+	captures.archived(archivePath, archived)
+	archivesCreatedCounter.Inc()
+	wakeUploader()
+	log.Printf("Successfully created archive %s with %d files", filepath.Base(archivePath), len(archived))
+	return archivePath, nil
+}
+
+// pruneArchives deletes the archives in archiveDir beyond the retention
+// limits: more than keep, older than maxAge, or, oldest first, beyond
+// maxBytes in total. Zero maxAge or maxBytes is no limit. The newest archive
+// is always kept, and with upload enabled so is every archive that is not
+// uploaded yet. The temporary files of archives that were never completed
+// go as well.
+func pruneArchives(archiveDir string, keep int, maxAge time.Duration, maxBytes int64) error {
+	matches, err := filepath.Glob(filepath.Join(archiveDir, archivePrefix+"*"))
+	if err != nil {
+		return fmt.Errorf("could not find archives for rotation: %w", err)
+	}
+	type archive struct {
+		path string
+		info os.FileInfo
+	}
+	var archives []archive
+	for _, path := range matches {
+		if tmp, ok := strings.CutSuffix(path, ".tmp"); ok && isArchiveFile(tmp) {
+			removeStaleArchive(path)
+			continue
+		}
+		if !isArchiveFile(path) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, archive{path, info})
+	}
+	// newest first; names sort by their timestamp
+	sort.Slice(archives, func(i, j int) bool { return archives[i].path > archives[j].path })
+
+	upload := cfg().Upload
+	awaitingUpload := 0
+	var total int64
+	for i, a := range archives {
+		total += a.info.Size()
+		reason := ""
+		switch {
+		case i == 0:
+		case keep > 0 && i >= keep:
+			reason = archiveDeletedCount
+		case maxAge > 0 && time.Since(a.info.ModTime()) > maxAge:
+			reason = archiveDeletedAge
+		case maxBytes > 0 && total > maxBytes:
+			reason = archiveDeletedSize
+		}
+		if reason == "" {
+			continue
+		}
+		if upload.Enabled && !uploadedBefore(a.path, upload.objectKey(a.path, a.info.ModTime()), a.info) {
+			awaitingUpload++
+			continue
+		}
+		total -= a.info.Size()
+		log.Printf("Deleting old archive %s (%s limit)", filepath.Base(a.path), reason)
+		if err := os.Remove(a.path); err != nil {
+			log.Printf("Could not delete %s: %v", a.path, err)
+			continue
+		}
+		os.Remove(a.path + uploadMarkerExtension)
+		archivesDeletedCounter.WithLabelValues(reason).Inc()
+	}
+	archivesAwaitingUploadGauge.Set(float64(awaitingUpload))
+	if awaitingUpload > 0 {
+		log.Printf("Keeping %d archives beyond the retention limits until they are uploaded", awaitingUpload)
+	}
+	return nil
+}
+
+// removeStaleArchive deletes the temporary file of an archive that a crash
+// or a full disk left behind, once nothing has written to it for a while.
+func removeStaleArchive(path string) {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) < archiveSettleTime {
+		return
+	}
+	log.Printf("Deleting incomplete archive %s", filepath.Base(path))
+	if err := os.Remove(path); err != nil {
+		log.Printf("Could not delete %s: %v", path, err)
+	}
+}
+
+// manageDataArchives archives the finished captures once the data directory
+// has grown beyond the threshold, into the directory above it, and applies
+// the retention limits to the archives there. Running captures are rotated
+// first, so what they have written so far is archived as well.
+func manageDataArchives(c CaptureConfig) error {
+	dataDir := c.DataPath
+	archiveDir := filepath.Dir(dataDir)
+	totalSize, err := dirSize(dataDir)
+	if err != nil {
+		return fmt.Errorf("could not calculate directory size: %w", err)
+	}
+	thresholdBytes := int64(c.ArchiveThresholdMB) * 1024 * 1024
+	if totalSize >= thresholdBytes {
+		rotateCaptures(dataDir)
+		if _, err := archiveCaptures(dataDir, archiveDir, c.ArchiveFormat); err != nil {
+			return err
+		}
+	}
+	return pruneArchives(archiveDir, c.ArchiveKeep, c.ArchiveMaxAge, int64(c.ArchiveMaxTotalMB)*1024*1024)
+}
+
+// runArchiver checks the data directory every archive_check_interval until
+// ctx is done, so long captures don't grow it beyond the threshold.
+func runArchiver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg().Capture.ArchiveCheckInterval):
+		}
+		if err := manageDataArchives(cfg().Capture); err != nil {
+			archiveFailuresCounter.Inc()
+			log.Printf("Failed to manage data archives: %v", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// testArchive is an archive for pruneArchives, age old.
+type testArchive struct {
+	name string
+	size int
+	age  time.Duration
+}
+
+// writeArchives creates archives in a new directory.
+func writeArchives(t *testing.T, archives []testArchive) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, a := range archives {
+		path := filepath.Join(dir, a.name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", a.size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-a.age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestPruneArchives(t *testing.T) {
+	// oldest first
+	archives := []testArchive{
+		{"ibtestdata_20260101_000000.zip", 300, 72 * time.Hour},
+		{"ibtestdata_20260102_000000.tar.gz", 200, 48 * time.Hour},
+		{"ibtestdata_20260103_000000.tar.zst", 100, 24 * time.Hour},
+		{"ibtestdata_20260104_000000.zip", 50, time.Hour},
+	}
+	names := func(i ...int) []string {
+		var n []string
+		for _, a := range i {
+			n = append(n, archives[a].name)
+		}
+		return n
+	}
+	for _, tc := range []struct {
+		name     string
+		archives []testArchive
+		keep     int
+		maxAge   time.Duration
+		maxBytes int64
+		want     []string
+	}{
+		{"no limit", archives, 0, 0, 0, names(0, 1, 2, 3)},
+		{"count", archives, 2, 0, 0, names(2, 3)},
+		{"age", archives, 0, 36 * time.Hour, 0, names(2, 3)},
+		// oldest first, until the rest fits
+		{"bytes", archives, 0, 0, 350, names(1, 2, 3)},
+		{"bytes, exactly", archives, 0, 0, 150, names(2, 3)},
+		{"all limits", archives, 3, 60 * time.Hour, 160, names(2, 3)},
+		// the newest is kept even beyond every limit
+		{"newest", archives, 1, time.Minute, 10, names(3)},
+		{"only", archives[:1], 1, time.Minute, 10, names(0)},
+		// other files are left alone
+		{"other files", append(slices.Clone(archives), testArchive{"ibtestdata_notes.txt", 1000, 96 * time.Hour}, testArchive{"data_1.csv", 1000, 96 * time.Hour}),
+			1, 0, 0, []string{"data_1.csv", archives[3].name, "ibtestdata_notes.txt"}},
+	} {
+		dir := writeArchives(t, tc.archives)
+		if err := pruneArchives(dir, tc.keep, tc.maxAge, tc.maxBytes); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := dirNames(t, dir); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: left %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The temporary files of archives never completed go once they are stale,
+// the one being written stays.
+func TestPruneStaleArchives(t *testing.T) {
+	dir := writeArchives(t, []testArchive{
+		{"ibtestdata_20260101_000000.zip", 10, 48 * time.Hour},
+		{"ibtestdata_20260102_000000.tar.gz.tmp", 10, 2 * archiveSettleTime},
+		{"ibtestdata_20260103_000000.tar.zst.tmp", 10, 0},
+	})
+	if err := pruneArchives(dir, 1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ibtestdata_20260101_000000.zip", "ibtestdata_20260103_000000.tar.zst.tmp"}
+	if got := dirNames(t, dir); !slices.Equal(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}
+
+// With upload enabled, only uploaded archives are deleted.
+func TestPruneArchivesAwaitingUpload(t *testing.T) {
+	c := *cfg()
+	c.Upload.Enabled = true
+	c.Upload.KeyPrefix = "{node}/"
+	previous := cfg()
+	currentConfig.Store(&c)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+
+	dir := writeArchives(t, []testArchive{
+		{"ibtestdata_20260101_000000.zip", 10, 72 * time.Hour},
+		{"ibtestdata_20260102_000000.zip", 10, 48 * time.Hour},
+		{"ibtestdata_20260103_000000.zip", 10, 24 * time.Hour},
+		{"ibtestdata_20260104_000000.zip", 10, time.Hour},
+	})
+	// the oldest was uploaded, the second as it was before it changed
+	for _, name := range []string{"ibtestdata_20260101_000000.zip", "ibtestdata_20260102_000000.zip"} {
+		path := filepath.Join(dir, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeUploadMarker(path, c.Upload.objectKey(path, stat.ModTime()), stat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "ibtestdata_20260102_000000.zip"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneArchives(dir, 1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ibtestdata_20260102_000000.zip", "ibtestdata_20260102_000000.zip.uploaded",
+		"ibtestdata_20260103_000000.zip", "ibtestdata_20260104_000000.zip",
+	}
+	if got := dirNames(t, dir); !slices.Equal(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+	var m dto.Metric
+	archivesAwaitingUploadGauge.Write(&m)
+	if awaiting := m.GetGauge().GetValue(); awaiting != 2 {
+		t.Errorf("%g archives awaiting upload, want 2", awaiting)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"ib-exporter/capfile"
+)
+
+// tickReader reads a capture tick by tick, whatever its format.
+type tickReader interface {
+	Next() (capfile.Tick, error)
+	Close() error
+}
+
+// csvTickReader reads the -runonce CSV, where the lines of one sample share
+// the timestamp.
+type csvTickReader struct {
+	scanner *bufio.Scanner
+	line    int
+	next    *capfile.Tick
+	err     error
+}
+
+func (r *csvTickReader) parse(text string) (time.Time, capfile.Value, error) {
+	fields := strings.SplitN(text, ",", 6)
+	if len(fields) != 6 {
+		return time.Time{}, capfile.Value{}, fmt.Errorf("line %d: expected 6 fields, got %d", r.line, len(fields))
+	}
+	ns, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Time{}, capfile.Value{}, fmt.Errorf("line %d: timestamp: %w", r.line, err)
+	}
+	value, err := strconv.ParseFloat(fields[5], 64)
+	if err != nil {
+		return time.Time{}, capfile.Value{}, fmt.Errorf("line %d: value: %w", r.line, err)
+	}
+	return time.Unix(0, ns), capfile.Value{
+		Series: capfile.Series{IBDev: fields[1], NetDev: fields[2], LinkType: fields[3], Counter: fields[4]},
+		Value:  value,
+	}, nil
+}
+
+func (r *csvTickReader) Next() (capfile.Tick, error) {
+	for r.err == nil {
+		if !r.scanner.Scan() {
+			if r.err = r.scanner.Err(); r.err == nil {
+				r.err = io.EOF
+			}
+			break
+		}
+		r.line++
+		text := strings.TrimSpace(r.scanner.Text())
+		if text == "" {
+			continue
+		}
+		at, value, err := r.parse(text)
+		if err != nil {
+			r.err = err
+			break
+		}
+		if r.next != nil && !at.Equal(r.next.Time) {
+			tick := *r.next
+			r.next = &capfile.Tick{Time: at, Values: []capfile.Value{value}}
+			return tick, nil
+		}
+		if r.next == nil {
+			r.next = &capfile.Tick{Time: at}
+		}
+		r.next.Values = append(r.next.Values, value)
+	}
+	if r.next != nil {
+		tick := *r.next
+		r.next = nil
+		return tick, nil
+	}
+	return capfile.Tick{}, r.err
+}
+
+func (r *csvTickReader) Close() error {
+	return nil
+}
+
+// newTickReader detects the format of a capture by its first bytes.
+func newTickReader(r io.Reader) (tickReader, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len("IBCAP"))
+	if bytes.Equal(head, []byte("IBCAP")) {
+		return capfile.NewReader(br)
+	}
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &csvTickReader{scanner: scanner}, nil
+}
+
+func isCaptureFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == captureFileExtension || ext == captureBinaryExtension || ext == ".csv"
+}
+
+// captureMetadataName is the name of the .json metadata next to a capture.
+func captureMetadataName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + captureMetaExtension
+}
+
+// readCaptureMetadata decodes the .json metadata of a capture, nil when
+// there is none or it can't be read.
+func readCaptureMetadata(open func() (io.ReadCloser, error)) *CaptureInfo {
+	f, err := open()
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var info CaptureInfo
+	if err := json.NewDecoder(f).Decode(&info); err != nil {
+		return nil
+	}
+	return &info
+}
+
+// openTar opens a tar.gz or tar.zst archive.
+func openTar(path string) (*tar.Reader, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.HasSuffix(path, "."+archiveFormatTarGz) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return tar.NewReader(gz), func() { f.Close() }, nil
+	}
+	dec, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return tar.NewReader(dec), func() { dec.Close(); f.Close() }, nil
+}
+
+// forEachTarCapture reads the captures of a tar archive in archive order,
+// which is name order for the archives ib-exporter writes. The archive is
+// read twice, first for the metadata, as it may come after its capture.
+func forEachTarCapture(path string, fn func(name string, r tickReader, meta *CaptureInfo) error) error {
+	metadata := map[string]*CaptureInfo{}
+	tr, closeTar, err := openTar(path)
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeTar()
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if filepath.Ext(hdr.Name) == captureMetaExtension {
+			metadata[hdr.Name] = readCaptureMetadata(func() (io.ReadCloser, error) { return io.NopCloser(tr), nil })
+		}
+	}
+	closeTar()
+
+	if tr, closeTar, err = openTar(path); err != nil {
+		return err
+	}
+	defer closeTar()
+	captures := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !isCaptureFile(hdr.Name) {
+			continue
+		}
+		captures++
+		name := path + ":" + hdr.Name
+		r, err := newTickReader(tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		err = fn(name, r, metadata[captureMetadataName(hdr.Name)])
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if captures == 0 {
+		return fmt.Errorf("%s: no capture files in the archive", path)
+	}
+	return nil
+}
+
+// forEachCapture calls fn for every capture in path: a CSV or binary capture
+// file, "-" for stdin, or a zip, tar.gz or tar.zst archive of them, whose
+// captures are read in name order. Names of captures in an archive are
+// <archive>:<entry>. The .json metadata of a capture is passed along when it
+// is next to it.
+func forEachCapture(path string, fn func(name string, r tickReader, meta *CaptureInfo) error) error {
+	if strings.HasSuffix(path, "."+archiveFormatTarGz) || strings.HasSuffix(path, "."+archiveFormatTarZst) {
+		return forEachTarCapture(path, fn)
+	}
+	if filepath.Ext(path) != ".zip" {
+		f := os.Stdin
+		var meta *CaptureInfo
+		if path != "-" {
+			var err error
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+			defer f.Close()
+			meta = readCaptureMetadata(func() (io.ReadCloser, error) { return os.Open(captureMetadataName(path)) })
+		}
+		r, err := newTickReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer r.Close()
+		if err := fn(path, r, meta); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	var entries []*zip.File
+	metadata := map[string]*zip.File{}
+	for _, entry := range archive.File {
+		if isCaptureFile(entry.Name) {
+			entries = append(entries, entry)
+		} else if filepath.Ext(entry.Name) == captureMetaExtension {
+			metadata[entry.Name] = entry
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s: no capture files in the archive", path)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	for _, entry := range entries {
+		name := path + ":" + entry.Name
+		err := func() error {
+			var meta *CaptureInfo
+			if m, ok := metadata[captureMetadataName(entry.Name)]; ok {
+				meta = readCaptureMetadata(m.Open)
+			}
+			f, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r, err := newTickReader(f)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return fn(name, r, meta)
+		}()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1162 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"ib-exporter/capfile"
+)
+
+// A capture samples every counter at a fixed interval for a fixed duration.
+// In the csv format it writes one line per counter and sample, the -runonce
+// format:
+//
+//	<unix nanoseconds>,<ib_dev>,<net_dev>,<link type>,<counter name>,<value>
+//
+// The binary format is the columnar one of package capfile, a fraction of the
+// size; "ib-exporter export csv" turns it back into the above.
+const (
+	captureMinInterval   = time.Millisecond
+	captureMaxSpinLead   = 10 * time.Millisecond
+	captureHistoryLimit  = 100
+	captureStateRunning  = "running"
+	captureStateDone     = "done"
+	captureStateFailed   = "failed"
+	captureMaxBodyBytes  = 64 * 1024
+	captureFilePrefix    = "data_"
+	captureFileExtension = ".log"
+	captureMetaExtension = ".json"
+
+	captureFormatCSV       = "csv"
+	captureFormatBinary    = "binary"
+	captureBinaryExtension = ".ibcap"
+	captureCompressionNone = "none"
+	captureCompressionZstd = "zstd"
+
+	captureOriginAPI      = "api"
+	captureOriginSchedule = "schedule"
+	captureOriginTrigger  = "trigger"
+	captureOriginRecorder = "recorder"
+	captureOriginRunonce  = "runonce"
+)
+
+var (
+	capturesStartedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_captures_started_total",
+			Help: "Captures started in the daemon, by what started them",
+		},
+		[]string{"origin"},
+	)
+	capturesSkippedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_captures_skipped_total",
+			Help: "Scheduled or triggered captures that could not start, e.g. because too many were running",
+		},
+		[]string{"origin"},
+	)
+
+	errTooManyCaptures = errors.New("too many captures running")
+
+	captures = &captureManager{captures: map[string]*CaptureInfo{}}
+)
+
+// CaptureSpec says what a capture samples and with which sampler. Empty
+// device and counter lists select everything. A capture with groups samples
+// each group at its own interval and with its own sampler, Counters is then
+// unused and Interval the shortest interval of a group.
+type CaptureSpec struct {
+	Duration time.Duration
+	Interval time.Duration
+	Devices  []string
+	Counters []string
+	Sampler  string
+	Groups   []CaptureGroup
+}
+
+// CaptureGroup is a set of counters a capture samples at its own interval,
+// e.g. the data counters every 10ms with the precise sampler and the QP
+// counts every second with the full one. A group without counters samples
+// those the other groups don't.
+type CaptureGroup struct {
+	Name     string        `yaml:"name"`
+	Interval time.Duration `yaml:"interval"`
+	Counters []string      `yaml:"counters"`
+	Sampler  string        `yaml:"sampler"`
+}
+
+// validateCaptureGroups checks what can be checked of groups without the
+// capture they belong to.
+func validateCaptureGroups(groups []CaptureGroup) error {
+	names := map[string]bool{}
+	counters := map[string]string{}
+	catchAll := ""
+	for i, g := range groups {
+		field := fmt.Sprintf("groups[%d]", i)
+		if g.Name == "" {
+			return fmt.Errorf("%s.name: must not be empty", field)
+		}
+		if names[g.Name] {
+			return fmt.Errorf("%s.name: %q is used twice", field, g.Name)
+		}
+		names[g.Name] = true
+		if g.Interval != 0 && g.Interval < captureMinInterval {
+			return fmt.Errorf("%s.interval: %s is below %s", field, g.Interval, captureMinInterval)
+		}
+		if g.Sampler != "" && g.Sampler != captureSamplerFull && g.Sampler != captureSamplerPrecise {
+			return fmt.Errorf("%s.sampler: %q is not %s or %s", field, g.Sampler, captureSamplerFull, captureSamplerPrecise)
+		}
+		if len(g.Counters) == 0 {
+			if catchAll != "" {
+				return fmt.Errorf("%s.counters: only one group can go without, %s does already", field, catchAll)
+			}
+			catchAll = g.Name
+		}
+		for name := range stringSet(g.Counters) {
+			if other, ok := counters[name]; ok {
+				return fmt.Errorf("%s.counters: %s is in group %s too", field, name, other)
+			}
+			counters[name] = g.Name
+		}
+	}
+	return nil
+}
+
+// setGroups makes the capture sample in groups. Groups without interval or
+// sampler take the capture's, the interval raised to minInterval of the
+// group's sampler unless minInterval is nil.
+func (s *CaptureSpec) setGroups(groups []CaptureGroup, minInterval func(sampler string) time.Duration) {
+	s.Groups = make([]CaptureGroup, len(groups))
+	interval := time.Duration(0)
+	for i, g := range groups {
+		if g.Sampler == "" {
+			g.Sampler = s.Sampler
+		}
+		if g.Interval == 0 {
+			g.Interval = s.Interval
+			if minInterval != nil {
+				g.Interval = max(g.Interval, minInterval(g.Sampler))
+			}
+		}
+		if interval == 0 || g.Interval < interval {
+			interval = g.Interval
+		}
+		s.Groups[i] = g
+	}
+	s.Interval, s.Counters = interval, nil
+}
+
+// checkGroupIntervals checks the intervals groups give against the minimum
+// of their sampler, sampler for the groups without one.
+func checkGroupIntervals(groups []CaptureGroup, sampler string, minInterval func(sampler string) time.Duration) error {
+	for i, g := range groups {
+		if g.Sampler != "" {
+			sampler = g.Sampler
+		}
+		if g.Interval != 0 && g.Interval < minInterval(sampler) {
+			return fmt.Errorf("groups[%d].interval: %s is below %s, the minimum of the %s sampler", i, g.Interval, minInterval(sampler), sampler)
+		}
+	}
+	return nil
+}
+
+// groups returns the groups of the capture, one for all of it when it has
+// none.
+func (s CaptureSpec) groups() []CaptureGroup {
+	if len(s.Groups) > 0 {
+		return s.Groups
+	}
+	return []CaptureGroup{{Interval: s.Interval, Counters: s.Counters, Sampler: s.Sampler}}
+}
+
+// captureSample collects every counter once, through the helper when one is
+// configured.
+func captureSample() ([]IBCounter, error) {
+	if socket := cfg().Helper.Socket; socket != "" {
+		snap, err := requestHelper(socket, helperMethodCapture)
+		if err != nil {
+			return nil, err
+		}
+		return snap.Counters, nil
+	}
+	return captureLocalSample(), nil
+}
+
+// captureLocalSample collects every counter once in this process. Unlike a
+// scrape it leaves the MRRS alone, and it waits for a collection in
+// progress, so that captures and scrapes don't run the same commands at
+// once.
+func captureLocalSample() []IBCounter {
+	collectMu.Lock()
+	defer collectMu.Unlock()
+	IBDevs := GetIBDev()
+	if len(IBDevs) == 0 {
+		return nil
+	}
+	return collectIBCounters(IBDevs)
+}
+
+func writeCaptureSample(w io.Writer, at time.Time, counters []IBCounter) error {
+	for _, counter := range counters {
+		_, err := fmt.Fprintf(w, "%d,%s,%s,%s,%s,%f\n",
+			at.UnixNano(),
+			counter.IBDev,
+			counter.NetDev,
+			counter.DevLinkType,
+			counter.CounterName,
+			counter.CounterValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureWriter writes the samples of a capture in one of the capture
+// formats. Close flushes what is buffered but leaves the file open.
+type captureWriter interface {
+	WriteSample(at time.Time, counters []IBCounter) error
+	Close() error
+}
+
+type csvCaptureWriter struct {
+	w *bufio.Writer
+}
+
+func (c csvCaptureWriter) WriteSample(at time.Time, counters []IBCounter) error {
+	return writeCaptureSample(c.w, at, counters)
+}
+
+func (c csvCaptureWriter) Close() error {
+	return c.w.Flush()
+}
+
+type binaryCaptureWriter struct {
+	w *capfile.Writer
+}
+
+func (c binaryCaptureWriter) WriteSample(at time.Time, counters []IBCounter) error {
+	values := make([]capfile.Value, len(counters))
+	for i, counter := range counters {
+		values[i] = capfile.Value{
+			Series: capfile.Series{
+				IBDev:    counter.IBDev,
+				NetDev:   counter.NetDev,
+				LinkType: counter.DevLinkType,
+				Counter:  counter.CounterName,
+			},
+			Value: counter.CounterValue,
+		}
+	}
+	return c.w.WriteTick(at, values)
+}
+
+func (c binaryCaptureWriter) Close() error {
+	return c.w.Close()
+}
+
+func newCaptureWriter(w io.Writer, c CaptureConfig) (captureWriter, error) {
+	if c.Format != captureFormatBinary {
+		return csvCaptureWriter{bufio.NewWriter(w)}, nil
+	}
+	cw, err := capfile.NewWriter(w, capfile.Options{Zstd: c.Compression == captureCompressionZstd})
+	if err != nil {
+		return nil, err
+	}
+	return binaryCaptureWriter{cw}, nil
+}
+
+// captureFileName is the data file name of a capture in the format c writes.
+func captureFileName(id string, c CaptureConfig) string {
+	if c.Format == captureFormatBinary {
+		return captureFilePrefix + id + captureBinaryExtension
+	}
+	return captureFilePrefix + id + captureFileExtension
+}
+
+// createCaptureFile creates the data file of a capture and its writer. The
+// file is not archived until writeCaptureMetadata has been called for it.
+func createCaptureFile(path string, c CaptureConfig) (*os.File, captureWriter, error) {
+	holdCaptureFile(path)
+	f, err := os.Create(path)
+	if err != nil {
+		releaseCaptureFile(path)
+		return nil, nil, fmt.Errorf("create data file: %w", err)
+	}
+	w, err := newCaptureWriter(f, c)
+	if err != nil {
+		f.Close()
+		releaseCaptureFile(path)
+		return nil, nil, fmt.Errorf("create data file: %w", err)
+	}
+	return f, w, nil
+}
+
+// captureSegmentFileName is the data file name of segment n of a capture
+// the archiver split; the first one has the capture's own name.
+func captureSegmentFileName(id string, n int, c CaptureConfig) string {
+	if n <= 1 {
+		return captureFileName(id, c)
+	}
+	return captureFileName(fmt.Sprintf("%s_part%d", id, n), c)
+}
+
+// segmentedCaptureWriter writes a capture to one data file after another.
+// When the data directory grows beyond the archive threshold, the archiver
+// rotates the running captures: rotate starts a new segment file, closes
+// the current one, writes its metadata and releases it for archiving. A
+// capture that is never rotated writes the one file it always did; the
+// metadata of the last segment is the capture's, from writeCaptureMetadata.
+type segmentedCaptureWriter struct {
+	mu sync.Mutex
+	c  CaptureConfig
+	// what the metadata of a closed segment says about the capture
+	meta    CaptureInfo
+	f       *os.File
+	w       captureWriter
+	path    string
+	started time.Time
+	samples int
+	// the files of the closed segments
+	segments []string
+	closed   bool
+	// onRotate is told the segment the capture continues in
+	onRotate func(segment captureSegment)
+}
+
+// captureSegment is the segment a capture is writing.
+type captureSegment struct {
+	file, path string
+	number     int
+	previous   []string
+}
+
+// apply points info at the segment.
+func (s captureSegment) apply(info *CaptureInfo) {
+	info.File, info.path = s.file, s.path
+	if s.number > 1 {
+		info.Segment, info.Segments = s.number, s.previous
+	}
+}
+
+// newSegmentedCaptureWriter creates the first data file of the capture
+// info describes, at info.path.
+func newSegmentedCaptureWriter(info CaptureInfo, c CaptureConfig) (*segmentedCaptureWriter, error) {
+	f, w, err := createCaptureFile(info.path, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &segmentedCaptureWriter{c: c, meta: info, f: f, w: w, path: info.path, started: info.StartedAt}
+	trackSegmentedCapture(s)
+	return s, nil
+}
+
+func (s *segmentedCaptureWriter) WriteSample(at time.Time, counters []IBCounter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples++
+	return s.w.WriteSample(at, counters)
+}
+
+// Close flushes and closes the current segment, unlike other capture
+// writers also the file.
+func (s *segmentedCaptureWriter) Close() error {
+	untrackSegmentedCapture(s)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.w.Close()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// segment returns the segment the capture is writing.
+func (s *segmentedCaptureWriter) segment() captureSegment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current()
+}
+
+func (s *segmentedCaptureWriter) current() captureSegment {
+	return captureSegment{file: filepath.Base(s.path), path: s.path, number: len(s.segments) + 1, previous: slices.Clone(s.segments)}
+}
+
+// rotate continues the capture in a new segment file, unless nothing was
+// written to the current one yet.
+func (s *segmentedCaptureWriter) rotate() error {
+	segment, rotated, err := s.rotateLocked()
+	if rotated && s.onRotate != nil {
+		s.onRotate(segment)
+	}
+	return err
+}
+
+func (s *segmentedCaptureWriter) rotateLocked() (captureSegment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.samples == 0 {
+		return captureSegment{}, false, nil
+	}
+	number := len(s.segments) + 2
+	path := filepath.Join(filepath.Dir(s.path), captureSegmentFileName(s.meta.ID, number, s.c))
+	f, w, err := createCaptureFile(path, s.c)
+	if err != nil {
+		return captureSegment{}, false, fmt.Errorf("capture %s: new segment: %w", s.meta.ID, err)
+	}
+	err = s.w.Close()
+	if closeErr := s.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		err = fmt.Errorf("capture %s: close segment %s: %w", s.meta.ID, filepath.Base(s.path), err)
+	}
+
+	now := time.Now()
+	meta := s.meta
+	meta.State = captureStateRunning
+	meta.StartedAt, meta.FinishedAt = s.started, &now
+	meta.Samples = s.samples
+	s.current().apply(&meta)
+	meta.Segment = number - 1
+	if metaErr := writeCaptureMetadata(meta); metaErr != nil && err == nil {
+		err = fmt.Errorf("capture %s: %w", s.meta.ID, metaErr)
+	}
+
+	s.segments = append(s.segments, filepath.Base(s.path))
+	s.f, s.w, s.path, s.started, s.samples = f, w, path, now, 0
+	return s.current(), true, err
+}
+
+// lockedCaptureWriter lets the groups of a capture write to one file.
+type lockedCaptureWriter struct {
+	mu sync.Mutex
+	w  captureWriter
+}
+
+func (l *lockedCaptureWriter) WriteSample(at time.Time, counters []IBCounter) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.WriteSample(at, counters)
+}
+
+func (l *lockedCaptureWriter) Close() error {
+	return l.w.Close()
+}
+
+// runCapture samples until the duration has elapsed and returns the number of
+// samples written and how well each group kept its interval. Groups sample
+// concurrently, on schedules starting together, and write their samples as
+// ticks of their own. Cancelling ctx ends the capture early with ctx's
+// error.
+func runCapture(ctx context.Context, spec CaptureSpec, w captureWriter) (int, []*CaptureSampling, error) {
+	groups := spec.groups()
+	samplers := make([]captureSampler, 0, len(groups))
+	defer func() {
+		for _, sampler := range samplers {
+			sampler.close()
+		}
+	}()
+	for i, g := range groups {
+		var exclude []string
+		for j, other := range groups {
+			if j != i {
+				exclude = append(exclude, other.Counters...)
+			}
+		}
+		sampler, err := newCaptureSampler(spec.Devices, g, exclude)
+		if err != nil {
+			if g.Name != "" {
+				err = fmt.Errorf("group %s: %w", g.Name, err)
+			}
+			return 0, nil, err
+		}
+		samplers = append(samplers, sampler)
+	}
+
+	start := time.Now()
+	end := start.Add(spec.Duration)
+	sampling := make([]*CaptureSampling, len(groups))
+	if len(groups) == 1 {
+		samples, s, err := runCaptureGroup(ctx, groups[0], samplers[0], w, start, end)
+		sampling[0] = s
+		return samples, sampling, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lw := &lockedCaptureWriter{w: w}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	total := 0
+	for i, g := range groups {
+		wg.Add(1)
+		go func(i int, g CaptureGroup) {
+			defer wg.Done()
+			samples, s, err := runCaptureGroup(ctx, g, samplers[i], lw, start, end)
+			mu.Lock()
+			defer mu.Unlock()
+			sampling[i] = s
+			total += samples
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("group %s: %w", g.Name, err)
+				// a failed write fails the whole capture
+				cancel()
+			}
+		}(i, g)
+	}
+	wg.Wait()
+	return total, sampling, firstErr
+}
+
+// runCaptureGroup samples one group from start to end. Ticks are scheduled
+// from the start, so slow samples don't make the capture drift; the ticks a
+// sample overran are skipped and counted as missed, and neither that sample
+// nor the one after them is held against the jitter.
+func runCaptureGroup(ctx context.Context, g CaptureGroup, sampler captureSampler, w captureWriter, start, end time.Time) (int, *CaptureSampling, error) {
+	sampling := &CaptureSampling{Sampler: g.Sampler}
+	var jitter, reads []float64
+	last := map[string]time.Time{}
+	defer func() {
+		sampling.ReadErrors = sampler.readErrors()
+		sampling.JitterSeconds = summarize(jitter)
+		sampling.ReadSeconds = summarize(reads)
+	}()
+
+	// timers fire up to a millisecond late, the precise sampler wakes up
+	// early and spins until the tick, yielding to the other groups
+	var lead time.Duration
+	if g.Sampler == captureSamplerPrecise {
+		lead = cfg().Capture.SpinLead
+	}
+	next := start.Add(g.Interval)
+	timer := time.NewTimer(time.Until(next) - lead)
+	defer timer.Stop()
+	samples := 0
+	for next.Before(end) {
+		select {
+		case <-ctx.Done():
+			return samples, sampling, ctx.Err()
+		case <-timer.C:
+		}
+		for time.Now().Before(next) {
+			runtime.Gosched()
+		}
+
+		began := time.Now()
+		ticks, err := sampler.sample()
+		reads = append(reads, time.Since(began).Seconds())
+		next = next.Add(g.Interval)
+		now := time.Now()
+		onSchedule := next.After(now)
+		if err != nil {
+			log.Printf("Capture sample failed: %v", err)
+		} else {
+			// jitter is per device, each of the precise sampler's is
+			// timestamped on its own
+			for _, t := range ticks {
+				if err := w.WriteSample(t.at, t.counters); err != nil {
+					return samples, sampling, fmt.Errorf("write capture data: %w", err)
+				}
+				if prev, ok := last[t.device]; ok && onSchedule {
+					j := math.Abs((t.at.Sub(prev) - g.Interval).Seconds())
+					jitter = append(jitter, j)
+					captureJitterHistogram.Observe(j)
+				}
+				last[t.device] = t.at
+			}
+			samples++
+		}
+
+		if !onSchedule {
+			missed := int(now.Sub(next)/g.Interval) + 1
+			sampling.MissedTicks += missed
+			captureMissedTicksCounter.Add(float64(missed))
+			next = next.Add(time.Duration(missed) * g.Interval)
+			clear(last)
+		}
+		timer.Reset(time.Until(next) - lead)
+	}
+	return samples, sampling, nil
+}
+
+// CaptureRequest is the body of POST /api/v1/captures. Durations use Go
+// syntax, e.g. "30s" or "100ms"; missing fields take the capture defaults.
+type CaptureRequest struct {
+	Duration string                `json:"duration,omitempty"`
+	Interval string                `json:"interval,omitempty"`
+	Devices  []string              `json:"devices,omitempty"`
+	Counters []string              `json:"counters,omitempty"`
+	Sampler  string                `json:"sampler,omitempty"`
+	Groups   []CaptureGroupRequest `json:"groups,omitempty"`
+}
+
+// CaptureGroupRequest is a CaptureGroup in a request or capture info.
+type CaptureGroupRequest struct {
+	Name     string   `json:"name"`
+	Interval string   `json:"interval,omitempty"`
+	Counters []string `json:"counters,omitempty"`
+	Sampler  string   `json:"sampler,omitempty"`
+}
+
+func (req CaptureRequest) spec(c CaptureConfig) (CaptureSpec, error) {
+	spec := CaptureSpec{Duration: c.Duration, Interval: c.Interval, Devices: req.Devices, Counters: req.Counters, Sampler: c.Sampler}
+	var err error
+	if req.Duration != "" {
+		if spec.Duration, err = time.ParseDuration(req.Duration); err != nil {
+			return spec, fmt.Errorf("duration: %w", err)
+		}
+	}
+	if req.Interval != "" {
+		if spec.Interval, err = time.ParseDuration(req.Interval); err != nil {
+			return spec, fmt.Errorf("interval: %w", err)
+		}
+	}
+	if spec.Duration <= 0 || spec.Duration > c.MaxDuration {
+		return spec, fmt.Errorf("duration must be positive and at most %s", c.MaxDuration)
+	}
+	if req.Sampler != "" {
+		if req.Sampler != captureSamplerFull && req.Sampler != captureSamplerPrecise {
+			return spec, fmt.Errorf("sampler must be %s or %s", captureSamplerFull, captureSamplerPrecise)
+		}
+		spec.Sampler = req.Sampler
+	}
+	// a default interval below the sampler's minimum is raised to it, one
+	// asked for is refused
+	minInterval := c.minInterval(spec.Sampler)
+	if req.Interval == "" {
+		spec.Interval = max(spec.Interval, minInterval)
+	}
+	if spec.Interval < minInterval || spec.Interval > spec.Duration {
+		return spec, fmt.Errorf("interval must be between %s, the minimum of the %s sampler, and the duration", minInterval, spec.Sampler)
+	}
+
+	// the configured groups apply to requests that select no counters
+	groups := c.Groups
+	if len(req.Counters) > 0 {
+		groups = nil
+	}
+	if len(req.Groups) > 0 {
+		if len(req.Counters) > 0 {
+			return spec, errors.New("counters and groups don't go together, give each group its counters")
+		}
+		groups = make([]CaptureGroup, len(req.Groups))
+		for i, g := range req.Groups {
+			groups[i] = CaptureGroup{Name: g.Name, Counters: g.Counters, Sampler: g.Sampler}
+			if g.Interval != "" {
+				if groups[i].Interval, err = time.ParseDuration(g.Interval); err != nil {
+					return spec, fmt.Errorf("groups[%d].interval: %w", i, err)
+				}
+			}
+		}
+		if err := validateCaptureGroups(groups); err != nil {
+			return spec, err
+		}
+		if err := checkGroupIntervals(groups, spec.Sampler, c.minInterval); err != nil {
+			return spec, err
+		}
+	}
+	if len(groups) > 0 {
+		spec.setGroups(groups, c.minInterval)
+		for i, g := range spec.Groups {
+			if g.Interval > spec.Duration {
+				return spec, fmt.Errorf("groups[%d].interval: must be at most the duration", i)
+			}
+		}
+	}
+	return spec, nil
+}
+
+type CaptureInfo struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	Duration   string     `json:"duration"`
+	Interval   string     `json:"interval"`
+	Devices    []string   `json:"devices,omitempty"`
+	Counters   []string   `json:"counters,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Samples    int        `json:"samples"`
+	Sampler    string     `json:"sampler,omitempty"`
+	// set once the capture has finished, in Groups for captures with groups
+	Sampling *CaptureSampling   `json:"sampling,omitempty"`
+	Groups   []CaptureGroupInfo `json:"groups,omitempty"`
+	File     string             `json:"file"`
+	Error    string             `json:"error,omitempty"`
+	// what started the capture: api, schedule, trigger, recorder or
+	// runonce; Rule names the schedule or trigger rule and Reason says why it
+	// fired
+	Origin string `json:"origin"`
+	Rule   string `json:"rule,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// the devices when the capture started, so captures can be matched up by
+	// GUID when device names changed in between
+	Identities []DeviceIdentity `json:"identities,omitempty"`
+	// a capture the archiver split while it ran: the number of the segment
+	// File is, from 1, and the files of the segments before it, which are
+	// archived separately
+	Segment  int      `json:"segment,omitempty"`
+	Segments []string `json:"segments,omitempty"`
+	// the data files of the capture the archiver moved, to the archive
+	// they are in, next to capture.data_path
+	Archived map[string]string `json:"archived,omitempty"`
+
+	path, archiveDir string
+}
+
+type CaptureGroupInfo struct {
+	CaptureGroupRequest
+	Sampling *CaptureSampling `json:"sampling,omitempty"`
+}
+
+// captureGroupInfos describes the groups of spec, nil when it has none.
+func captureGroupInfos(spec CaptureSpec) []CaptureGroupInfo {
+	var infos []CaptureGroupInfo
+	for _, g := range spec.Groups {
+		infos = append(infos, CaptureGroupInfo{CaptureGroupRequest: CaptureGroupRequest{
+			Name:     g.Name,
+			Interval: g.Interval.String(),
+			Counters: g.Counters,
+			Sampler:  g.Sampler,
+		}})
+	}
+	return infos
+}
+
+// setSampling records the sampling of each group runCapture returned.
+func (info *CaptureInfo) setSampling(sampling []*CaptureSampling) {
+	if len(info.Groups) == 0 {
+		if len(sampling) > 0 {
+			info.Sampling = sampling[0]
+		}
+		return
+	}
+	for i := range info.Groups {
+		if i < len(sampling) {
+			info.Groups[i].Sampling = sampling[i]
+		}
+	}
+}
+
+// missedTicks adds up the missed ticks of all groups.
+func missedTicks(sampling []*CaptureSampling) int {
+	missed := 0
+	for _, s := range sampling {
+		if s != nil {
+			missed += s.MissedTicks
+		}
+	}
+	return missed
+}
+
+type captureManager struct {
+	mu       sync.Mutex
+	captures map[string]*CaptureInfo
+	running  int
+}
+
+// captureIdentities reads the identity of every device, through the helper
+// when one is configured. A capture without them is still useful, so a
+// failing helper is only logged.
+func captureIdentities() []DeviceIdentity {
+	if socket := cfg().Helper.Socket; socket != "" {
+		snap, err := requestHelper(socket, helperMethodInventory)
+		if err != nil {
+			log.Printf("Read device identities: %v", err)
+			return nil
+		}
+		return snap.Identities
+	}
+	return readIdentities(localDevices())
+}
+
+// localDevices returns the inventory, discovering the devices when no
+// collection has yet. Unlike discovery it includes the devices whose port
+// is down.
+func localDevices() []IBDevice {
+	if devs := inventory.Devices(); len(devs) > 0 {
+		return devs
+	}
+	DiscoverIBDevices()
+	return inventory.Devices()
+}
+
+func readIdentities(devs []IBDevice) []DeviceIdentity {
+	identities := make([]DeviceIdentity, 0, len(devs))
+	for _, dev := range devs {
+		identities = append(identities, ReadDeviceIdentity(dev))
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].Device < identities[j].Device })
+	return identities
+}
+
+func newCaptureID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().Format("20060102_150405") + "_" + hex.EncodeToString(b)
+}
+
+// start runs a capture in the background. The data file is written next to
+// the -runonce files, so the same archiving applies to it, and the capture
+// metadata goes to a .json file of the same name once it has finished.
+func (m *captureManager) start(spec CaptureSpec, origin, rule, reason string) (CaptureInfo, error) {
+	c := cfg().Capture
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running >= c.MaxConcurrent {
+		return CaptureInfo{}, errTooManyCaptures
+	}
+	if err := os.MkdirAll(c.DataPath, 0755); err != nil {
+		return CaptureInfo{}, fmt.Errorf("create data directory: %w", err)
+	}
+	id := newCaptureID()
+	info := &CaptureInfo{
+		ID:         id,
+		State:      captureStateRunning,
+		Duration:   spec.Duration.String(),
+		Interval:   spec.Interval.String(),
+		Devices:    spec.Devices,
+		Counters:   spec.Counters,
+		Sampler:    spec.Sampler,
+		Groups:     captureGroupInfos(spec),
+		StartedAt:  time.Now(),
+		File:       captureFileName(id, c),
+		Origin:     origin,
+		Rule:       rule,
+		Reason:     reason,
+		Identities: captureIdentities(),
+	}
+	info.path = filepath.Join(c.DataPath, info.File)
+	w, err := newSegmentedCaptureWriter(*info, c)
+	if err != nil {
+		return CaptureInfo{}, err
+	}
+	w.onRotate = func(segment captureSegment) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		segment.apply(info)
+	}
+
+	m.captures[id] = info
+	m.running++
+	m.prune()
+	capturesStartedCounter.WithLabelValues(origin).Inc()
+	go m.run(info, spec, w)
+	log.Printf("Capture %s started by %s %s: %s every %s, writing %s", id, origin, rule, spec.Duration, spec.Interval, info.path)
+	return *info, nil
+}
+
+func (m *captureManager) run(info *CaptureInfo, spec CaptureSpec, w *segmentedCaptureWriter) {
+	samples, sampling, err := runCapture(context.Background(), spec, w)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	info.FinishedAt = &now
+	info.Samples = samples
+	info.setSampling(sampling)
+	info.State = captureStateDone
+	if err != nil {
+		info.State = captureStateFailed
+		info.Error = err.Error()
+		log.Printf("Capture %s failed after %d samples: %v", info.ID, samples, err)
+	} else {
+		log.Printf("Capture %s finished with %d samples, %d missed ticks", info.ID, samples, missedTicks(sampling))
+	}
+	m.running--
+	if err := writeCaptureMetadata(*info); err != nil {
+		log.Printf("Capture %s: %v", info.ID, err)
+	}
+}
+
+func writeCaptureMetadata(info CaptureInfo) error {
+	defer releaseCaptureFile(info.path)
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	metaPath := strings.TrimSuffix(info.path, filepath.Ext(info.path)) + captureMetaExtension
+	if err := os.WriteFile(metaPath, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	return nil
+}
+
+// prune forgets the oldest finished captures beyond the history limit; their
+// files stay on disk. Callers hold m.mu.
+func (m *captureManager) prune() {
+	if len(m.captures) <= captureHistoryLimit {
+		return
+	}
+	var finished []*CaptureInfo
+	for _, info := range m.captures {
+		if info.State != captureStateRunning {
+			finished = append(finished, info)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	for _, info := range finished {
+		if len(m.captures) <= captureHistoryLimit {
+			break
+		}
+		delete(m.captures, info.ID)
+	}
+}
+
+// add records a capture that was written elsewhere, like a flight recorder
+// dump, so it can be listed and downloaded.
+func (m *captureManager) add(info CaptureInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.captures[info.ID] = &info
+	m.prune()
+}
+
+func (m *captureManager) get(id string) (CaptureInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.captures[id]
+	if !ok {
+		return CaptureInfo{}, false
+	}
+	return info.copy(), true
+}
+
+func (m *captureManager) list() []CaptureInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]CaptureInfo, 0, len(m.captures))
+	for _, info := range m.captures {
+		list = append(list, info.copy())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// archived records that the data files at paths, of any segment, were
+// moved into archive.
+func (m *captureManager) archived(archive string, paths []string) {
+	moved := stringSet(paths)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, info := range m.captures {
+		for _, file := range append(slices.Clone(info.Segments), info.File) {
+			if !moved[filepath.Join(filepath.Dir(info.path), file)] {
+				continue
+			}
+			if info.Archived == nil {
+				info.Archived = map[string]string{}
+			}
+			info.Archived[file] = filepath.Base(archive)
+			info.archiveDir = filepath.Dir(archive)
+		}
+	}
+}
+
+// copy is info without the map archived changes. Callers hold m.mu.
+func (info *CaptureInfo) copy() CaptureInfo {
+	c := *info
+	c.Archived = maps.Clone(info.Archived)
+	return c
+}
+
+type CapturesResponse struct {
+	APIVersion string        `json:"api_version"`
+	Captures   []CaptureInfo `json:"captures"`
+}
+
+type CaptureResponse struct {
+	APIVersion string      `json:"api_version"`
+	Capture    CaptureInfo `json:"capture"`
+}
+
+// apiCapturesHandler starts a capture on POST and lists the known captures
+// on GET.
+func apiCapturesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, CapturesResponse{APIVersion: apiVersion, Captures: captures.list()})
+	case http.MethodPost:
+		decoder := json.NewDecoder(io.LimitReader(r.Body, captureMaxBodyBytes))
+		decoder.DisallowUnknownFields()
+		var req CaptureRequest
+		if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeAPIError(w, http.StatusBadRequest, "decode request: %v", err)
+			return
+		}
+		spec, err := req.spec(cfg().Capture)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		info, err := captures.start(spec, captureOriginAPI, "", "")
+		if errors.Is(err, errTooManyCaptures) {
+			writeAPIError(w, http.StatusTooManyRequests, "%v, at most %d at a time", err, cfg().Capture.MaxConcurrent)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		w.Header().Set("Location", "captures/"+info.ID)
+		writeAPIJSON(w, http.StatusAccepted, CaptureResponse{APIVersion: apiVersion, Capture: info})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// apiCaptureHandler serves GET /api/v1/captures/<id>: the data file once the
+// capture is done, its state as JSON while it runs or after it failed.
+func apiCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/captures/")
+	info, ok := captures.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown capture %q", id)
+		return
+	}
+	switch info.State {
+	case captureStateRunning:
+		writeAPIJSON(w, http.StatusAccepted, CaptureResponse{APIVersion: apiVersion, Capture: info})
+		return
+	case captureStateFailed:
+		writeAPIJSON(w, http.StatusInternalServerError, CaptureResponse{APIVersion: apiVersion, Capture: info})
+		return
+	}
+
+	if len(info.Segments) > 0 {
+		serveCaptureSegments(w, info)
+		return
+	}
+	f, size, modTime, err := openCaptureFile(info, info.File)
+	if errors.Is(err, os.ErrNotExist) {
+		writeAPIError(w, http.StatusGone, "%v", err)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if filepath.Ext(info.File) == captureBinaryExtension {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.File))
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, info.File, modTime, rs)
+		return
+	}
+	// out of a compressed archive, without Range
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("Capture %s: send %s: %v", info.ID, info.File, err)
+	}
+}
+
+// serveCaptureSegments sends the data files of a capture split into
+// segments as a tar of the segments in order, each out of capture.data_path
+// or the archive it was moved into.
+func serveCaptureSegments(w http.ResponseWriter, info CaptureInfo) {
+	type segment struct {
+		file    string
+		rc      io.ReadCloser
+		size    int64
+		modTime time.Time
+	}
+	var segments []segment
+	defer func() {
+		for _, s := range segments {
+			s.rc.Close()
+		}
+	}()
+	for _, file := range append(slices.Clone(info.Segments), info.File) {
+		rc, size, modTime, err := openCaptureFile(info, file)
+		if errors.Is(err, os.ErrNotExist) {
+			writeAPIError(w, http.StatusGone, "%v", err)
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		segments = append(segments, segment{file, rc, size, modTime})
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", captureFilePrefix+info.ID+".tar"))
+	tw := tar.NewWriter(w)
+	for _, s := range segments {
+		err := tw.WriteHeader(&tar.Header{Name: s.file, Mode: 0644, Size: s.size, ModTime: s.modTime, Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = io.CopyN(tw, s.rc, s.size)
+		}
+		if err != nil {
+			log.Printf("Capture %s: send %s: %v", info.ID, s.file, err)
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Printf("Capture %s: %v", info.ID, err)
+	}
+}
+
+// openCaptureFile opens a data file of a capture in capture.data_path or in
+// the archive it was moved into.
+func openCaptureFile(info CaptureInfo, file string) (io.ReadCloser, int64, time.Time, error) {
+	if archive, ok := info.Archived[file]; ok {
+		rc, size, modTime, err := openArchiveEntry(filepath.Join(info.archiveDir, archive), file)
+		if errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("data file %s was archived to %s, which is gone: %w", file, archive, err)
+		}
+		return rc, size, modTime, err
+	}
+	f, err := os.Open(filepath.Join(filepath.Dir(info.path), file))
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("data file %s is no longer in %s: %w", file, filepath.Dir(info.path), err)
+	}
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return f, stat.Size(), stat.ModTime(), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useCaptures gives the test a capture manager of its own.
+func useCaptures(t *testing.T) {
+	previous := captures
+	captures = &captureManager{captures: map[string]*CaptureInfo{}}
+	t.Cleanup(func() { captures = previous })
+}
+
+// addFinishedCapture writes the data file and metadata of a finished
+// capture to dataDir and records it.
+func addFinishedCapture(t *testing.T, dataDir, id, data string) CaptureInfo {
+	t.Helper()
+	now := time.Now()
+	info := CaptureInfo{ID: id, State: captureStateDone, StartedAt: now, FinishedAt: &now, File: captureFilePrefix + id + captureFileExtension}
+	info.path = filepath.Join(dataDir, info.File)
+	if err := os.WriteFile(info.path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCaptureMetadata(info); err != nil {
+		t.Fatal(err)
+	}
+	captures.add(info)
+	return info
+}
+
+func getCapture(id string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	apiCaptureHandler(rec, httptest.NewRequest(http.MethodGet, "/api/v1/captures/"+id, nil))
+	return rec
+}
+
+func TestCaptureDownloadArchived(t *testing.T) {
+	for _, format := range archiveFormats {
+		useCaptures(t)
+		archiveDir := t.TempDir()
+		dataDir := filepath.Join(archiveDir, "data")
+		if err := os.Mkdir(dataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := "1700000000000000000,mlx5_0,eth0,Ethernet,port_rcv_data,100\n"
+		id := "20260101_000000_" + format
+		addFinishedCapture(t, dataDir, id, data)
+		addFinishedCapture(t, dataDir, "20260101_000001_other", "other\n")
+
+		if rec := getCapture(id); rec.Code != http.StatusOK || rec.Body.String() != data {
+			t.Fatalf("%s: before archiving: status %d, %q", format, rec.Code, rec.Body)
+		}
+		archive, err := archiveCaptures(dataDir, archiveDir, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := captures.get(id)
+		if info.Archived[info.File] != filepath.Base(archive) {
+			t.Errorf("%s: archived %v, want %s in %s", format, info.Archived, info.File, filepath.Base(archive))
+		}
+		rec := getCapture(id)
+		if rec.Code != http.StatusOK || rec.Body.String() != data {
+			t.Errorf("%s: out of the archive: status %d, %q", format, rec.Code, rec.Body)
+		}
+		if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="`+info.File+`"` {
+			t.Errorf("%s: Content-Disposition %s", format, cd)
+		}
+
+		os.Remove(archive)
+		if rec := getCapture(id); rec.Code != http.StatusGone {
+			t.Errorf("%s: archive deleted: status %d, %q", format, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestCaptureDownloadDeleted(t *testing.T) {
+	useCaptures(t)
+	info := addFinishedCapture(t, t.TempDir(), "20260101_000000_abcd", "data\n")
+	os.Remove(info.path)
+	if rec := getCapture(info.ID); rec.Code != http.StatusGone {
+		t.Errorf("data file deleted: status %d, %q", rec.Code, rec.Body)
+	}
+	if rec := getCapture("20260101_000000_ffff"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown capture: status %d", rec.Code)
+	}
+}
+
+func TestCaptureDownloadSegments(t *testing.T) {
+	useCaptures(t)
+	archiveDir := t.TempDir()
+	dataDir := filepath.Join(archiveDir, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the first segment is closed and has its metadata, the second was
+	// just written
+	id := "20260101_000000_abcd"
+	first := addFinishedCapture(t, dataDir, id, "segment 1\n")
+	second := captureFilePrefix + id + "_part2" + captureFileExtension
+	if err := os.WriteFile(filepath.Join(dataDir, second), []byte("segment 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info := first
+	info.File, info.path = second, filepath.Join(dataDir, second)
+	info.Segment, info.Segments = 2, []string{first.File}
+	captures.add(info)
+
+	archive, err := archiveCaptures(dataDir, archiveDir, archiveFormatTarZst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ = captures.get(id)
+	if len(info.Archived) != 1 || info.Archived[first.File] != filepath.Base(archive) {
+		t.Errorf("archived %v, want only %s", info.Archived, first.File)
+	}
+
+	rec := getCapture(id)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("status %d, %s: %q", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	tr := tar.NewReader(rec.Body)
+	for _, want := range []struct{ name, content string }{{first.File, "segment 1\n"}, {second, "segment 2\n"}} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tr)
+		if hdr.Name != want.name || string(content) != want.content {
+			t.Errorf("entry %s: %q, want %s: %q", hdr.Name, content, want.name, want.content)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("more entries: %v", err)
+	}
+
+	// a segment gone takes the capture with it
+	os.Remove(filepath.Join(dataDir, second))
+	if rec := getCapture(id); rec.Code != http.StatusGone {
+		t.Errorf("segment deleted: status %d, %q", rec.Code, rec.Body)
+	}
+}
@@ -11,8 +11,11 @@ import (
 )
 
 var (
-	IBSYSPATH = "/sys/class/infiniband/"
-	tempRegex = regexp.MustCompile(`Temperature
+	// filesystem roots, see PathsConfig
+	IBSYSPATH   = "/sys/class/infiniband/"
+	DEBUGFSPATH = "/sys/kernel/debug"
+	PROCFSPATH  = "/proc"
+	tempRegex   = regexp.MustCompile(`Temperature
 $$
 C
 $$
@@ -40,13 +43,6 @@ $$
 	linkTypeRegex = regexp.MustCompile(`Cable Type\s*:\s*(.+)`)
 )
 
-func init() {
-	customIBSYSPATH := os.Getenv("IBSYSPATH")
-	if customIBSYSPATH != "" {
-		IBSYSPATH = customIBSYSPATH
-	}
-}
-
 type IBCounter struct {
 	IBDev        string  `json:"ib_dev"`
 	NetDev       string  `json:"net_dev"`
@@ -114,37 +110,16 @@ func IsIBLink(IBDev string) bool {
 	return false
 }
 func isPhysicalIBDevice(deviceName string) bool {
-	filePath := fmt.Sprintf("/sys/class/infiniband/%s/device/sriov_numvfs", deviceName)
-	_, err := os.Stat(filePath)
-	if err == nil {
-
-		return true
-	}
-	if os.IsNotExist(err) {
-		return false
-	}
-	log.Printf("Warning: Could not check device type for %s due to an error: %v. Assuming it's not a physical device.\n", deviceName, err)
-	return false
+	function, _ := getDeviceFunction(deviceName)
+	return function == functionPF
 }
 
 func GetIBDev() []string {
-	allIBDev, err := listFiles(IBSYSPATH)
-	if err != nil {
-		log.Fatal("Fail to get all IB Dev", err)
-		return nil
-	}
-
 	var activeIBDev []string
-	for _, ibDev := range allIBDev {
-		// skip virtual functions and mezz devices
-		if strings.Contains(ibDev, "mezz") {
-			continue
-		}
-		if isDevActive(ibDev) {
-			activeIBDev = append(activeIBDev, ibDev)
-		}
+	for _, dev := range DiscoverIBDevices() {
+		activeIBDev = append(activeIBDev, dev.Name)
 	}
-	log.Printf("Get allIBDev:%s, Infiniband Link_layer && active state dev:%s", allIBDev, activeIBDev)
+	log.Printf("Get filtered && active state dev:%s", activeIBDev)
 	return activeIBDev
 }
 
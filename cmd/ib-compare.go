@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	compareByName = "name"
+	compareByGUID = "guid"
+)
+
+// ComparisonSide says what one side of a comparison was made of. Rates of a
+// side pool all of its captures.
+type ComparisonSide struct {
+	Paths           []string  `json:"paths"`
+	Captures        int       `json:"captures"`
+	Samples         int       `json:"samples"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// Change percentages are relative to A; they are null when A is 0 and B is
+// not, which always counts as significant. A counter found on one side only
+// is 0 on the other, OnlyIn says which side has it.
+type ThroughputShift struct {
+	Counter           string   `json:"counter"`
+	OnlyIn            string   `json:"only_in,omitempty"`
+	A                 Stats    `json:"a_gbps"`
+	B                 Stats    `json:"b_gbps"`
+	MeanChangePercent *float64 `json:"mean_change_percent"`
+	P50ChangePercent  *float64 `json:"p50_change_percent"`
+	P99ChangePercent  *float64 `json:"p99_change_percent"`
+	Significant       bool     `json:"significant"`
+}
+
+// ErrorDelta compares an error, discard or pause counter that increased on
+// either side. The per second rates make captures of different length
+// comparable.
+type ErrorDelta struct {
+	Counter       string   `json:"counter"`
+	OnlyIn        string   `json:"only_in,omitempty"`
+	Class         string   `json:"class"`
+	IncreaseA     float64  `json:"increase_a"`
+	IncreaseB     float64  `json:"increase_b"`
+	PerSecondA    float64  `json:"per_second_a"`
+	PerSecondB    float64  `json:"per_second_b"`
+	ChangePercent *float64 `json:"change_percent"`
+	Significant   bool     `json:"significant"`
+}
+
+type RateDiff struct {
+	Counter       string   `json:"counter"`
+	OnlyIn        string   `json:"only_in,omitempty"`
+	MeanA         float64  `json:"mean_per_second_a"`
+	MeanB         float64  `json:"mean_per_second_b"`
+	ChangePercent *float64 `json:"change_percent"`
+	Significant   bool     `json:"significant"`
+}
+
+// DeviceComparison pairs up a device of A with the one of B that has the
+// same name or node GUID.
+type DeviceComparison struct {
+	Key        string            `json:"key"`
+	DeviceA    string            `json:"device_a"`
+	DeviceB    string            `json:"device_b"`
+	FWVerA     string            `json:"fw_ver_a,omitempty"`
+	FWVerB     string            `json:"fw_ver_b,omitempty"`
+	Throughput []ThroughputShift `json:"throughput"`
+	Errors     []ErrorDelta      `json:"errors"`
+	Rates      []RateDiff        `json:"rates"`
+}
+
+type ComparisonReport struct {
+	By               string             `json:"by"`
+	ThresholdPercent float64            `json:"threshold_percent"`
+	A                ComparisonSide     `json:"a"`
+	B                ComparisonSide     `json:"b"`
+	Devices          []DeviceComparison `json:"devices"`
+	OnlyInA          []string           `json:"only_in_a"`
+	OnlyInB          []string           `json:"only_in_b"`
+}
+
+// compareSide is the analysis of one side plus the identities found in the
+// .json metadata of its captures.
+type compareSide struct {
+	analyzer   *captureAnalyzer
+	identities map[string]DeviceIdentity
+	paths      []string
+}
+
+func loadCompareSide(paths []string) (*compareSide, error) {
+	side := &compareSide{analyzer: newCaptureAnalyzer(), identities: map[string]DeviceIdentity{}, paths: paths}
+	for _, path := range paths {
+		err := forEachCapture(path, func(name string, r tickReader, meta *CaptureInfo) error {
+			if meta != nil {
+				for _, id := range meta.Identities {
+					side.identities[id.Device] = id
+				}
+			}
+			return side.analyzer.read(r, meta)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return side, nil
+}
+
+func (s *compareSide) summary() ComparisonSide {
+	a := s.analyzer
+	return ComparisonSide{Paths: s.paths, Captures: a.captures, Samples: a.samples, Start: a.start, End: a.end, DurationSeconds: a.seconds}
+}
+
+// devices maps the alignment key of every device to its name and counters.
+func (s *compareSide) devices(by string) (map[string]string, map[string]map[string]*seriesTrack, error) {
+	names := map[string]string{}
+	counters := map[string]map[string]*seriesTrack{}
+	for key, t := range s.analyzer.tracks {
+		align := key.IBDev
+		if by == compareByGUID {
+			align = s.identities[key.IBDev].NodeGUID
+			if align == "" {
+				return nil, nil, fmt.Errorf("no node GUID for %s in the capture metadata of %s, compare by name instead", key.IBDev, strings.Join(s.paths, ", "))
+			}
+		}
+		if other, ok := names[align]; ok && other != key.IBDev {
+			return nil, nil, fmt.Errorf("%s and %s share %s %s", other, key.IBDev, by, align)
+		}
+		names[align] = key.IBDev
+		if counters[align] == nil {
+			counters[align] = map[string]*seriesTrack{}
+		}
+		counters[align][key.Counter] = t
+	}
+	return names, counters, nil
+}
+
+func changePercent(a, b float64) *float64 {
+	if a == b {
+		zero := 0.0
+		return &zero
+	}
+	if a == 0 {
+		return nil
+	}
+	change := (b - a) / math.Abs(a) * 100
+	return &change
+}
+
+func isSignificant(change *float64, threshold float64) bool {
+	return change == nil || math.Abs(*change) >= threshold
+}
+
+func compareDevice(key, nameA, nameB string, a, b map[string]*seriesTrack, secondsA, secondsB, threshold float64) DeviceComparison {
+	dc := DeviceComparison{Key: key, DeviceA: nameA, DeviceB: nameB, Throughput: []ThroughputShift{}, Errors: []ErrorDelta{}, Rates: []RateDiff{}}
+	counters := make([]string, 0, len(a))
+	for counter := range a {
+		counters = append(counters, counter)
+	}
+	for counter := range b {
+		if a[counter] == nil {
+			counters = append(counters, counter)
+		}
+	}
+	sort.Strings(counters)
+
+	// a counter missing on one side, e.g. renamed by a firmware upgrade, is
+	// compared against 0 and always significant
+	for _, counter := range counters {
+		ta, tb := a[counter], b[counter]
+		onlyIn := ""
+		if tb == nil {
+			onlyIn, tb = "a", &seriesTrack{}
+		} else if ta == nil {
+			onlyIn, ta = "b", &seriesTrack{}
+		}
+		rateA, rateB := summarize(ta.rates), summarize(tb.rates)
+		rd := RateDiff{Counter: counter, OnlyIn: onlyIn, MeanA: rateA.Mean, MeanB: rateB.Mean, ChangePercent: changePercent(rateA.Mean, rateB.Mean)}
+		rd.Significant = onlyIn != "" || isSignificant(rd.ChangePercent, threshold)
+		dc.Rates = append(dc.Rates, rd)
+
+		if gbpsA := ta.gbps(counter); gbpsA != nil {
+			ts := ThroughputShift{Counter: counter, OnlyIn: onlyIn, A: summarize(gbpsA), B: summarize(tb.gbps(counter))}
+			ts.MeanChangePercent = changePercent(ts.A.Mean, ts.B.Mean)
+			ts.P50ChangePercent = changePercent(ts.A.P50, ts.B.P50)
+			ts.P99ChangePercent = changePercent(ts.A.P99, ts.B.P99)
+			ts.Significant = onlyIn != "" || isSignificant(ts.MeanChangePercent, threshold) ||
+				isSignificant(ts.P50ChangePercent, threshold) || isSignificant(ts.P99ChangePercent, threshold)
+			dc.Throughput = append(dc.Throughput, ts)
+		}
+
+		class := counterClass(counter)
+		if class == "" || (ta.increase <= 0 && tb.increase <= 0) {
+			continue
+		}
+		ed := ErrorDelta{Counter: counter, OnlyIn: onlyIn, Class: class, IncreaseA: ta.increase, IncreaseB: tb.increase}
+		if secondsA > 0 {
+			ed.PerSecondA = ta.increase / secondsA
+		}
+		if secondsB > 0 {
+			ed.PerSecondB = tb.increase / secondsB
+		}
+		ed.ChangePercent = changePercent(ed.PerSecondA, ed.PerSecondB)
+		ed.Significant = onlyIn != "" || isSignificant(ed.ChangePercent, threshold)
+		dc.Errors = append(dc.Errors, ed)
+	}
+	return dc
+}
+
+func compareCaptures(a, b *compareSide, by string, threshold float64) (ComparisonReport, error) {
+	report := ComparisonReport{
+		By:               by,
+		ThresholdPercent: threshold,
+		A:                a.summary(),
+		B:                b.summary(),
+		Devices:          []DeviceComparison{},
+		OnlyInA:          []string{},
+		OnlyInB:          []string{},
+	}
+	namesA, countersA, err := a.devices(by)
+	if err != nil {
+		return report, fmt.Errorf("A: %w", err)
+	}
+	namesB, countersB, err := b.devices(by)
+	if err != nil {
+		return report, fmt.Errorf("B: %w", err)
+	}
+
+	keys := make([]string, 0, len(namesA))
+	for key := range namesA {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		nameB, ok := namesB[key]
+		if !ok {
+			report.OnlyInA = append(report.OnlyInA, namesA[key])
+			continue
+		}
+		dc := compareDevice(key, namesA[key], nameB, countersA[key], countersB[key], report.A.DurationSeconds, report.B.DurationSeconds, threshold)
+		dc.FWVerA, dc.FWVerB = a.identities[namesA[key]].FWVer, b.identities[nameB].FWVer
+		report.Devices = append(report.Devices, dc)
+	}
+	for key, name := range namesB {
+		if _, ok := namesA[key]; !ok {
+			report.OnlyInB = append(report.OnlyInB, name)
+		}
+	}
+	sort.Strings(report.OnlyInB)
+	return report, nil
+}
+
+func formatChange(change *float64) string {
+	if change == nil {
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", *change)
+}
+
+// counterLabel is the counter's name in the table, with the side it was
+// found on when that is one only.
+func counterLabel(counter, onlyIn string) string {
+	if onlyIn == "" {
+		return counter
+	}
+	return fmt.Sprintf("%s (only %s)", counter, strings.ToUpper(onlyIn))
+}
+
+func significanceMark(significant bool) string {
+	if significant {
+		return "*"
+	}
+	return " "
+}
+
+func writeComparisonTable(w io.Writer, report ComparisonReport, all bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, side := range []struct {
+		label string
+		s     ComparisonSide
+	}{{"A", report.A}, {"B", report.B}} {
+		fmt.Fprintf(tw, "%s: %s (%d captures, %d samples, %.1fs)\n", side.label, strings.Join(side.s.Paths, ", "), side.s.Captures, side.s.Samples, side.s.DurationSeconds)
+	}
+	fmt.Fprintf(tw, "Devices matched by %s; * marks changes of at least %g%%\n", report.By, report.ThresholdPercent)
+
+	for _, dc := range report.Devices {
+		fmt.Fprintf(tw, "\n%s -> %s", dc.DeviceA, dc.DeviceB)
+		if report.By == compareByGUID {
+			fmt.Fprintf(tw, " (%s)", dc.Key)
+		}
+		if dc.FWVerA != "" || dc.FWVerB != "" {
+			fmt.Fprintf(tw, ", firmware %s -> %s", dc.FWVerA, dc.FWVerB)
+		}
+		fmt.Fprintln(tw)
+
+		if len(dc.Throughput) > 0 {
+			fmt.Fprintf(tw, "   Gb/s\tA p50\tB p50\tshift\tA p99\tB p99\tshift\tA mean\tB mean\tshift\t\n")
+			for _, t := range dc.Throughput {
+				fmt.Fprintf(tw, " %s %s\t%.3f\t%.3f\t%s\t%.3f\t%.3f\t%s\t%.3f\t%.3f\t%s\t\n", significanceMark(t.Significant), counterLabel(t.Counter, t.OnlyIn),
+					t.A.P50, t.B.P50, formatChange(t.P50ChangePercent),
+					t.A.P99, t.B.P99, formatChange(t.P99ChangePercent),
+					t.A.Mean, t.B.Mean, formatChange(t.MeanChangePercent))
+			}
+			// every table gets its own column widths
+			tw.Flush()
+		}
+		if len(dc.Errors) > 0 {
+			fmt.Fprintf(tw, "   errors\tA\tB\tA/s\tB/s\tchange\t\n")
+			for _, e := range dc.Errors {
+				fmt.Fprintf(tw, " %s %s\t%g\t%g\t%.4f\t%.4f\t%s\t\n", significanceMark(e.Significant), counterLabel(e.Counter, e.OnlyIn),
+					e.IncreaseA, e.IncreaseB, e.PerSecondA, e.PerSecondB, formatChange(e.ChangePercent))
+			}
+			tw.Flush()
+		} else {
+			fmt.Fprintf(tw, "   no error, discard or pause counter increased\n")
+		}
+		var rates []RateDiff
+		for _, r := range dc.Rates {
+			if all || r.Significant {
+				rates = append(rates, r)
+			}
+		}
+		if len(rates) > 0 {
+			fmt.Fprintf(tw, "   per second\tA mean\tB mean\tchange\t\n")
+			for _, r := range rates {
+				fmt.Fprintf(tw, " %s %s\t%.2f\t%.2f\t%s\t\n", significanceMark(r.Significant), counterLabel(r.Counter, r.OnlyIn), r.MeanA, r.MeanB, formatChange(r.ChangePercent))
+			}
+			tw.Flush()
+		}
+	}
+	if len(report.OnlyInA) > 0 {
+		fmt.Fprintf(tw, "\nOnly in A: %s\n", strings.Join(report.OnlyInA, ", "))
+	}
+	if len(report.OnlyInB) > 0 {
+		fmt.Fprintf(tw, "\nOnly in B: %s\n", strings.Join(report.OnlyInB, ", "))
+	}
+	return tw.Flush()
+}
+
+// runCompare implements "ib-exporter compare [-by name|guid] [-threshold
+// percent] [-format table|json] [-all] A B". A side with several captures,
+// comma separated or in a zip, is pooled.
+func runCompare(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	by := fs.String("by", compareByName, "Match devices by name or by node guid, which needs the .json capture metadata")
+	threshold := fs.Float64("threshold", 10, "Changes of at least this many percent are significant")
+	format := fs.String("format", "table", "Output format: table or json")
+	all := fs.Bool("all", false, "List every counter rate in the table, not only the significant ones")
+	files, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) != 2 {
+		return errors.New("usage: ib-exporter compare [-by name|guid] [-threshold percent] [-format table|json] [-all] <A> <B>")
+	}
+	if *by != compareByName && *by != compareByGUID {
+		return fmt.Errorf("unknown -by %q", *by)
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+
+	a, err := loadCompareSide(strings.Split(files[0], ","))
+	if err != nil {
+		return err
+	}
+	b, err := loadCompareSide(strings.Split(files[1], ","))
+	if err != nil {
+		return err
+	}
+	report, err := compareCaptures(a, b, *by, *threshold)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return writeComparisonTable(os.Stdout, report, *all)
+}
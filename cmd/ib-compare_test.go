@@ -0,0 +1,177 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"ib-exporter/capfile"
+)
+
+func TestChangeSignificance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b        float64
+		change      float64
+		new         bool
+		significant bool
+	}{
+		{100, 100, 0, false, false},
+		{0, 0, 0, false, false},
+		// at the threshold counts
+		{100, 110, 10, false, true},
+		{100, 109, 9, false, false},
+		{100, 80, -20, false, true},
+		{-100, -50, 50, false, true},
+		// from nothing
+		{0, 5, 0, true, true},
+	} {
+		change := changePercent(tc.a, tc.b)
+		if tc.new != (change == nil) || change != nil && *change != tc.change {
+			t.Errorf("%g -> %g: change %v, want %g", tc.a, tc.b, change, tc.change)
+		}
+		if significant := isSignificant(change, 10); significant != tc.significant {
+			t.Errorf("%g -> %g: significant %t at 10%%", tc.a, tc.b, significant)
+		}
+	}
+}
+
+// compareTicks is a side of a capture sampling devices every second for 4s,
+// each counter growing by perSecond.
+func compareTicks(t *testing.T, devices []string, perSecond map[string]float64, identities ...DeviceIdentity) *compareSide {
+	t.Helper()
+	var ticks []capfile.Tick
+	for i := range 5 {
+		tick := capfile.Tick{Time: at(time.Duration(i) * time.Second)}
+		for _, dev := range devices {
+			for _, counter := range slices.Sorted(maps.Keys(perSecond)) {
+				tick.Values = append(tick.Values, value(dev, counter, float64(i)*perSecond[counter]))
+			}
+		}
+		ticks = append(ticks, tick)
+	}
+	side := &compareSide{analyzer: newCaptureAnalyzer(), identities: map[string]DeviceIdentity{}, paths: []string{"test"}}
+	for _, id := range identities {
+		side.identities[id.Device] = id
+	}
+	if err := side.analyzer.read(&ticksReader{ticks: ticks}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return side
+}
+
+func TestCompareCaptures(t *testing.T) {
+	a := compareTicks(t, []string{"mlx5_0", "mlx5_1"}, map[string]float64{
+		"port_rcv_data":   1000,
+		"port_xmit_data":  1000,
+		"rx_discards_phy": 2,
+		"np_cnp_sent":     10,
+		// renamed in B
+		"rx_prio3_pause": 4,
+	})
+	b := compareTicks(t, []string{"mlx5_0", "mlx5_2"}, map[string]float64{
+		// 5% more, below the threshold
+		"port_rcv_data": 1050,
+		// 50% less
+		"port_xmit_data":        500,
+		"rx_discards_phy":       6,
+		"np_cnp_sent":           10,
+		"rx_prio3_pause_frames": 4,
+	})
+	report, err := compareCaptures(a, b, compareByName, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.OnlyInA, []string{"mlx5_1"}) || !slices.Equal(report.OnlyInB, []string{"mlx5_2"}) {
+		t.Errorf("only in A %q, only in B %q", report.OnlyInA, report.OnlyInB)
+	}
+	if len(report.Devices) != 1 || report.Devices[0].DeviceA != "mlx5_0" || report.Devices[0].DeviceB != "mlx5_0" {
+		t.Fatalf("devices %+v", report.Devices)
+	}
+	dc := report.Devices[0]
+
+	type diff struct {
+		onlyIn      string
+		significant bool
+	}
+	rates := map[string]diff{}
+	for _, r := range dc.Rates {
+		rates[r.Counter] = diff{r.OnlyIn, r.Significant}
+	}
+	wantRates := map[string]diff{
+		"np_cnp_sent":     {"", false},
+		"port_rcv_data":   {"", false},
+		"port_xmit_data":  {"", true},
+		"rx_discards_phy": {"", true},
+		// a counter on one side only is always significant
+		"rx_prio3_pause":        {"a", true},
+		"rx_prio3_pause_frames": {"b", true},
+	}
+	if !maps.Equal(rates, wantRates) {
+		t.Errorf("rates %+v, want %+v", rates, wantRates)
+	}
+
+	throughput := map[string]diff{}
+	for _, ts := range dc.Throughput {
+		throughput[ts.Counter] = diff{ts.OnlyIn, ts.Significant}
+		if ts.Counter == "port_xmit_data" && (ts.MeanChangePercent == nil || *ts.MeanChangePercent != -50) {
+			t.Errorf("port_xmit_data mean change %v, want -50%%", ts.MeanChangePercent)
+		}
+	}
+	if want := map[string]diff{"port_rcv_data": {"", false}, "port_xmit_data": {"", true}}; !maps.Equal(throughput, want) {
+		t.Errorf("throughput %+v, want %+v", throughput, want)
+	}
+
+	// the counters that increased, per second of each side
+	errs := map[string]ErrorDelta{}
+	for _, e := range dc.Errors {
+		errs[e.Counter] = e
+	}
+	if len(errs) != 3 {
+		t.Errorf("errors %+v", dc.Errors)
+	}
+	if e := errs["rx_discards_phy"]; e.Class != counterClassDiscard || e.PerSecondA != 2 || e.PerSecondB != 6 || *e.ChangePercent != 200 || !e.Significant {
+		t.Errorf("rx_discards_phy %+v", e)
+	}
+	if e := errs["rx_prio3_pause"]; e.OnlyIn != "a" || e.IncreaseA != 16 || e.IncreaseB != 0 || *e.ChangePercent != -100 || !e.Significant {
+		t.Errorf("rx_prio3_pause %+v", e)
+	}
+	if e := errs["rx_prio3_pause_frames"]; e.OnlyIn != "b" || e.IncreaseB != 16 || e.ChangePercent != nil || !e.Significant {
+		t.Errorf("rx_prio3_pause_frames %+v", e)
+	}
+
+	// a higher threshold lets the discards pass
+	report, _ = compareCaptures(a, b, compareByName, 300)
+	for _, e := range report.Devices[0].Errors {
+		if e.Significant != (e.OnlyIn != "") {
+			t.Errorf("threshold 300%%: %s significant %t", e.Counter, e.Significant)
+		}
+	}
+}
+
+func TestCompareByGUID(t *testing.T) {
+	counters := map[string]float64{"port_rcv_data": 1000}
+	a := compareTicks(t, []string{"mlx5_0", "mlx5_1"}, counters,
+		DeviceIdentity{Device: "mlx5_0", NodeGUID: "0c42:a103:0001:0001", FWVer: "28.39.1002"},
+		DeviceIdentity{Device: "mlx5_1", NodeGUID: "0c42:a103:0001:0002", FWVer: "28.39.1002"})
+	// renumbered
+	b := compareTicks(t, []string{"mlx5_0", "mlx5_1"}, counters,
+		DeviceIdentity{Device: "mlx5_0", NodeGUID: "0c42:a103:0001:0002", FWVer: "28.41.1000"},
+		DeviceIdentity{Device: "mlx5_1", NodeGUID: "0c42:a103:0001:0001", FWVer: "28.41.1000"})
+	report, err := compareCaptures(a, b, compareByGUID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pairs []string
+	for _, dc := range report.Devices {
+		pairs = append(pairs, dc.DeviceA+"->"+dc.DeviceB+" "+dc.FWVerA+"->"+dc.FWVerB)
+	}
+	if want := []string{"mlx5_0->mlx5_1 28.39.1002->28.41.1000", "mlx5_1->mlx5_0 28.39.1002->28.41.1000"}; !slices.Equal(pairs, want) {
+		t.Errorf("pairs %q, want %q", pairs, want)
+	}
+
+	// without the metadata there is nothing to match
+	if _, err := compareCaptures(a, compareTicks(t, []string{"mlx5_0"}, counters), compareByGUID, 10); err == nil {
+		t.Error("compared by GUID without identities")
+	}
+}
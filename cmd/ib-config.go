@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/yaml.v3"
+)
+
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Config is the content of the YAML configuration file. Every field has a
+// default, and command line flags that were set explicitly override it.
+type Config struct {
+	HTTP       HTTPConfig        `yaml:"http"`
+	Helper     HelperConfig      `yaml:"helper"`
+	Paths      PathsConfig       `yaml:"paths"`
+	Exec       ExecConfig        `yaml:"exec"`
+	Collectors CollectorsConfig  `yaml:"collectors"`
+	Filters    FiltersConfig     `yaml:"filters"`
+	Labels     map[string]string `yaml:"labels"`
+	Capture    CaptureConfig     `yaml:"capture"`
+	Monitor    MonitorConfig     `yaml:"monitor"`
+	Stream     StreamConfig      `yaml:"stream"`
+	Recorder   RecorderConfig    `yaml:"recorder"`
+	Upload     UploadConfig      `yaml:"upload"`
+
+	filter DeviceFilter
+}
+
+// HTTPConfig is the metrics endpoint. ListenAddress defaults to ":<port>";
+// WebConfigFile uses the Prometheus exporter-toolkit format for TLS, client
+// certificates, basic auth and HTTP/2.
+type HTTPConfig struct {
+	Port          string `yaml:"port"`
+	ListenAddress string `yaml:"listen_address"`
+	WebConfigFile string `yaml:"web_config_file"`
+}
+
+func (h HTTPConfig) listenAddress() string {
+	if h.ListenAddress != "" {
+		return h.ListenAddress
+	}
+	return ":" + h.Port
+}
+
+// HelperConfig points the HTTP process at the privileged collection helper.
+// With an empty socket the HTTP process collects by itself. SocketGID is the
+// group the helper gives its socket, -1 keeps the helper's own group.
+type HelperConfig struct {
+	Socket    string `yaml:"socket"`
+	SocketGID int    `yaml:"socket_gid"`
+}
+
+// PathsConfig holds the filesystem roots every collector reads from. Pointing
+// them at host mounts such as /host/sys, or at a captured copy of the trees,
+// works without changing anything else.
+type PathsConfig struct {
+	Sysfs   string `yaml:"sysfs"`
+	Debugfs string `yaml:"debugfs"`
+	Procfs  string `yaml:"procfs"`
+	// defaults to <sysfs>/class/infiniband, or $IBSYSPATH when set
+	InfiniBand string `yaml:"infiniband"`
+}
+
+func (p PathsConfig) infiniBandPath() string {
+	if p.InfiniBand != "" {
+		return p.InfiniBand
+	}
+	return filepath.Join(p.Sysfs, "class", "infiniband")
+}
+
+// ExecConfig controls how host tools are run, see Executor. Mode defaults to
+// nsenter when CONTAINER=true and to direct otherwise.
+type ExecConfig struct {
+	Mode          string                   `yaml:"mode"`
+	Timeout       time.Duration            `yaml:"timeout"`
+	Timeouts      map[string]time.Duration `yaml:"timeouts"`
+	MaxConcurrent int                      `yaml:"max_concurrent"`
+}
+
+type CollectorsConfig struct {
+	Counters   bool          `yaml:"counters"`
+	HWCounters bool          `yaml:"hw_counters"`
+	QP         bool          `yaml:"qp"`
+	MR         bool          `yaml:"mr"`
+	PortSpeed  bool          `yaml:"port_speed"`
+	Ethtool    EthtoolConfig `yaml:"ethtool"`
+	Optical    bool          `yaml:"optical"`
+	Identity   bool          `yaml:"identity"`
+	GID        bool          `yaml:"gid"`
+	NUMA       bool          `yaml:"numa"`
+	MRRS       MRRSConfig    `yaml:"mrrs"`
+}
+
+// EthtoolConfig selects the `ethtool -S` fields exported per link layer.
+type EthtoolConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	EthernetFields   []string `yaml:"ethernet_fields"`
+	InfiniBandFields []string `yaml:"infiniband_fields"`
+}
+
+// MRRSConfig controls the PCIe Max Read Request Size fix applied before each
+// collection. Value is the encoded size: 0=128B, 1=256B ... 5=4096B.
+type MRRSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Value   int  `yaml:"value"`
+}
+
+type FiltersConfig struct {
+	DeviceInclude string `yaml:"device_include"`
+	DeviceExclude string `yaml:"device_exclude"`
+	NetDevInclude string `yaml:"netdev_include"`
+	NetDevExclude string `yaml:"netdev_exclude"`
+	DriverInclude string `yaml:"driver_include"`
+	DriverExclude string `yaml:"driver_exclude"`
+	PCIInclude    string `yaml:"pci_include"`
+	PCIExclude    string `yaml:"pci_exclude"`
+	ExportVFs     bool   `yaml:"export_vf"`
+}
+
+// CaptureConfig covers -runonce and the captures started through the API.
+// Duration and Interval are the defaults of both; captures requested over
+// the API are limited by MaxConcurrent and MaxDuration.
+type CaptureConfig struct {
+	DataPath           string        `yaml:"data_path"`
+	Duration           time.Duration `yaml:"duration"`
+	Interval           time.Duration `yaml:"interval"`
+	ArchiveThresholdMB int           `yaml:"archive_threshold_mb"`
+	// retention: the newest archive_keep archives, and of those only the
+	// ones younger than archive_max_age and within archive_max_total_mb;
+	// zero age or size is no limit
+	ArchiveKeep          int           `yaml:"archive_keep"`
+	ArchiveMaxAge        time.Duration `yaml:"archive_max_age"`
+	ArchiveMaxTotalMB    int           `yaml:"archive_max_total_mb"`
+	ArchiveFormat        string        `yaml:"archive_format"`
+	ArchiveCheckInterval time.Duration `yaml:"archive_check_interval"`
+	// csv is the -runonce text format, binary the compact capfile format;
+	// compression is none or zstd and only applies to binary
+	Format      string `yaml:"format"`
+	Compression string `yaml:"compression"`
+	// full collects everything once per tick, precise only the sysfs port
+	// counters and ethtool statistics, kept open, for intervals down to 10ms
+	Sampler string `yaml:"sampler"`
+	// the shortest interval the daemon's captures may sample at with the
+	// full sampler, which runs commands every tick; -runonce has no minimum
+	MinFullInterval time.Duration `yaml:"min_full_interval"`
+	// how long before a tick the precise sampler wakes up and spins, since
+	// timers fire up to a millisecond late; 0 leaves it to the timer
+	SpinLead time.Duration `yaml:"spin_lead"`
+	// groups of counters sampled at their own interval, for captures that
+	// select no counters themselves
+	Groups        []CaptureGroup `yaml:"groups"`
+	MaxConcurrent int            `yaml:"max_concurrent"`
+	MaxDuration   time.Duration  `yaml:"max_duration"`
+	// how often the trigger rules sample the counters
+	TriggerInterval time.Duration    `yaml:"trigger_interval"`
+	Schedules       []ScheduleConfig `yaml:"schedules"`
+	Triggers        []TriggerConfig  `yaml:"triggers"`
+}
+
+// minInterval is the shortest interval the daemon's captures may sample at
+// with sampler.
+func (c CaptureConfig) minInterval(sampler string) time.Duration {
+	if sampler == captureSamplerFull {
+		return c.MinFullInterval
+	}
+	return captureMinInterval
+}
+
+// CaptureTemplate is what an automatic capture records. Zero durations take
+// the capture defaults, empty lists select everything.
+type CaptureTemplate struct {
+	Duration time.Duration  `yaml:"duration"`
+	Interval time.Duration  `yaml:"interval"`
+	Devices  []string       `yaml:"devices"`
+	Counters []string       `yaml:"counters"`
+	Sampler  string         `yaml:"sampler"`
+	Groups   []CaptureGroup `yaml:"groups"`
+}
+
+// ScheduleConfig starts a capture whenever the cron expression matches,
+// e.g. "0 * * * *" for the top of every hour.
+type ScheduleConfig struct {
+	Name            string `yaml:"name"`
+	Cron            string `yaml:"cron"`
+	CaptureTemplate `yaml:",inline"`
+
+	schedule cronSchedule
+}
+
+// TriggerConfig starts a capture when the counters matching Counter (and
+// Device, if set) meet Condition for at least For:
+//
+//	increase          the counter grew by more than Threshold since the last check
+//	rate_above        the counter grew faster than Threshold per second
+//	rate_below        the counter grew slower than Threshold per second
+//	throughput_below  the matched data counters of a device add up to less
+//	                  than Threshold percent of its port speed
+//
+// Counter and Device are regular expressions matched against the whole name,
+// of the sampled counters: sysfs, ethtool fields and portSpeed.
+type TriggerConfig struct {
+	Name            string        `yaml:"name"`
+	Device          string        `yaml:"device"`
+	Counter         string        `yaml:"counter"`
+	Condition       string        `yaml:"condition"`
+	Threshold       float64       `yaml:"threshold"`
+	For             time.Duration `yaml:"for"`
+	Cooldown        time.Duration `yaml:"cooldown"`
+	CaptureTemplate `yaml:",inline"`
+
+	device, counter *regexp.Regexp
+}
+
+type MonitorConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RecorderConfig is the flight recorder: the last Window of sysfs counter
+// samples, taken every Interval, kept in memory and written to the capture
+// directory when something happens. Dumps closer together than DumpCooldown
+// are skipped so a flapping port doesn't fill the disk.
+type RecorderConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Window       time.Duration `yaml:"window"`
+	Interval     time.Duration `yaml:"interval"`
+	DumpCooldown time.Duration `yaml:"dump_cooldown"`
+}
+
+// UploadConfig pushes the capture archives to an S3-compatible bucket. The
+// credentials default to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN; PathStyle is needed for MinIO and most other stores.
+type UploadConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Endpoint        string `yaml:"endpoint"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	PathStyle       bool   `yaml:"path_style"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// {node}, {date} and {timestamp} are replaced, the archive name appended
+	KeyPrefix         string        `yaml:"key_prefix"`
+	NodeName          string        `yaml:"node_name"`
+	DeleteAfterUpload bool          `yaml:"delete_after_upload"`
+	Interval          time.Duration `yaml:"interval"`
+	Timeout           time.Duration `yaml:"timeout"`
+	Retries           int           `yaml:"retries"`
+	RetryBackoff      time.Duration `yaml:"retry_backoff"`
+}
+
+// StreamConfig limits the live counter stream. A client whose buffer of
+// pending events is full is disconnected instead of slowing the sampler down.
+type StreamConfig struct {
+	MinInterval  time.Duration `yaml:"min_interval"`
+	MaxClients   int           `yaml:"max_clients"`
+	ClientBuffer int           `yaml:"client_buffer"`
+}
+
+func defaultConfig() *Config {
+	c := &Config{
+		HTTP:   HTTPConfig{Port: "9315"},
+		Helper: HelperConfig{SocketGID: -1},
+		Paths: PathsConfig{
+			Sysfs:      "/sys",
+			Debugfs:    "/sys/kernel/debug",
+			Procfs:     "/proc",
+			InfiniBand: os.Getenv("IBSYSPATH"),
+		},
+		Exec: ExecConfig{
+			Mode:          execModeDirect,
+			Timeout:       10 * time.Second,
+			Timeouts:      map[string]time.Duration{"mlxlink": time.Minute},
+			MaxConcurrent: 8,
+		},
+		Collectors: CollectorsConfig{
+			Counters:   true,
+			HWCounters: true,
+			QP:         true,
+			MR:         true,
+			PortSpeed:  true,
+			Ethtool: EthtoolConfig{
+				Enabled: true,
+				EthernetFields: []string{
+					"rx_prio0_bytes", "tx_prio0_bytes", "rx_prio0_discards",
+					"rx_prio5_bytes", "tx_prio5_bytes", "rx_prio5_discards",
+					"rx_prio0_pause", "rx_prio0_pause_duration", "tx_prio0_pause", "tx_prio0_pause_duration",
+					"rx_prio5_pause", "rx_prio5_pause_duration", "tx_prio5_pause", "tx_prio5_pause_duration",
+				},
+				InfiniBandFields: []string{"rx_vport_rdma_unicast_bytes", "tx_vport_rdma_unicast_bytes"},
+			},
+			Identity: true,
+			GID:      true,
+			NUMA:     true,
+			MRRS:     MRRSConfig{Enabled: true, Value: 5},
+		},
+		Filters: FiltersConfig{DeviceExclude: "mezz", ExportVFs: true},
+		Capture: CaptureConfig{
+			DataPath:             "/var/log/ibtestdata",
+			Duration:             5 * time.Second,
+			Interval:             100 * time.Millisecond,
+			ArchiveThresholdMB:   5,
+			ArchiveKeep:          5,
+			ArchiveFormat:        archiveFormatZip,
+			ArchiveCheckInterval: 10 * time.Second,
+			Format:               captureFormatCSV,
+			Compression:          captureCompressionZstd,
+			Sampler:              captureSamplerFull,
+			MinFullInterval:      time.Second,
+			SpinLead:             time.Millisecond,
+			MaxConcurrent:        2,
+			MaxDuration:          10 * time.Minute,
+			TriggerInterval:      time.Second,
+		},
+		Monitor: MonitorConfig{Interval: time.Second},
+		Recorder: RecorderConfig{
+			Enabled:      true,
+			Window:       120 * time.Second,
+			Interval:     100 * time.Millisecond,
+			DumpCooldown: 10 * time.Second,
+		},
+		Upload: UploadConfig{
+			Region:            "us-east-1",
+			KeyPrefix:         "ib-exporter/{node}/{date}/",
+			DeleteAfterUpload: true,
+			Interval:          time.Minute,
+			Timeout:           5 * time.Minute,
+			Retries:           5,
+			RetryBackoff:      time.Second,
+		},
+		Stream: StreamConfig{
+			MinInterval:  100 * time.Millisecond,
+			MaxClients:   32,
+			ClientBuffer: 16,
+		},
+	}
+	if os.Getenv("CONTAINER") == "true" {
+		c.Exec.Mode = execModeNsenter
+	}
+	return c
+}
+
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	c := defaultConfig()
+	if err := c.Validate(); err != nil {
+		panic(err)
+	}
+	currentConfig.Store(c)
+	executor, _ := NewExecutor(c.Exec)
+	hostExecutor.Store(executor)
+}
+
+// cfg returns the active configuration. It is replaced, never mutated, on reload.
+func cfg() *Config {
+	return currentConfig.Load()
+}
+
+// Validate checks the configuration and compiles what later code needs. All
+// problems are reported at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.HTTP.Port); err != nil || port < 1 || port > 65535 {
+		fail("http.port: %q is not a valid TCP port", c.HTTP.Port)
+	}
+	if c.HTTP.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.ListenAddress); err != nil {
+			fail("http.listen_address: %v", err)
+		}
+	}
+	if err := web.Validate(c.HTTP.WebConfigFile); err != nil {
+		fail("http.web_config_file: %v", err)
+	}
+	for name, p := range map[string]string{"sysfs": c.Paths.Sysfs, "debugfs": c.Paths.Debugfs, "procfs": c.Paths.Procfs} {
+		if p == "" {
+			fail("paths.%s: must not be empty", name)
+		}
+	}
+	if _, _, err := parseExecMode(c.Exec.Mode); err != nil {
+		fail("exec.mode: %v", err)
+	}
+	if c.Exec.Timeout <= 0 {
+		fail("exec.timeout: must be positive")
+	}
+	for name, t := range c.Exec.Timeouts {
+		if t <= 0 {
+			fail("exec.timeouts.%s: must be positive", name)
+		}
+	}
+	if c.Exec.MaxConcurrent < 1 {
+		fail("exec.max_concurrent: must be at least 1")
+	}
+	if c.Collectors.MRRS.Value < 0 || c.Collectors.MRRS.Value > 5 {
+		fail("collectors.mrrs.value: %d is out of range 0-5", c.Collectors.MRRS.Value)
+	}
+	for name := range c.Labels {
+		if !labelNameRegex.MatchString(name) {
+			fail("labels: %q is not a valid label name", name)
+		}
+	}
+	if c.Capture.DataPath == "" {
+		fail("capture.data_path: must not be empty")
+	}
+	if c.Capture.Duration <= 0 {
+		fail("capture.duration: must be positive")
+	}
+	if c.Capture.Interval < captureMinInterval {
+		fail("capture.interval: %s is below %s", c.Capture.Interval, captureMinInterval)
+	}
+	if c.Capture.ArchiveThresholdMB < 0 {
+		fail("capture.archive_threshold_mb: must not be negative")
+	}
+	if c.Capture.ArchiveKeep < 1 {
+		fail("capture.archive_keep: must keep at least one archive")
+	}
+	if c.Capture.ArchiveMaxAge < 0 {
+		fail("capture.archive_max_age: must not be negative")
+	}
+	if c.Capture.ArchiveMaxTotalMB < 0 {
+		fail("capture.archive_max_total_mb: must not be negative")
+	}
+	if !slices.Contains(archiveFormats, c.Capture.ArchiveFormat) {
+		fail("capture.archive_format: %q is not one of %s", c.Capture.ArchiveFormat, strings.Join(archiveFormats, ", "))
+	}
+	if c.Capture.ArchiveCheckInterval < time.Second {
+		fail("capture.archive_check_interval: %s is below 1s", c.Capture.ArchiveCheckInterval)
+	}
+	if c.Capture.Format != captureFormatCSV && c.Capture.Format != captureFormatBinary {
+		fail("capture.format: %q is not %s or %s", c.Capture.Format, captureFormatCSV, captureFormatBinary)
+	}
+	if c.Capture.Compression != captureCompressionNone && c.Capture.Compression != captureCompressionZstd {
+		fail("capture.compression: %q is not %s or %s", c.Capture.Compression, captureCompressionNone, captureCompressionZstd)
+	}
+	validSampler := func(sampler string) bool {
+		return sampler == captureSamplerFull || sampler == captureSamplerPrecise
+	}
+	if !validSampler(c.Capture.Sampler) {
+		fail("capture.sampler: %q is not %s or %s", c.Capture.Sampler, captureSamplerFull, captureSamplerPrecise)
+	}
+	if c.Capture.MinFullInterval < captureMinInterval {
+		fail("capture.min_full_interval: %s is below %s", c.Capture.MinFullInterval, captureMinInterval)
+	}
+	if c.Capture.SpinLead < 0 || c.Capture.SpinLead > captureMaxSpinLead {
+		fail("capture.spin_lead: %s is not between 0 and %s", c.Capture.SpinLead, captureMaxSpinLead)
+	}
+	if err := validateCaptureGroups(c.Capture.Groups); err != nil {
+		fail("capture.%v", err)
+	} else if err := checkGroupIntervals(c.Capture.Groups, c.Capture.Sampler, c.Capture.minInterval); err != nil {
+		fail("capture.%v", err)
+	}
+	if c.Capture.MaxConcurrent < 1 {
+		fail("capture.max_concurrent: must be at least 1")
+	}
+	if c.Capture.MaxDuration <= 0 {
+		fail("capture.max_duration: must be positive")
+	}
+	if c.Capture.TriggerInterval < 100*time.Millisecond {
+		fail("capture.trigger_interval: %s is below 100ms", c.Capture.TriggerInterval)
+	}
+	validateTemplate := func(field string, t CaptureTemplate) {
+		if t.Duration < 0 || t.Duration > c.Capture.MaxDuration {
+			fail("%s.duration: must be at most capture.max_duration (%s)", field, c.Capture.MaxDuration)
+		}
+		if t.Sampler != "" && !validSampler(t.Sampler) {
+			fail("%s.sampler: %q is not %s or %s", field, t.Sampler, captureSamplerFull, captureSamplerPrecise)
+		}
+		sampler := cmp.Or(t.Sampler, c.Capture.Sampler)
+		if min := c.Capture.minInterval(sampler); t.Interval != 0 && t.Interval < min {
+			fail("%s.interval: %s is below %s, the minimum of the %s sampler", field, t.Interval, min, sampler)
+		}
+		if err := validateCaptureGroups(t.Groups); err != nil {
+			fail("%s.%v", field, err)
+		} else if err := checkGroupIntervals(t.Groups, sampler, c.Capture.minInterval); err != nil {
+			fail("%s.%v", field, err)
+		} else if len(t.Groups) > 0 && len(t.Counters) > 0 {
+			fail("%s.counters: counters and groups don't go together, give each group its counters", field)
+		}
+	}
+	names := map[string]bool{}
+	checkName := func(field, name string) {
+		if name == "" {
+			fail("%s.name: must not be empty", field)
+		} else if names[name] {
+			fail("%s.name: %q is used twice", field, name)
+		}
+		names[name] = true
+	}
+	for i := range c.Capture.Schedules {
+		s := &c.Capture.Schedules[i]
+		field := fmt.Sprintf("capture.schedules[%d]", i)
+		checkName(field, s.Name)
+		var err error
+		if s.schedule, err = parseCron(s.Cron); err != nil {
+			fail("%s.cron: %v", field, err)
+		}
+		validateTemplate(field, s.CaptureTemplate)
+	}
+	for i := range c.Capture.Triggers {
+		t := &c.Capture.Triggers[i]
+		field := fmt.Sprintf("capture.triggers[%d]", i)
+		checkName(field, t.Name)
+		if !triggerConditions[t.Condition] {
+			fail("%s.condition: unknown condition %q", field, t.Condition)
+		}
+		if t.Condition == triggerThroughputBelow && (t.Threshold <= 0 || t.Threshold > 100) {
+			fail("%s.threshold: must be a percentage of the port speed", field)
+		}
+		var err error
+		if t.Counter == "" {
+			fail("%s.counter: must not be empty", field)
+		} else if t.counter, err = regexp.Compile("^(?:" + t.Counter + ")$"); err != nil {
+			fail("%s.counter: %v", field, err)
+		}
+		if t.Device != "" {
+			if t.device, err = regexp.Compile("^(?:" + t.Device + ")$"); err != nil {
+				fail("%s.device: %v", field, err)
+			}
+		}
+		if t.For < 0 || t.Cooldown < 0 {
+			fail("%s: for and cooldown must not be negative", field)
+		}
+		validateTemplate(field, t.CaptureTemplate)
+	}
+	if c.Monitor.Interval < 100*time.Millisecond {
+		fail("monitor.interval: %s is below 100ms", c.Monitor.Interval)
+	}
+	if c.Recorder.Interval < 10*time.Millisecond {
+		fail("recorder.interval: %s is below 10ms", c.Recorder.Interval)
+	} else if n := c.Recorder.Window / c.Recorder.Interval; n < 2 || n > recorderMaxSamples {
+		fail("recorder.window: must hold between 2 and %d samples of recorder.interval", recorderMaxSamples)
+	}
+	if c.Upload.Enabled {
+		if u, err := url.Parse(c.Upload.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("upload.endpoint: %q is not an http or https URL", c.Upload.Endpoint)
+		}
+		if c.Upload.Bucket == "" {
+			fail("upload.bucket: must not be empty")
+		}
+		if c.Upload.Region == "" {
+			fail("upload.region: must not be empty")
+		}
+		if creds := c.Upload.credentials(); creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			fail("upload: no credentials in access_key_id and secret_access_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+	}
+	if c.Upload.Interval < time.Second {
+		fail("upload.interval: %s is below 1s", c.Upload.Interval)
+	}
+	if c.Upload.Timeout <= 0 {
+		fail("upload.timeout: must be positive")
+	}
+	if c.Upload.Retries < 0 {
+		fail("upload.retries: must not be negative")
+	}
+	if c.Upload.RetryBackoff <= 0 {
+		fail("upload.retry_backoff: must be positive")
+	}
+	if c.Recorder.DumpCooldown < 0 {
+		fail("recorder.dump_cooldown: must not be negative")
+	}
+	if c.Stream.MinInterval < 10*time.Millisecond {
+		fail("stream.min_interval: %s is below 10ms", c.Stream.MinInterval)
+	}
+	if c.Stream.MaxClients < 1 {
+		fail("stream.max_clients: must be at least 1")
+	}
+	if c.Stream.ClientBuffer < 1 {
+		fail("stream.client_buffer: must be at least 1")
+	}
+
+	filter, err := NewDeviceFilter(c.Filters)
+	if err != nil {
+		fail("filters: %v", err)
+	}
+	c.filter = filter
+	return errors.Join(errs...)
+}
+
+// LoadConfig reads the file over the defaults. Unknown keys are rejected so
+// that typos don't silently fall back to defaults.
+func LoadConfig(filename string) (*Config, error) {
+	c := defaultConfig()
+	if filename == "" {
+		return c, nil
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config file %s: %w", filename, err)
+	}
+	return c, nil
+}
+
+// configFlags are the command line flags that map onto Config fields.
+type configFlags struct {
+	fs          *flag.FlagSet
+	port        *string
+	listenAddr  *string
+	webConfig   *string
+	runDuration *int
+	threshold   *int
+	dataPath    *string
+	execMode    *string
+	socket      *string
+	socketGID   *int
+	paths       PathsConfig
+	filters     FiltersConfig
+}
+
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	d := defaultConfig()
+	f := &configFlags{fs: fs}
+	f.port = fs.String("port", d.HTTP.Port, "port to run the server on")
+	f.listenAddr = fs.String("web.listen-address", d.HTTP.ListenAddress, "Address to listen on, e.g. 10.0.0.1:9315 for a management interface only (default \":<port>\")")
+	f.webConfig = fs.String("web.config.file", d.HTTP.WebConfigFile, "Path to an exporter-toolkit web config file enabling TLS, client certificates, basic auth or HTTP/2")
+	f.runDuration = fs.Int("t", int(d.Capture.Duration/time.Second), "The total time for the task to run")
+	f.threshold = fs.Int("r", d.Capture.ArchiveThresholdMB, "The size threshold in MB for archiving the data folder")
+	f.dataPath = fs.String("datapath", d.Capture.DataPath, "Path for storing data files")
+	f.socket = fs.String("helper.socket", d.Helper.Socket, "Unix socket of the privileged collection helper")
+	f.socketGID = fs.Int("helper.socket-gid", d.Helper.SocketGID, "Group ID given to the helper socket, -1 to keep the helper's group")
+	f.execMode = fs.String("exec.mode", d.Exec.Mode, "How to run host tools: direct, nsenter or chroot:<root>")
+	fs.StringVar(&f.paths.Sysfs, "path.sysfs", d.Paths.Sysfs, "sysfs mountpoint")
+	fs.StringVar(&f.paths.Debugfs, "path.debugfs", d.Paths.Debugfs, "debugfs mountpoint")
+	fs.StringVar(&f.paths.Procfs, "path.procfs", d.Paths.Procfs, "procfs mountpoint")
+	fs.StringVar(&f.filters.DeviceInclude, "device.include", "", "Regexp of IB device names to export")
+	fs.StringVar(&f.filters.DeviceExclude, "device.exclude", d.Filters.DeviceExclude, "Regexp of IB device names to skip")
+	fs.StringVar(&f.filters.NetDevInclude, "netdev.include", "", "Regexp of netdev names to export")
+	fs.StringVar(&f.filters.NetDevExclude, "netdev.exclude", "", "Regexp of netdev names to skip")
+	fs.StringVar(&f.filters.DriverInclude, "driver.include", "", "Regexp of kernel driver names to export")
+	fs.StringVar(&f.filters.DriverExclude, "driver.exclude", "", "Regexp of kernel driver names to skip")
+	fs.StringVar(&f.filters.PCIInclude, "pci.include", "", "Regexp of PCI vendor:device IDs to export, e.g. 15b3:101d")
+	fs.StringVar(&f.filters.PCIExclude, "pci.exclude", "", "Regexp of PCI vendor:device IDs to skip")
+	fs.BoolVar(&f.filters.ExportVFs, "export.vf", d.Filters.ExportVFs, "Export SR-IOV virtual functions")
+	return f
+}
+
+// apply overrides the config with the flags given on the command line.
+func (f *configFlags) apply(c *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			c.HTTP.Port = *f.port
+		case "web.listen-address":
+			c.HTTP.ListenAddress = *f.listenAddr
+		case "web.config.file":
+			c.HTTP.WebConfigFile = *f.webConfig
+		case "t":
+			c.Capture.Duration = time.Duration(*f.runDuration) * time.Second
+		case "r":
+			c.Capture.ArchiveThresholdMB = *f.threshold
+		case "datapath":
+			c.Capture.DataPath = *f.dataPath
+		case "helper.socket":
+			c.Helper.Socket = *f.socket
+		case "helper.socket-gid":
+			c.Helper.SocketGID = *f.socketGID
+		case "exec.mode":
+			c.Exec.Mode = *f.execMode
+		case "path.sysfs":
+			c.Paths.Sysfs = f.paths.Sysfs
+		case "path.debugfs":
+			c.Paths.Debugfs = f.paths.Debugfs
+		case "path.procfs":
+			c.Paths.Procfs = f.paths.Procfs
+		case "device.include":
+			c.Filters.DeviceInclude = f.filters.DeviceInclude
+		case "device.exclude":
+			c.Filters.DeviceExclude = f.filters.DeviceExclude
+		case "netdev.include":
+			c.Filters.NetDevInclude = f.filters.NetDevInclude
+		case "netdev.exclude":
+			c.Filters.NetDevExclude = f.filters.NetDevExclude
+		case "driver.include":
+			c.Filters.DriverInclude = f.filters.DriverInclude
+		case "driver.exclude":
+			c.Filters.DriverExclude = f.filters.DriverExclude
+		case "pci.include":
+			c.Filters.PCIInclude = f.filters.PCIInclude
+		case "pci.exclude":
+			c.Filters.PCIExclude = f.filters.PCIExclude
+		case "export.vf":
+			c.Filters.ExportVFs = f.filters.ExportVFs
+		}
+	})
+}
+
+// BuildConfig returns the effective, validated configuration: defaults, then
+// the file, then the flags given on the command line.
+func BuildConfig(filename string, flags *configFlags) (*Config, error) {
+	c, err := LoadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	flags.apply(c)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyConfig makes c the active configuration. It is only called once at
+// startup; reloads go through reloadConfig.
+func applyConfig(c *Config) {
+	currentConfig.Store(c)
+	executor, _ := NewExecutor(c.Exec)
+	hostExecutor.Store(executor)
+	IBSYSPATH = c.Paths.infiniBandPath()
+	DEBUGFSPATH = c.Paths.Debugfs
+	PROCFSPATH = c.Paths.Procfs
+}
+
+// reloadConfig swaps in a new configuration. Settings bound at startup, like
+// the listening port and the filesystem paths, keep their old values.
+func reloadConfig(filename string, flags *configFlags) error {
+	c, err := BuildConfig(filename, flags)
+	if err != nil {
+		return err
+	}
+	old := cfg()
+	if c.HTTP != old.HTTP {
+		log.Printf("Config http section changed, restart to apply it")
+		c.HTTP = old.HTTP
+	}
+	if c.Helper != old.Helper {
+		log.Printf("Config helper section changed, restart to apply it")
+		c.Helper = old.Helper
+	}
+	if c.Paths != old.Paths {
+		log.Printf("Config paths section changed, restart to apply it")
+		c.Paths = old.Paths
+	}
+	// Validate already built it once, so this can't fail
+	executor, _ := NewExecutor(c.Exec)
+	currentConfig.Store(c)
+	hostExecutor.Store(executor)
+	forgetDisabledCollectors(old.Collectors, c.Collectors)
+	return nil
+}
+
+// watchConfigReload reloads the configuration on SIGHUP. A bad file is
+// logged and the previous configuration stays active. The HTTP listener and
+// any rate state live outside the config, so they are not affected.
+func watchConfigReload(filename string, flags *configFlags) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := reloadConfig(filename, flags); err != nil {
+				log.Printf("Reload config failed, keeping the previous one: %v", err)
+				continue
+			}
+			log.Printf("Reloaded config from %s", filename)
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testConfigFlags() *configFlags {
+	return registerConfigFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+}
+
+func TestBuildConfig(t *testing.T) {
+	c, err := BuildConfig(writeTestConfig(t, `
+http:
+  port: "9400"
+collectors:
+  qp: false
+labels:
+  cluster: a
+capture:
+  interval: 10ms
+`), testConfigFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Port != "9400" || c.Collectors.QP || c.Labels["cluster"] != "a" || c.Capture.Interval != 10*time.Millisecond {
+		t.Errorf("file not applied: %+v", c)
+	}
+	// the rest keeps the defaults
+	if d := defaultConfig(); c.Collectors.MR != d.Collectors.MR || c.Capture.Duration != d.Capture.Duration {
+		t.Errorf("defaults not kept: %+v", c)
+	}
+}
+
+func TestBuildConfigFlags(t *testing.T) {
+	flags := testConfigFlags()
+	if err := flags.fs.Parse([]string{"-port", "9500", "-datapath", "/tmp/captures"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := BuildConfig(writeTestConfig(t, "http:\n  port: \"9400\"\ncapture:\n  duration: 30s\n"), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flags given override the file, the others don't
+	if c.HTTP.Port != "9500" || c.Capture.DataPath != "/tmp/captures" || c.Capture.Duration != 30*time.Second {
+		t.Errorf("port %s, data path %s, duration %s", c.HTTP.Port, c.Capture.DataPath, c.Capture.Duration)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+		want          []string
+	}{
+		{"unknown key", "collectors:\n  qps: false\n", []string{"field qps not found"}},
+		{"wrong type", "capture:\n  duration: soon\n", []string{"parse config file"}},
+		{"port", "http:\n  port: \"70000\"\n", []string{"http.port:"}},
+		{"port name", "http:\n  port: http\n", []string{"http.port:"}},
+		{"mrrs", "collectors:\n  mrrs:\n    value: 6\n", []string{"collectors.mrrs.value:"}},
+		{"label", "labels:\n  1cluster: a\n", []string{"labels:"}},
+		{"data path", "capture:\n  data_path: \"\"\n", []string{"capture.data_path:"}},
+		{"duration", "capture:\n  duration: 0s\n", []string{"capture.duration:"}},
+		{"interval", "capture:\n  interval: 500us\n", []string{"capture.interval:"}},
+		{"archive threshold", "capture:\n  archive_threshold_mb: -1\n", []string{"capture.archive_threshold_mb:"}},
+		{"archive keep", "capture:\n  archive_keep: 0\n", []string{"capture.archive_keep:"}},
+		{"monitor", "monitor:\n  interval: 10ms\n", []string{"monitor.interval:"}},
+		{"filter", "filters:\n  device_include: \"mlx5_(\"\n", []string{"filters:"}},
+		// every problem at once
+		{"several", "http:\n  port: \"0\"\ncapture:\n  duration: 0s\n  archive_keep: 0\n",
+			[]string{"http.port:", "capture.duration:", "capture.archive_keep:"}},
+	} {
+		_, err := BuildConfig(writeTestConfig(t, tc.content), testConfigFlags())
+		if err == nil {
+			t.Errorf("%s: accepted", tc.name)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't mention %q", tc.name, err, want)
+			}
+		}
+	}
+}
+
+// useConfigFile makes the config of content active, as at startup.
+func useConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := writeTestConfig(t, content)
+	c, err := BuildConfig(path, testConfigFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := cfg()
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := useConfigFile(t, `
+http:
+  port: "9400"
+helper:
+  socket: /run/ib-exporter/helper.sock
+paths:
+  infiniband: /sys/class/infiniband
+  sysfs: /sys
+collectors:
+  qp: true
+labels:
+  cluster: a
+`)
+	if err := os.WriteFile(path, []byte(`
+http:
+  port: "9401"
+helper:
+  socket: /tmp/helper.sock
+paths:
+  infiniband: /host/sys/class/infiniband
+  sysfs: /host/sys
+collectors:
+  qp: false
+labels:
+  cluster: b
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path, testConfigFlags()); err != nil {
+		t.Fatal(err)
+	}
+	c := cfg()
+	// bound at startup
+	if c.HTTP.Port != "9400" {
+		t.Errorf("reload changed the port to %s", c.HTTP.Port)
+	}
+	if c.Helper.Socket != "/run/ib-exporter/helper.sock" {
+		t.Errorf("reload changed the helper socket to %s", c.Helper.Socket)
+	}
+	if c.Paths.InfiniBand != "/sys/class/infiniband" || c.Paths.Sysfs != "/sys" {
+		t.Errorf("reload changed the paths to %+v", c.Paths)
+	}
+	// applied
+	if c.Collectors.QP || c.Labels["cluster"] != "b" {
+		t.Errorf("reload didn't apply the collectors and labels: %+v", c)
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	path := useConfigFile(t, "labels:\n  cluster: a\n")
+	previous := cfg()
+	if err := os.WriteFile(path, []byte("labels:\n  cluster: b\ncapture:\n  duration: 0s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path, testConfigFlags()); err == nil {
+		t.Fatal("invalid config reloaded")
+	}
+	if cfg() != previous {
+		t.Errorf("invalid config replaced the active one: labels %v", cfg().Labels)
+	}
+}
+
+// The shipped config shows the defaults, but for the data path of the
+// DaemonSet's volume.
+func TestShippedConfig(t *testing.T) {
+	c, err := LoadConfig("../deployment/ib-exporter-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Capture.DataPath = defaultConfig().Capture.DataPath
+	shipped, _ := yaml.Marshal(c)
+	defaults, _ := yaml.Marshal(defaultConfig())
+	if string(shipped) != string(defaults) {
+		t.Errorf("shipped config differs from the defaults:\n%s\ndefaults:\n%s", shipped, defaults)
+	}
+}
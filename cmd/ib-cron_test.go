@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func cronBits(values ...int) uint64 {
+	var bits uint64
+	for _, v := range values {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func cronRange(lo, hi int) uint64 {
+	var bits uint64
+	for v := lo; v <= hi; v++ {
+		bits |= 1 << uint(v)
+	}
+	return bits
+}
+
+func TestParseCronField(t *testing.T) {
+	for _, tc := range []struct {
+		field    string
+		min, max int
+		want     uint64
+	}{
+		{"*", 0, 59, cronRange(0, 59)},
+		{"5", 0, 59, cronBits(5)},
+		{"8-18", 0, 23, cronRange(8, 18)},
+		{"*/15", 0, 59, cronBits(0, 15, 30, 45)},
+		{"10/20", 0, 59, cronBits(10, 30, 50)},
+		{"1-10/3", 1, 31, cronBits(1, 4, 7, 10)},
+		{"1,3,5-6", 0, 7, cronBits(1, 3, 5, 6)},
+		{"0-59/30,7", 0, 59, cronBits(0, 7, 30)},
+	} {
+		got, err := parseCronField(tc.field, tc.min, tc.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tc.field, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseCronField(%q) = %b, want %b", tc.field, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	for _, tc := range []struct {
+		field    string
+		min, max int
+	}{
+		{"60", 0, 59},
+		{"0", 1, 31},
+		{"5-1", 0, 59},
+		{"*/0", 0, 59},
+		{"*/x", 0, 59},
+		{"a", 0, 59},
+		{"1-b", 0, 59},
+		{"", 0, 59},
+		{"1,,2", 0, 59},
+		{"13", 1, 12},
+	} {
+		if got, err := parseCronField(tc.field, tc.min, tc.max); err == nil {
+			t.Errorf("parseCronField(%q) = %b, want an error", tc.field, got)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want cronSchedule
+	}{
+		{"*/15 8-18 * * 1-5", cronSchedule{
+			minute: cronBits(0, 15, 30, 45), hour: cronRange(8, 18), dom: cronRange(1, 31),
+			month: cronRange(1, 12), dow: cronRange(1, 5), domAny: true,
+		}},
+		// 7 is Sunday as well as 0
+		{"0 0 * * 7", cronSchedule{
+			minute: cronBits(0), hour: cronBits(0), dom: cronRange(1, 31),
+			month: cronRange(1, 12), dow: cronBits(0, 7), domAny: true,
+		}},
+		{"0 0 1 * 1", cronSchedule{
+			minute: cronBits(0), hour: cronBits(0), dom: cronBits(1),
+			month: cronRange(1, 12), dow: cronBits(1),
+		}},
+		{" @monthly ", cronSchedule{
+			minute: cronBits(0), hour: cronBits(0), dom: cronBits(1),
+			month: cronRange(1, 12), dow: cronRange(0, 7), dowAny: true,
+		}},
+		{"@hourly", cronSchedule{
+			minute: cronBits(0), hour: cronRange(0, 23), dom: cronRange(1, 31),
+			month: cronRange(1, 12), dow: cronRange(0, 7), domAny: true, dowAny: true,
+		}},
+	} {
+		got, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.expr, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseCron(%q) = %+v, want %+v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+// nextCronFire is the first minute after after that s fires in, the way
+// runCaptureScheduler checks them.
+func nextCronFire(s cronSchedule, after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func TestCronNextFire(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		expr  string
+		after time.Time
+		want  time.Time
+	}{
+		{"*/15 * * * *", at(2026, 10, 18, 10, 7), at(2026, 10, 18, 10, 15)},
+		// a schedule doesn't fire again in the minute it just fired in
+		{"*/15 * * * *", at(2026, 10, 18, 10, 15), at(2026, 10, 18, 10, 30)},
+		{"*/15 * * * *", at(2026, 10, 18, 23, 50), at(2026, 10, 19, 0, 0)},
+		// Sunday noon to Monday morning
+		{"0 9 * * 1-5", at(2026, 10, 18, 12, 0), at(2026, 10, 19, 9, 0)},
+		{"0 9 * * 1-5", at(2026, 10, 23, 9, 0), at(2026, 10, 26, 9, 0)},
+		{"30 2 * * 7", at(2026, 10, 24, 0, 0), at(2026, 10, 25, 2, 30)},
+		{"30 2 * * 0", at(2026, 10, 24, 0, 0), at(2026, 10, 25, 2, 30)},
+		{"@monthly", at(2026, 10, 18, 0, 0), at(2026, 11, 1, 0, 0)},
+		{"@daily", at(2026, 12, 31, 23, 59), at(2027, 1, 1, 0, 0)},
+		{"0 12 31 * *", at(2026, 11, 1, 0, 0), at(2026, 12, 31, 12, 0)},
+		{"0 0 29 2 *", at(2026, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		{"0 8-18/5 * * *", at(2026, 10, 18, 13, 0), at(2026, 10, 18, 18, 0)},
+		// both day fields restricted: the 1st or a Monday, whichever is
+		// first; November 1st 2026 is a Sunday
+		{"0 0 1 * 1", at(2026, 10, 28, 0, 0), at(2026, 11, 1, 0, 0)},
+		{"0 0 1 * 1", at(2026, 11, 1, 0, 0), at(2026, 11, 2, 0, 0)},
+		{"0 0 13 * 5", at(2026, 10, 18, 0, 0), at(2026, 10, 23, 0, 0)},
+		// only one restricted: that one alone
+		{"0 0 1 * *", at(2026, 10, 28, 0, 0), at(2026, 11, 1, 0, 0)},
+		{"0 0 * * 1", at(2026, 10, 28, 0, 0), at(2026, 11, 2, 0, 0)},
+		{"0 0 1 * *", at(2026, 11, 1, 0, 0), at(2026, 12, 1, 0, 0)},
+	} {
+		s, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.expr, err)
+			continue
+		}
+		if got := nextCronFire(s, tc.after); !got.Equal(tc.want) {
+			t.Errorf("%q after %s fires at %s, want %s", tc.expr, tc.after.Format(time.DateTime), got.Format(time.DateTime), tc.want.Format(time.DateTime))
+		}
+	}
+}
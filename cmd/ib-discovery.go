@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	functionPF = "pf"
+	functionVF = "vf"
+)
+
+// IBDevice describes a discovered RDMA device and the PCI function behind it.
+type IBDevice struct {
+	Name      string `json:"name"`
+	NodeGUID  string `json:"node_guid"`
+	NetDev    string `json:"net_dev"`
+	Driver    string `json:"driver"`
+	PCIVendor string `json:"pci_vendor"`
+	PCIDevice string `json:"pci_device"`
+	BDF       string `json:"bdf"`
+	Function  string `json:"function"`
+	ParentPF  string `json:"parent_pf"`
+}
+
+// DeviceFilter selects which devices are exported. An empty include pattern
+// matches everything, an empty exclude pattern matches nothing. The PCI
+// patterns are matched against "vendor:device", e.g. "15b3:101d".
+type DeviceFilter struct {
+	DeviceInclude *regexp.Regexp
+	DeviceExclude *regexp.Regexp
+	NetDevInclude *regexp.Regexp
+	NetDevExclude *regexp.Regexp
+	DriverInclude *regexp.Regexp
+	DriverExclude *regexp.Regexp
+	PCIInclude    *regexp.Regexp
+	PCIExclude    *regexp.Regexp
+	ExportVFs     bool
+}
+
+func NewDeviceFilter(opts FiltersConfig) (DeviceFilter, error) {
+	filter := DeviceFilter{ExportVFs: opts.ExportVFs}
+	patterns := []struct {
+		name string
+		expr string
+		dst  **regexp.Regexp
+	}{
+		{"device include", opts.DeviceInclude, &filter.DeviceInclude},
+		{"device exclude", opts.DeviceExclude, &filter.DeviceExclude},
+		{"netdev include", opts.NetDevInclude, &filter.NetDevInclude},
+		{"netdev exclude", opts.NetDevExclude, &filter.NetDevExclude},
+		{"driver include", opts.DriverInclude, &filter.DriverInclude},
+		{"driver exclude", opts.DriverExclude, &filter.DriverExclude},
+		{"pci include", opts.PCIInclude, &filter.PCIInclude},
+		{"pci exclude", opts.PCIExclude, &filter.PCIExclude},
+	}
+	for _, p := range patterns {
+		if p.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.expr)
+		if err != nil {
+			return DeviceFilter{}, fmt.Errorf("invalid %s pattern %q: %w", p.name, p.expr, err)
+		}
+		*p.dst = re
+	}
+	return filter, nil
+}
+
+func matchInclude(re *regexp.Regexp, s string) bool {
+	return re == nil || re.MatchString(s)
+}
+
+func matchExclude(re *regexp.Regexp, s string) bool {
+	return re != nil && re.MatchString(s)
+}
+
+// Match reports whether the device passes the filter, and why not if it doesn't.
+func (f DeviceFilter) Match(dev IBDevice) (bool, string) {
+	pciID := dev.PCIVendor + ":" + dev.PCIDevice
+	switch {
+	case !matchInclude(f.DeviceInclude, dev.Name) || matchExclude(f.DeviceExclude, dev.Name):
+		return false, "device name"
+	case !matchInclude(f.NetDevInclude, dev.NetDev) || matchExclude(f.NetDevExclude, dev.NetDev):
+		return false, "netdev name"
+	case !matchInclude(f.DriverInclude, dev.Driver) || matchExclude(f.DriverExclude, dev.Driver):
+		return false, "driver"
+	case !matchInclude(f.PCIInclude, pciID) || matchExclude(f.PCIExclude, pciID):
+		return false, "pci id"
+	case dev.Function == functionVF && !f.ExportVFs:
+		return false, "virtual function"
+	}
+	return true, ""
+}
+
+func readSysfsString(p string) string {
+	contents, err := os.ReadFile(p)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+func getNetDev(IBDev string) string {
+	entries, err := os.ReadDir(path.Join(IBSYSPATH, IBDev, "device/net/"))
+	if err != nil {
+		return ""
+	}
+	// just one net device is expected
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Type()&os.ModeSymlink != 0 {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+// getDeviceFunction classifies the PCI function behind an IB device using the
+// SR-IOV links: a VF has a "physfn" link back to its PF. For a VF the name of
+// the IB device on the parent PF is returned as well.
+func getDeviceFunction(IBDev string) (string, string) {
+	physfn := path.Join(IBSYSPATH, IBDev, "device", "physfn")
+	if _, err := os.Stat(physfn); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Could not check device type for %s due to an error: %v. Assuming it's a physical function.", IBDev, err)
+		}
+		return functionPF, ""
+	}
+
+	parentPF := ""
+	if entries, err := os.ReadDir(path.Join(physfn, "infiniband")); err == nil && len(entries) > 0 {
+		parentPF = entries[0].Name()
+	} else if target, err := filepath.EvalSymlinks(physfn); err == nil {
+		// fall back to the PF's BDF when it has no IB device of its own
+		parentPF = filepath.Base(target)
+	}
+	return functionVF, parentPF
+}
+
+func describeIBDevice(IBDev string) IBDevice {
+	devicePath := path.Join(IBSYSPATH, IBDev, "device")
+	dev := IBDevice{
+		Name:      IBDev,
+		NodeGUID:  readSysfsString(path.Join(IBSYSPATH, IBDev, "node_guid")),
+		NetDev:    getNetDev(IBDev),
+		PCIVendor: strings.TrimPrefix(readSysfsString(path.Join(devicePath, "vendor")), "0x"),
+		PCIDevice: strings.TrimPrefix(readSysfsString(path.Join(devicePath, "device")), "0x"),
+		BDF:       GetIBDevBDF(IBDev),
+	}
+	if driver, err := filepath.EvalSymlinks(path.Join(devicePath, "driver")); err == nil {
+		dev.Driver = filepath.Base(driver)
+	}
+	dev.Function, dev.ParentPF = getDeviceFunction(IBDev)
+	return dev
+}
+
+// DiscoverIBDevices returns the active devices that pass the configured
+// filter. The inventory tracks every device that passes it, whatever the
+// state of its port, so a link flap doesn't drop the device's series;
+// ib_port_active tells whether a port is up.
+func DiscoverIBDevices() []IBDevice {
+	if throughHelper.Load() {
+		log.Printf("Device discovery: %v", errThroughHelper)
+		return nil
+	}
+	allIBDev, err := listFiles(IBSYSPATH)
+	if err != nil {
+		log.Fatal("Fail to get all IB Dev", err)
+		return nil
+	}
+
+	var devices, active []IBDevice
+	for _, ibDev := range allIBDev {
+		dev := describeIBDevice(ibDev)
+		if ok, reason := cfg().filter.Match(dev); !ok {
+			log.Printf("Skip IBDev:%s, filtered by %s", ibDev, reason)
+			continue
+		}
+		devices = append(devices, dev)
+		if isDevActive(ibDev) {
+			active = append(active, dev)
+		}
+	}
+
+	applyInventoryChanges(inventory.Update(devices))
+	return active
+}
+
+func lookupIBDevice(IBDev string) (IBDevice, bool) {
+	return inventory.Lookup(IBDev)
+}
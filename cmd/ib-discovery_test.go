@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// writeSysfs creates the files of a fake sysfs tree under root. A value
+// starting with "->" makes a symlink to the rest, relative to root.
+func writeSysfs(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if target, ok := strings.CutPrefix(content, "->"); ok {
+			err = os.Symlink(filepath.Join(root, target), p)
+		} else {
+			err = os.WriteFile(p, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// useIBSysPath points IBSYSPATH at dir for the test.
+func useIBSysPath(t *testing.T, dir string) {
+	previous := IBSYSPATH
+	IBSYSPATH = dir
+	t.Cleanup(func() { IBSYSPATH = previous })
+}
+
+// fakeDiscoverySysfs has a PF with two VFs, one of them on a PF without an
+// IB device of its own, and a PF of another vendor.
+func fakeDiscoverySysfs(t *testing.T) {
+	root := t.TempDir()
+	writeSysfs(t, root, map[string]string{
+		"devices/0000:3b:00.0/vendor":              "0x15b3\n",
+		"devices/0000:3b:00.0/device":              "0x101d\n",
+		"devices/0000:3b:00.0/uevent":              "DRIVER=mlx5_core\nPCI_SLOT_NAME=0000:3b:00.0\n",
+		"devices/0000:3b:00.0/driver":              "->drivers/mlx5_core",
+		"devices/0000:3b:00.0/infiniband/mlx5_0/x": "",
+		"devices/0000:3b:00.0/net/eth0/x":          "",
+		"devices/0000:3b:00.2/vendor":              "0x15b3\n",
+		"devices/0000:3b:00.2/device":              "0x101e\n",
+		"devices/0000:3b:00.2/uevent":              "PCI_SLOT_NAME=0000:3b:00.2\n",
+		"devices/0000:3b:00.2/driver":              "->drivers/mlx5_core",
+		"devices/0000:3b:00.2/physfn":              "->devices/0000:3b:00.0",
+		"devices/0000:3b:00.2/net/eth2/x":          "",
+		"devices/0000:5e:00.0/vendor":              "0x15b3\n",
+		"devices/0000:5e:00.3/vendor":              "0x15b3\n",
+		"devices/0000:5e:00.3/device":              "0x101e\n",
+		"devices/0000:5e:00.3/physfn":              "->devices/0000:5e:00.0",
+		"devices/0000:af:00.0/vendor":              "0x8086\n",
+		"devices/0000:af:00.0/device":              "0x1592\n",
+		"devices/0000:af:00.0/driver":              "->drivers/irdma",
+		"devices/0000:af:00.0/net/ens1/x":          "",
+		"drivers/mlx5_core/x":                      "",
+		"drivers/irdma/x":                          "",
+		"class/infiniband/mlx5_0/device":           "->devices/0000:3b:00.0",
+		"class/infiniband/mlx5_2/device":           "->devices/0000:3b:00.2",
+		"class/infiniband/mlx5_3/device":           "->devices/0000:5e:00.3",
+		"class/infiniband/irdma0/device":           "->devices/0000:af:00.0",
+		"class/infiniband/mezz0/x":                 "",
+	})
+	useIBSysPath(t, filepath.Join(root, "class/infiniband"))
+}
+
+func TestGetDeviceFunction(t *testing.T) {
+	fakeDiscoverySysfs(t)
+	for _, tc := range []struct {
+		dev, function, parent string
+	}{
+		{"mlx5_0", functionPF, ""},
+		{"mlx5_2", functionVF, "mlx5_0"},
+		// the PF has no IB device, its BDF stands in
+		{"mlx5_3", functionVF, "0000:5e:00.0"},
+		{"irdma0", functionPF, ""},
+		// no PCI device at all
+		{"mezz0", functionPF, ""},
+	} {
+		function, parent := getDeviceFunction(tc.dev)
+		if function != tc.function || parent != tc.parent {
+			t.Errorf("getDeviceFunction(%s) = %s, %q, want %s, %q", tc.dev, function, parent, tc.function, tc.parent)
+		}
+	}
+}
+
+func TestDescribeIBDevice(t *testing.T) {
+	fakeDiscoverySysfs(t)
+	got := describeIBDevice("mlx5_2")
+	want := IBDevice{
+		Name:      "mlx5_2",
+		NetDev:    "eth2",
+		Driver:    "mlx5_core",
+		PCIVendor: "15b3",
+		PCIDevice: "101e",
+		BDF:       "0000:3b:00.2",
+		Function:  functionVF,
+		ParentPF:  "mlx5_0",
+	}
+	if got != want {
+		t.Errorf("describeIBDevice(mlx5_2) = %+v, want %+v", got, want)
+	}
+}
+
+func TestDeviceFilter(t *testing.T) {
+	fakeDiscoverySysfs(t)
+	re := regexp.MustCompile
+	for _, tc := range []struct {
+		name   string
+		filter DeviceFilter
+		want   map[string]string
+	}{
+		{"everything", DeviceFilter{ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "", "irdma0": "", "mezz0": ""}},
+		{"no VFs", DeviceFilter{},
+			map[string]string{"mlx5_0": "", "mlx5_2": "virtual function", "mlx5_3": "virtual function", "irdma0": "", "mezz0": ""}},
+		{"device exclude", DeviceFilter{DeviceExclude: re(`mezz`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "", "irdma0": "", "mezz0": "device name"}},
+		{"device include", DeviceFilter{DeviceInclude: re(`^mlx5_[02]$`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "device name", "irdma0": "device name", "mezz0": "device name"}},
+		// devices without a netdev don't match a netdev include
+		{"netdev include", DeviceFilter{NetDevInclude: re(`^eth`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "netdev name", "irdma0": "netdev name", "mezz0": "netdev name"}},
+		{"netdev exclude", DeviceFilter{NetDevExclude: re(`^ens`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "", "irdma0": "netdev name", "mezz0": ""}},
+		{"driver", DeviceFilter{DriverInclude: re(`^mlx5`), DriverExclude: re(`irdma`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "driver", "irdma0": "driver", "mezz0": "driver"}},
+		{"pci include", DeviceFilter{PCIInclude: re(`^15b3:`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "", "mlx5_3": "", "irdma0": "pci id", "mezz0": "pci id"}},
+		{"pci exclude", DeviceFilter{PCIExclude: re(`^15b3:101e$`), ExportVFs: true},
+			map[string]string{"mlx5_0": "", "mlx5_2": "pci id", "mlx5_3": "pci id", "irdma0": "", "mezz0": ""}},
+		// the first failing check is the reason
+		{"several", DeviceFilter{DeviceExclude: re(`_2$`), PCIExclude: re(`101e`)},
+			map[string]string{"mlx5_0": "", "mlx5_2": "device name", "mlx5_3": "pci id", "irdma0": "", "mezz0": ""}},
+	} {
+		for dev, reason := range tc.want {
+			ok, got := tc.filter.Match(describeIBDevice(dev))
+			if ok != (reason == "") || got != reason {
+				t.Errorf("%s: %s matches %v, %q, want %q", tc.name, dev, ok, got, reason)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// ethtoolStats reads the statistics of a net device with the SIOCETHTOOL
+// ioctl, what `ethtool -S` prints, without running it. The wanted names are
+// resolved to their indices once; a read is then a single ETHTOOL_GSTATS,
+// which needs no privileges.
+const (
+	siocEthtool      = 0x8946
+	ethtoolGStrings  = 0x1b
+	ethtoolGStats    = 0x1d
+	ethtoolGSSetInfo = 0x37
+	ethSSStats       = 1
+	ethGStringLen    = 32
+	ifNameSize       = 16
+)
+
+var errNoEthtoolStats = errors.New("no statistics selected")
+
+type ethtoolStats struct {
+	fd      int
+	ifname  string
+	count   int
+	indices []int
+	names   []string
+	// struct ethtool_stats: cmd, n_stats, then a u64 per statistic
+	buf []byte
+}
+
+// ethtoolIoctl runs one ethtool command, data holds its struct.
+func ethtoolIoctl(fd int, ifname string, data []byte) error {
+	var ifr struct {
+		name [ifNameSize]byte
+		data unsafe.Pointer
+		_    [16]byte
+	}
+	copy(ifr.name[:ifNameSize-1], ifname)
+	ifr.data = unsafe.Pointer(&data[0])
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openEthtoolStats resolves the statistics of ifname that want selects,
+// errNoEthtoolStats when it selects none.
+func openEthtoolStats(ifname string, want func(name string) bool) (*ethtoolStats, error) {
+	if throughHelper.Load() {
+		return nil, errThroughHelper
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("ethtool %s: %w", ifname, err)
+	}
+	s := &ethtoolStats{fd: fd, ifname: ifname}
+	if err := s.resolve(want); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ethtoolStats) resolve(want func(name string) bool) error {
+	// struct ethtool_sset_info: cmd, reserved, sset_mask, then a u32 per set
+	info := make([]byte, 24)
+	binary.NativeEndian.PutUint32(info[0:], ethtoolGSSetInfo)
+	binary.NativeEndian.PutUint64(info[8:], 1<<ethSSStats)
+	if err := ethtoolIoctl(s.fd, s.ifname, info); err != nil {
+		return fmt.Errorf("ethtool %s: count statistics: %w", s.ifname, err)
+	}
+	if binary.NativeEndian.Uint64(info[8:])&(1<<ethSSStats) == 0 {
+		return fmt.Errorf("ethtool %s: %w", s.ifname, errNoEthtoolStats)
+	}
+	s.count = int(binary.NativeEndian.Uint32(info[16:]))
+	if s.count == 0 {
+		return fmt.Errorf("ethtool %s: %w", s.ifname, errNoEthtoolStats)
+	}
+
+	// struct ethtool_gstrings: cmd, string_set, len, then the names. The
+	// kernel writes as many as the driver has now, whatever len says, so
+	// leave room for the driver adding some, here and for the statistics.
+	room := 2*s.count + 64
+	strs := make([]byte, 12+room*ethGStringLen)
+	binary.NativeEndian.PutUint32(strs[0:], ethtoolGStrings)
+	binary.NativeEndian.PutUint32(strs[4:], ethSSStats)
+	binary.NativeEndian.PutUint32(strs[8:], uint32(s.count))
+	if err := ethtoolIoctl(s.fd, s.ifname, strs); err != nil {
+		return fmt.Errorf("ethtool %s: read statistic names: %w", s.ifname, err)
+	}
+	if n := int(binary.NativeEndian.Uint32(strs[8:])); n != s.count {
+		return fmt.Errorf("ethtool %s: %d statistic names instead of %d", s.ifname, n, s.count)
+	}
+	for i := 0; i < s.count; i++ {
+		name := strs[12+i*ethGStringLen : 12+(i+1)*ethGStringLen]
+		for j, c := range name {
+			if c == 0 {
+				name = name[:j]
+				break
+			}
+		}
+		if want(string(name)) {
+			s.indices = append(s.indices, i)
+			s.names = append(s.names, string(name))
+		}
+	}
+	if len(s.indices) == 0 {
+		return fmt.Errorf("ethtool %s: %w", s.ifname, errNoEthtoolStats)
+	}
+	s.buf = make([]byte, 8+8*room)
+	return nil
+}
+
+// read reads all statistics and passes the selected ones to fn.
+func (s *ethtoolStats) read(fn func(name string, value float64)) error {
+	binary.NativeEndian.PutUint32(s.buf[0:], ethtoolGStats)
+	binary.NativeEndian.PutUint32(s.buf[4:], uint32(s.count))
+	if err := ethtoolIoctl(s.fd, s.ifname, s.buf); err != nil {
+		return fmt.Errorf("ethtool %s: read statistics: %w", s.ifname, err)
+	}
+	// the driver can change its statistics, e.g. with the channel count
+	if n := int(binary.NativeEndian.Uint32(s.buf[4:])); n != s.count {
+		return fmt.Errorf("ethtool %s: %d statistics instead of %d", s.ifname, n, s.count)
+	}
+	for i, index := range s.indices {
+		fn(s.names[i], float64(binary.NativeEndian.Uint64(s.buf[8+8*index:])))
+	}
+	return nil
+}
+
+func (s *ethtoolStats) close() {
+	syscall.Close(s.fd)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	execModeDirect  = "direct"
+	execModeNsenter = "nsenter"
+	execModeChroot  = "chroot"
+)
+
+var (
+	execDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ib_exec_duration_seconds",
+			Help:    "Duration of host commands run by the exporter",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"binary"},
+	)
+	execFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_exec_failures_total",
+			Help: "Host commands that failed or timed out",
+		},
+		[]string{"binary"},
+	)
+
+	hostExecutor atomic.Pointer[Executor]
+)
+
+// Executor runs host tools (ethtool, rdma, setpci, mlxlink) in one of three
+// ways: directly, inside the host namespaces of PID 1 through nsenter, or
+// chrooted into a host root mounted in the container, e.g. "chroot:/host".
+type Executor struct {
+	mode     string
+	root     string
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+	sem      chan struct{}
+}
+
+// parseExecMode splits "chroot:/host" into its mode and root.
+func parseExecMode(mode string) (string, string, error) {
+	name, root, _ := strings.Cut(mode, ":")
+	switch name {
+	case execModeDirect, execModeNsenter:
+		if root != "" {
+			return "", "", fmt.Errorf("mode %q takes no argument", name)
+		}
+	case execModeChroot:
+		if !filepath.IsAbs(root) {
+			return "", "", fmt.Errorf("chroot mode needs an absolute root, e.g. chroot:/host")
+		}
+	default:
+		return "", "", fmt.Errorf("unknown mode %q, expected direct, nsenter or chroot:<root>", mode)
+	}
+	return name, root, nil
+}
+
+func NewExecutor(c ExecConfig) (*Executor, error) {
+	mode, root, err := parseExecMode(c.Mode)
+	if err != nil {
+		return nil, err
+	}
+	return &Executor{
+		mode:     mode,
+		root:     root,
+		timeout:  c.Timeout,
+		timeouts: c.Timeouts,
+		sem:      make(chan struct{}, c.MaxConcurrent),
+	}, nil
+}
+
+func hostExec() *Executor {
+	return hostExecutor.Load()
+}
+
+func (e *Executor) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	switch e.mode {
+	case execModeNsenter:
+		nsenterArgs := append([]string{"-t", "1", "-m", "-u", "-n", "-i", "-p", "--", name}, args...)
+		return exec.CommandContext(ctx, "nsenter", nsenterArgs...)
+	case execModeChroot:
+		return exec.CommandContext(ctx, "chroot", append([]string{e.root, name}, args...)...)
+	}
+	return exec.CommandContext(ctx, name, args...)
+}
+
+func (e *Executor) timeoutFor(name string) time.Duration {
+	if t, ok := e.timeouts[name]; ok {
+		return t
+	}
+	return e.timeout
+}
+
+// run executes the command once a concurrency slot is free. Only the time
+// spent running is observed, not the wait for a slot.
+func (e *Executor) run(ctx context.Context, combined bool, name string, args ...string) ([]byte, error) {
+	select {
+	case e.sem <- struct{}{}:
+		defer func() { <-e.sem }()
+	case <-ctx.Done():
+		execFailuresCounter.WithLabelValues(name).Inc()
+		return nil, fmt.Errorf("waiting to run %s: %w", name, ctx.Err())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeoutFor(name))
+	defer cancel()
+
+	cmd := e.command(ctx, name, args...)
+	start := time.Now()
+	var output []byte
+	var err error
+	if combined {
+		output, err = cmd.CombinedOutput()
+	} else {
+		output, err = cmd.Output()
+	}
+	execDurationHistogram.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		execFailuresCounter.WithLabelValues(name).Inc()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return output, fmt.Errorf("%s timed out after %s: %w", name, e.timeoutFor(name), err)
+		}
+	}
+	return output, err
+}
+
+// Output runs the command and returns its standard output.
+func (e *Executor) Output(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return e.run(ctx, false, name, args...)
+}
+
+// CombinedOutput runs the command and returns its standard output and error.
+func (e *Executor) CombinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return e.run(ctx, true, name, args...)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// captureExporter converts captures, one after the other, into one output.
+type captureExporter interface {
+	Export(r tickReader, meta *CaptureInfo) error
+	Close() error
+}
+
+// exportFormats are the formats "ib-exporter export" converts captures to.
+// labels are the -label flags.
+var exportFormats = map[string]func(w io.Writer, labels map[string]string) captureExporter{
+	"csv":         newCSVExporter,
+	"openmetrics": newOpenMetricsExporter,
+}
+
+// labelFlags collects repeated -label name=value flags.
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || !labelNameRegex.MatchString(name) {
+		return fmt.Errorf("%q is not name=value with a valid label name", s)
+	}
+	l[name] = value
+	return nil
+}
+
+// runExport implements "ib-exporter export <format> [-o file] [-label
+// name=value]... <capture|archive>...".
+func runExport(args []string) error {
+	if len(args) == 0 || exportFormats[args[0]] == nil {
+		return errors.New("usage: ib-exporter export csv|openmetrics [-o file] [-label name=value]... <capture|archive>...")
+	}
+	newExporter := exportFormats[args[0]]
+	fs := flag.NewFlagSet("export "+args[0], flag.ContinueOnError)
+	output := fs.String("o", "-", "Output file, - for stdout")
+	labels := labelFlags{}
+	fs.Var(labels, "label", "Label added to every series as name=value, repeatable (openmetrics)")
+	files, err := parseCommandFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no capture files given, use - for stdin")
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+	exporter := newExporter(w, labels)
+	for _, path := range files {
+		if err := forEachCapture(path, func(_ string, r tickReader, meta *CaptureInfo) error {
+			return exporter.Export(r, meta)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
+
+// csvExporter writes captures in the -runonce format.
+type csvExporter struct {
+	w io.Writer
+}
+
+func newCSVExporter(w io.Writer, _ map[string]string) captureExporter {
+	return csvExporter{w: w}
+}
+
+func (e csvExporter) Export(r tickReader, _ *CaptureInfo) error {
+	for {
+		tick, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		counters := make([]IBCounter, len(tick.Values))
+		for i, v := range tick.Values {
+			counters[i] = IBCounter{
+				IBDev:        v.IBDev,
+				NetDev:       v.NetDev,
+				DevLinkType:  v.LinkType,
+				CounterName:  v.Counter,
+				CounterValue: v.Value,
+			}
+		}
+		if err := writeCaptureSample(e.w, tick.Time, counters); err != nil {
+			return err
+		}
+	}
+}
+
+func (e csvExporter) Close() error {
+	return nil
+}
+
+// openMetricsExporter writes captures as node_ib_counters samples with the
+// labels the daemon exports, for "promtool tsdb create-blocks-from
+// openmetrics". Samples are written tick by tick, so the series of one
+// family are interleaved, which promtool accepts.
+type openMetricsExporter struct {
+	w      io.Writer
+	labels map[string]string
+	header bool
+	// last timestamp per series in milliseconds, promtool fails on samples
+	// that don't move forward
+	last map[string]int64
+}
+
+func newOpenMetricsExporter(w io.Writer, labels map[string]string) captureExporter {
+	return &openMetricsExporter{w: w, labels: labels, last: map[string]int64{}}
+}
+
+// escapeLabelValue escapes a label value for the text exposition formats.
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// seriesLabels renders the label set of a series, sorted by name. Empty
+// values are left out as Prometheus drops them on scrape too.
+func (e *openMetricsExporter) seriesLabels(counter, IBDev string, functions map[string]DeviceIdentity) string {
+	function, parentPF := functionPF, ""
+	if id, ok := functions[IBDev]; ok && id.Function != "" {
+		function, parentPF = id.Function, id.ParentPF
+	}
+	labels := map[string]string{
+		"metricsName": counter,
+		"IBDev":       IBDev,
+		"function":    function,
+		"parent_pf":   parentPF,
+	}
+	// the series' own labels win over -label, as in labeledGatherer
+	for name, value := range e.labels {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+	names := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, escapeLabelValue(labels[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (e *openMetricsExporter) Export(r tickReader, meta *CaptureInfo) error {
+	if !e.header {
+		fmt.Fprintf(e.w, "# HELP node_ib_counters collected node ib counter\n# TYPE node_ib_counters gauge\n")
+		e.header = true
+	}
+	// function and parent_pf come from the identities in the capture's
+	// metadata, devices without one are taken to be PFs like in updateMetrics
+	functions := map[string]DeviceIdentity{}
+	if meta != nil {
+		for _, id := range meta.Identities {
+			functions[id.Device] = id
+		}
+	}
+	series := map[string]string{}
+	for {
+		tick, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// OpenMetrics timestamps are seconds, Prometheus keeps milliseconds
+		ms := tick.Time.UnixMilli()
+		ts := fmt.Sprintf("%d.%03d", ms/1000, ms%1000)
+		for _, v := range tick.Values {
+			key := v.IBDev + "\x00" + v.Counter
+			labels, ok := series[key]
+			if !ok {
+				labels = e.seriesLabels(v.Counter, v.IBDev, functions)
+				series[key] = labels
+			}
+			if last, ok := e.last[labels]; ok && ms <= last {
+				return fmt.Errorf("node_ib_counters%s at %s is not after %s, give the captures in time order",
+					labels, time.UnixMilli(ms).Format(time.RFC3339Nano), time.UnixMilli(last).Format(time.RFC3339Nano))
+			}
+			e.last[labels] = ms
+			if _, err := fmt.Fprintf(e.w, "node_ib_counters%s %s %s\n", labels, strconv.FormatFloat(v.Value, 'g', -1, 64), ts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (e *openMetricsExporter) Close() error {
+	_, err := io.WriteString(e.w, "# EOF\n")
+	return err
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -11,7 +11,6 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -24,6 +23,8 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/exporter-toolkit/web"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -35,7 +36,7 @@ var (
 			Name: "node_ib_counters",
 			Help: "collected node ib counter",
 		},
-		[]string{"metricsName", "IBDev"},
+		[]string{"metricsName", "IBDev", "function", "parent_pf"},
 	)
 )
 
@@ -43,7 +44,13 @@ func getIBDevCounter(IBDev []string) []IBCounter {
 	var ibCounters []IBCounter
 	var wg sync.WaitGroup
 	var mu sync.Mutex
-	counterTypes := []string{"counters", "hw_counters"}
+	var counterTypes []string
+	if cfg().Collectors.Counters {
+		counterTypes = append(counterTypes, "counters")
+	}
+	if cfg().Collectors.HWCounters {
+		counterTypes = append(counterTypes, "hw_counters")
+	}
 
 	wg.Add(len(counterTypes))
 	for _, counterType := range counterTypes {
@@ -65,8 +72,43 @@ func getIBDevCounter(IBDev []string) []IBCounter {
 
 func updateMetrics(counters []IBCounter) {
 	for _, counter := range counters {
-		ibcounterGauge.WithLabelValues(counter.CounterName, counter.IBDev).Set(float64(counter.CounterValue))
+		function, parentPF := functionPF, ""
+		if dev, ok := lookupIBDevice(counter.IBDev); ok {
+			function, parentPF = dev.Function, dev.ParentPF
+		}
+		ibcounterGauge.WithLabelValues(counter.CounterName, counter.IBDev, function, parentPF).Set(float64(counter.CounterValue))
+	}
+}
+
+// labeledGatherer adds the configured static labels to every gathered series.
+// Labels a series already carries take precedence.
+type labeledGatherer struct {
+	prometheus.Gatherer
+	labels map[string]string
+}
+
+func (g labeledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	if len(g.labels) == 0 {
+		return mfs, err
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			existing := make(map[string]bool, len(m.Label))
+			for _, lp := range m.Label {
+				existing[lp.GetName()] = true
+			}
+			for name, value := range g.labels {
+				if existing[name] {
+					continue
+				}
+				n, v := name, value
+				m.Label = append(m.Label, &dto.LabelPair{Name: &n, Value: &v})
+			}
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
 	}
+	return mfs, err
 }
 
 func GetIBDevBDF(mlxDev string) string {
@@ -93,9 +135,7 @@ func getMRNum(allIBDev []string) []IBCounter {
 	for _, IBDev := range allIBDev {
 		var counter IBCounter
 
-		cmd := exec.Command("rdma", "resource", "show", IBDev)
-
-		outputBytes, err := cmd.CombinedOutput()
+		outputBytes, err := hostExec().CombinedOutput(context.Background(), "rdma", "resource", "show", IBDev)
 		if err != nil {
 			return counters
 		}
@@ -150,7 +190,7 @@ func getQPNum(allIBDev []string) []IBCounter {
 		var counter IBCounter
 		var QPNum float64
 		bdf := GetIBDevBDF(IBDev)
-		qpPath := path.Join("/sys/kernel/debug/mlx5", bdf, "QPs")
+		qpPath := path.Join(DEBUGFSPATH, "mlx5", bdf, "QPs")
 		entries, err := os.ReadDir(qpPath)
 		if err != nil {
 			log.Printf("fail to read pat:%s, err:%v", qpPath, err)
@@ -182,6 +222,23 @@ func getQPNum(allIBDev []string) []IBCounter {
 	return counters
 }
 
+// unknownPortRates are the rate files whose content didn't parse, logged once.
+var unknownPortRates sync.Map
+
+// parsePortRate returns the speed in Mb/s of a port's sysfs rate, e.g.
+// "400 Gb/sec (4X NDR)" or "2.5 Gb/sec (1X SDR)".
+func parsePortRate(rate string) (float64, bool) {
+	fields := strings.Fields(rate)
+	if len(fields) < 2 || fields[1] != "Gb/sec" {
+		return 0, false
+	}
+	gbps, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || gbps <= 0 {
+		return 0, false
+	}
+	return gbps * 1000, true
+}
+
 func getPortSpeed(allIBDev []string) []IBCounter {
 	var counters []IBCounter
 	for i := range allIBDev {
@@ -204,12 +261,10 @@ func getPortSpeed(allIBDev []string) []IBCounter {
 		if err != nil {
 			log.Printf("Fail to read the file, path:%s", ratePath)
 		}
-		rate := string(rateByte)
-		if strings.Contains(rate, "200") {
-			counter.CounterValue = 200000
-		}
-		if strings.Contains(rate, "400") {
-			counter.CounterValue = 400000
+		if speed, ok := parsePortRate(string(rateByte)); ok {
+			counter.CounterValue = speed
+		} else if _, logged := unknownPortRates.LoadOrStore(ratePath, true); !logged {
+			log.Printf("Unknown port rate %q in %s, port speed is 0", strings.TrimSpace(string(rateByte)), ratePath)
 		}
 		log.Printf("ibDev:%11s, counterName:%35s:%f", counter.IBDev, counter.CounterName, counter.CounterValue)
 		counters = append(counters, counter)
@@ -217,15 +272,6 @@ func getPortSpeed(allIBDev []string) []IBCounter {
 	return counters
 }
 
-func execOnHost(ctx context.Context, name string, args ...string) ([]byte, error) {
-	// 构建完整的命令参数
-	nsenterArgs := []string{"-t", "1", "-m", "-u", "-n", "-i", "-p", "--", name}
-	nsenterArgs = append(nsenterArgs, args...)
-
-	cmd := exec.CommandContext(ctx, "nsenter", nsenterArgs...)
-	return cmd.Output()
-}
-
 func getPortOpticalInfo(allIBDev []string) []IBCounter {
 	var allCounters []IBCounter
 
@@ -233,10 +279,7 @@ func getPortOpticalInfo(allIBDev []string) []IBCounter {
 		if !isPhysicalIBDevice(device) {
 			continue
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-		defer cancel()
-
-		output, err := execOnHost(ctx, "mlxlink", "-d", device, "-m")
+		output, err := hostExec().Output(context.Background(), "mlxlink", "-d", device, "-m")
 		if err != nil {
 			fmt.Printf("Error executing mlxlink for device %s: %v\n", device, err)
 			continue
@@ -344,43 +387,23 @@ func GetRoceData(allIBDev []string) []IBCounter {
 			log.Printf("Expected one net interface for %s, found %d\n", allIBDev[i], len(entries))
 			os.Exit(1)
 		}
-		var fields map[string]bool
+		fields := map[string]bool{}
 		if strings.Contains(trimmedContent, "Ethernet") {
-			fields = map[string]bool{
-				"rx_prio0_bytes":          true,
-				"tx_prio0_bytes":          true,
-				"rx_prio0_discards":       true,
-				"rx_prio5_bytes":          true,
-				"tx_prio5_bytes":          true,
-				"rx_prio5_discards":       true,
-				"rx_prio0_pause":          true,
-				"rx_prio0_pause_duration": true,
-				"tx_prio0_pause":          true,
-				"tx_prio0_pause_duration": true,
-				"rx_prio5_pause":          true,
-				"rx_prio5_pause_duration": true,
-				"tx_prio5_pause":          true,
-				"tx_prio5_pause_duration": true,
+			for _, field := range cfg().Collectors.Ethtool.EthernetFields {
+				fields[field] = true
 			}
 		}
 		if strings.Contains(trimmedContent, "InfiniBand") {
-			fields = map[string]bool{
-				"rx_vport_rdma_unicast_bytes": true,
-				"tx_vport_rdma_unicast_bytes": true,
+			for _, field := range cfg().Collectors.Ethtool.InfiniBandFields {
+				fields[field] = true
 			}
 		}
-		cmd := exec.Command("ethtool", "-S", entries[0].Name())
-		if os.Getenv("CONTAINER") == "true" {
-			cmd = exec.Command("nsenter", "-t", "1", "-a", "ethtool", "-S", entries[0].Name())
-		}
-		stdout, err := cmd.StdoutPipe()
+		output, err := hostExec().Output(context.Background(), "ethtool", "-S", entries[0].Name())
 		if err != nil {
+			log.Printf("Fail to run ethtool for %s: %v", entries[0].Name(), err)
 			return nil
 		}
-		if err := cmd.Start(); err != nil {
-			return nil
-		}
-		scanner := bufio.NewScanner(stdout)
+		scanner := bufio.NewScanner(bytes.NewReader(output))
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 			parts := strings.SplitN(line, ":", 2)
@@ -406,9 +429,6 @@ func GetRoceData(allIBDev []string) []IBCounter {
 		if err := scanner.Err(); err != nil {
 			return nil
 		}
-
-		cmd.Wait()
-
 	}
 	return counters
 }
@@ -419,8 +439,8 @@ func ModifyPCIeMaxReadRequest(deviceAddr string, offset string, newHighNibble in
 	}
 
 	// Read current value
-	readCmd := exec.Command("setpci", "-s", deviceAddr, offset+".w")
-	output, err := readCmd.Output()
+	ctx := context.Background()
+	output, err := hostExec().Output(ctx, "setpci", "-s", deviceAddr, offset+".w")
 	if err != nil {
 		return fmt.Errorf("failed to read PCI register: %v", err)
 	}
@@ -445,15 +465,13 @@ func ModifyPCIeMaxReadRequest(deviceAddr string, offset string, newHighNibble in
 
 	// Write back the new value
 	writeValueStr := fmt.Sprintf("%04x", newValue)
-	writeCmd := exec.Command("setpci", "-s", deviceAddr, offset+".w="+writeValueStr)
-	err = writeCmd.Run()
+	_, err = hostExec().Output(ctx, "setpci", "-s", deviceAddr, offset+".w="+writeValueStr)
 	if err != nil {
 		return fmt.Errorf("failed to write PCI register: %v", err)
 	}
 
 	// Verify the write was successful
-	verifyCmd := exec.Command("setpci", "-s", deviceAddr, offset+".w")
-	verifyOutput, err := verifyCmd.Output()
+	verifyOutput, err := hostExec().Output(ctx, "setpci", "-s", deviceAddr, offset+".w")
 	if err != nil {
 		return fmt.Errorf("failed to verify write result: %v", err)
 	}
@@ -475,52 +493,115 @@ func ModifyPCIeMaxReadRequest(deviceAddr string, offset string, newHighNibble in
 func autoFixMrrs(ibDev []string) {
 	for _, dev := range ibDev {
 		BDF := GetIBDevBDF(dev)
-		ModifyPCIeMaxReadRequest(BDF, "68", 5)
+		ModifyPCIeMaxReadRequest(BDF, "68", cfg().Collectors.MRRS.Value)
 	}
 }
 
 func GetAllIBCounter() []IBCounter {
 	IBDevs := GetIBDev()
-	autoFixMrrs(IBDevs)
+	if len(IBDevs) == 0 {
+		return nil
+	}
+	if cfg().Collectors.MRRS.Enabled {
+		autoFixMrrs(IBDevs)
+	}
+	return collectIBCounters(IBDevs)
+}
 
+// collectIBCounters collects the counters of every enabled collector, without
+// touching the MRRS.
+func collectIBCounters(IBDevs []string) []IBCounter {
+	collectors := cfg().Collectors
 	ibCounters := getIBDevCounter(IBDevs)
 
-	QPNums := getQPNum(IBDevs)
-	ibCounters = append(ibCounters, QPNums...)
+	if collectors.QP {
+		QPNums := getQPNum(IBDevs)
+		ibCounters = append(ibCounters, QPNums...)
+	}
 
-	MRNums := getMRNum(IBDevs)
-	ibCounters = append(ibCounters, MRNums...)
+	if collectors.MR {
+		MRNums := getMRNum(IBDevs)
+		ibCounters = append(ibCounters, MRNums...)
+	}
 
-	roceData := GetRoceData(IBDevs)
-	ibCounters = append(ibCounters, roceData...)
+	if collectors.Ethtool.Enabled {
+		roceData := GetRoceData(IBDevs)
+		ibCounters = append(ibCounters, roceData...)
+	}
 
-	portUtil := getPortSpeed(IBDevs)
-	ibCounters = append(ibCounters, portUtil...)
+	if collectors.PortSpeed {
+		portUtil := getPortSpeed(IBDevs)
+		ibCounters = append(ibCounters, portUtil...)
+	}
 
-	// opticalInfo := getPortOpticalInfo(IBDevs)
-	// ibCounters = append(ibCounters, opticalInfo...)
+	if collectors.Optical {
+		opticalInfo := getPortOpticalInfo(IBDevs)
+		ibCounters = append(ibCounters, opticalInfo...)
+	}
 
 	return ibCounters
 }
 
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("=========> start to get ib counter in service<==========")
-	ibCounters := GetAllIBCounter()
-	updateMetrics(ibCounters)
-	h := promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{})
+	snap, err := takeSnapshot()
+	if err != nil {
+		log.Printf("Fail to take snapshot: %v", err)
+	}
+	gatherer := labeledGatherer{
+		Gatherer: prometheus.Gatherers{prometheus.DefaultGatherer, snapshotGatherer(snap)},
+		labels:   cfg().Labels,
+	}
+	h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
 }
 
+// commands are the subcommands of ib-exporter, run instead of the daemon
+// when named as the first argument.
+var commands = map[string]func(args []string) error{
+	"export":  runExport,
+	"analyze": runAnalyze,
+	"compare": runCompare,
+	"report":  runReport,
+}
+
+// parseCommandFlags parses the flags of a subcommand, which unlike the
+// daemon flags may also follow the file arguments, e.g.
+// "report data.log -o report.html". It returns the file arguments.
+func parseCommandFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return files, nil
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
 func main() {
-	port := flag.String("port", "9315", "port to run the server on")
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	logfile := flag.String("log", "/var/log/ib-exporter.log", "log file path")
 	termi := flag.Bool("termi", false, "Print log to terminal and file")
 	runonce := flag.Bool("runonce", false, "Run once and exit")
-	runDuration := flag.Int("t", 5, "The total time for the task to run")
-	archiveThresholdMB := flag.Int("r", 5, "The size threshold in MB for archiving the data folder")
-	dataPath := flag.String("datapath", "/var/log/ibtestdata", "Path for storing data files")
 	monitor := flag.Bool("monitor", false, "Monitor the IB devices and export metrics")
 	version := flag.Bool("version", false, "Version of the application")
+	helper := flag.Bool("helper", false, "Run as the privileged collection helper, serving snapshots on -helper.socket")
+	configFile := flag.String("config.file", "", "Path to the YAML configuration file, reloaded on SIGHUP")
+	configCheck := flag.Bool("config.check", false, "Validate the configuration file and exit")
+	configFlags := registerConfigFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *version {
@@ -528,6 +609,17 @@ func main() {
 		return
 	}
 
+	config, err := BuildConfig(*configFile, configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if *configCheck {
+		fmt.Println("configuration is valid")
+		return
+	}
+	applyConfig(config)
+
 	// for debugging, log to terminal and file
 	var logOutput io.Writer
 	if *termi {
@@ -549,6 +641,18 @@ func main() {
 	}
 	log.SetOutput(logOutput)
 
+	if *configFile != "" {
+		watchConfigReload(*configFile, configFlags)
+	}
+
+	if *helper {
+		socket := config.Helper.Socket
+		if socket == "" {
+			socket = defaultHelperSocket
+		}
+		log.Fatal(RunHelper(socket))
+	}
+
 	if *monitor {
 		p := tea.NewProgram(initialModel(), tea.WithAltScreen())
 		if _, err := p.Run(); err != nil {
@@ -557,147 +661,137 @@ func main() {
 		os.Exit(0)
 	}
 
+	if config.Helper.Socket != "" {
+		throughHelper.Store(true)
+	}
+
 	// just for hi-precision data collection and archiving interval:100ms
 	if *runonce {
-		testdataDir := *dataPath
+		testdataDir := config.Capture.DataPath
 		err := os.MkdirAll(testdataDir, 0755)
 		if err != nil {
 			log.Fatalf("Fatal: Could not create 'testdata' directory: %v", err)
 		}
 
 		log.Println("Checking data directory for potential archiving...")
-		thresholdBytes := int64(*archiveThresholdMB) * 1024 * 1024
-
-		archiveDir := filepath.Dir(testdataDir)
-		if err := manageDataArchives(testdataDir, archiveDir, thresholdBytes); err != nil {
+		if err := manageDataArchives(config.Capture); err != nil {
 			log.Fatalf("Fatal: Failed to manage data archives: %v", err)
 		}
+		// keep archiving while capturing, so long captures stay within the
+		// threshold
+		archiveCtx, stopArchiver := context.WithCancel(context.Background())
+		archiverDone := make(chan struct{}, 2)
+		go func() {
+			runArchiver(archiveCtx)
+			archiverDone <- struct{}{}
+		}()
+		go func() {
+			runUploader(archiveCtx)
+			archiverDone <- struct{}{}
+		}()
 
 		timestamp := time.Now().Format("20060102_150405")
-		dataFilename := fmt.Sprintf("data_%s.log", timestamp)
+		dataFilename := captureFileName(timestamp, config.Capture)
 		finalDataPath := filepath.Join(testdataDir, dataFilename)
-		dataFile, err := os.Create(finalDataPath)
+		info := CaptureInfo{
+			ID:         timestamp,
+			State:      captureStateDone,
+			Duration:   config.Capture.Duration.String(),
+			Interval:   config.Capture.Interval.String(),
+			StartedAt:  time.Now(),
+			File:       dataFilename,
+			Origin:     captureOriginRunonce,
+			Identities: captureIdentities(),
+			path:       finalDataPath,
+		}
+		spec := CaptureSpec{Duration: config.Capture.Duration, Interval: config.Capture.Interval, Sampler: config.Capture.Sampler}
+		if len(config.Capture.Groups) > 0 {
+			spec.setGroups(config.Capture.Groups, nil)
+		}
+		info.Interval = spec.Interval.String()
+		info.Sampler = spec.Sampler
+		info.Groups = captureGroupInfos(spec)
+		dataWriter, err := newSegmentedCaptureWriter(info, config.Capture)
 		if err != nil {
 			log.Fatalf("Fatal: Could not create data log file: %v", err)
 		}
-		defer dataFile.Close()
-
 		log.Printf("Run-once mode activated. Writing data to %s", finalDataPath)
 
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
-
-		done := make(chan bool)
-		go func() { time.Sleep(time.Duration(*runDuration) * time.Second); done <- true }()
-
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				ibCounters := GetAllIBCounter()
-				for _, counter := range ibCounters {
-					_, err := fmt.Fprintf(dataFile, "%d,%s,%s,%s,%s,%f\n",
-						time.Now().UnixNano(),
-						counter.IBDev,
-						counter.NetDev,
-						counter.DevLinkType,
-						counter.CounterName,
-						counter.CounterValue)
-					if err != nil {
-						log.Printf("Error writing to log file: %v", err)
-					}
-				}
+		var sampling []*CaptureSampling
+		info.Samples, sampling, err = runCapture(context.Background(), spec, dataWriter)
+		info.setSampling(sampling)
+		log.Printf("Took %d samples", info.Samples)
+		for i, s := range sampling {
+			name := "capture"
+			if g := spec.groups()[i]; g.Name != "" {
+				name = "group " + g.Name
 			}
+			log.Printf("Sampled the %s with the %s sampler: %d missed ticks, %d read errors, jitter p99 %s, read p99 %s",
+				name, s.Sampler, s.MissedTicks, s.ReadErrors, milliseconds(s.JitterSeconds.P99), milliseconds(s.ReadSeconds.P99))
 		}
-	}
-
-	prometheus.MustRegister(ibcounterGauge)
-
-	http.HandleFunc("/metrics", metricsHandler)
-	log.Printf("Starting server on :%s", *port)
-	log.Fatal(http.ListenAndServe(":"+*port, nil))
-}
-
-func manageDataArchives(dataDir, archiveDir string, thresholdBytes int64) error {
-	// 1. Calculate the total size of the data directory
-	var totalSize int64
-	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+		if closeErr := dataWriter.Close(); err == nil {
+			err = closeErr
 		}
-		if !info.IsDir() {
-			totalSize += info.Size()
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("could not calculate directory size: %w", err)
-	}
-
-	// 2. If size is below the threshold, do nothing.
-	if totalSize < thresholdBytes {
-		log.Printf("Data directory size (%d bytes) is under the %dMB threshold. No action needed.", totalSize, thresholdBytes)
-		return nil
-	}
-	log.Printf("Data directory size (%d bytes) exceeds %dMB threshold. Starting archival process.", totalSize, thresholdBytes)
-
-	// 3. Create a new timestamped archive file
-	timestamp := time.Now().Format("20060102_150405")
-	archiveName := fmt.Sprintf("ibtestdata_%s.zip", timestamp)
-	archivePath := filepath.Join(archiveDir, archiveName)
-	archiveFile, err := os.Create(archivePath)
-	if err != nil {
-		return fmt.Errorf("could not create archive file: %w", err)
-	}
-	defer archiveFile.Close()
-
-	zipWriter := zip.NewWriter(archiveFile)
-	defer zipWriter.Close()
-
-	// 4. Find all .log files and add them to the archive
-	filesToArchive, err := filepath.Glob(filepath.Join(dataDir, "*.log"))
-	if err != nil {
-		return fmt.Errorf("could not find log files to archive: %w", err)
-	}
-
-	for _, filePath := range filesToArchive {
-		log.Printf("Archiving %s", filepath.Base(filePath))
-		file, err := os.Open(filePath)
+		dataWriter.segment().apply(&info)
 		if err != nil {
-			continue
-		} // Skip files that can't be opened
-
-		zipEntry, err := zipWriter.Create(filepath.Base(filePath))
-		if err != nil {
-			file.Close()
-			continue
-		}
-
-		_, err = io.Copy(zipEntry, file)
-		file.Close() // Close file before deleting
-
-		if err == nil {
-			os.Remove(filePath) // Delete original file after successful archival
-		}
+			log.Printf("Error writing to log file: %v", err)
+			info.State, info.Error = captureStateFailed, err.Error()
+		}
+		finishedAt := time.Now()
+		info.FinishedAt = &finishedAt
+		if err := writeCaptureMetadata(info); err != nil {
+			log.Printf("Error writing capture metadata: %v", err)
+		}
+		// let an archive or upload in progress complete
+		stopArchiver()
+		<-archiverDone
+		<-archiverDone
+		return
 	}
-	log.Printf("Successfully created archive: %s", archiveName)
 
-	// 5. Rotate old archives, keeping the 5 most recent
-	allArchives, err := filepath.Glob(filepath.Join(archiveDir, "testdata_*.zip"))
-	if err != nil {
-		return fmt.Errorf("could not find archives for rotation: %w", err)
+	if config.Helper.Socket != "" {
+		log.Printf("Collecting through the helper at %s", config.Helper.Socket)
+		prometheus.MustRegister(helperUpGauge)
+	} else {
+		registerCollectors(prometheus.DefaultRegisterer)
 	}
+	prometheus.MustRegister(streamClientsGauge, streamDroppedCounter,
+		capturesStartedCounter, capturesSkippedCounter, captureTriggersCounter,
+		recorderSamplesGauge, recorderDumpsCounter, recorderDumpsSkippedCounter,
+		archivesCreatedCounter, archivesDeletedCounter, archiveFailuresCounter, archivesAwaitingUploadGauge,
+		captureMissedTicksCounter, captureJitterHistogram,
+		uploadsCounter, uploadFailuresCounter, uploadRetriesCounter, uploadBytesCounter, uploadLastSuccessGauge)
+
+	go runCaptureScheduler()
+	go runCaptureTriggers()
+	go recorder.run()
+	go runArchiver(context.Background())
+	go runUploader(context.Background())
+	watchRecorderSignal()
 
-	if len(allArchives) > 5 {
-		sort.Strings(allArchives) // Sorts alphabetically, which works for our timestamp format
-		archivesToDelete := allArchives[:len(allArchives)-5]
-		log.Printf("Found %d archives, cleaning up the oldest %d.", len(allArchives), len(archivesToDelete))
-		for _, oldArchive := range archivesToDelete {
-			log.Printf("Deleting old archive: %s", filepath.Base(oldArchive))
-			os.Remove(oldArchive)
-		}
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/gids", gidsHandler)
+	http.HandleFunc("/api/v1/devices", apiDevicesHandler)
+	http.HandleFunc("/api/v1/counters", apiCountersHandler)
+	http.HandleFunc("/api/v1/rates", apiRatesHandler)
+	http.HandleFunc("/api/v1/stream", apiStreamHandler)
+	http.HandleFunc("/api/v1/captures", apiCapturesHandler)
+	http.HandleFunc("/api/v1/captures/", apiCaptureHandler)
+	http.HandleFunc("/api/v1/recorder", apiRecorderHandler)
+	http.HandleFunc("/api/v1/recorder/dumps", apiRecorderDumpsHandler)
+	http.Handle("/ui/", uiHandler())
+	http.HandleFunc("/", rootHandler)
+	// TLS certificates and the web config file are re-read on every new
+	// connection, so they can be rotated without a restart
+	listenAddresses := []string{config.HTTP.listenAddress()}
+	systemdSocket := false
+	webConfigFile := config.HTTP.WebConfigFile
+	webFlags := &web.FlagConfig{
+		WebListenAddresses: &listenAddresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
 	}
-
-	return nil
+	logger := slog.New(slog.NewTextHandler(logOutput, nil))
+	log.Printf("Starting server on %s", config.HTTP.listenAddress())
+	log.Fatal(web.ListenAndServe(&http.Server{}, webFlags, logger))
 }
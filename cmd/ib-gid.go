@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const roceV2GIDType = "RoCE v2"
+
+var (
+	gidInfoGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_gid_info",
+			Help: "Populated GID table entry of a port, value is always 1",
+		},
+		[]string{"device", "port", "index", "gid", "type", "netdev", "vlan"},
+	)
+	roceV2GIDPresentGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_roce_v2_gid_present",
+			Help: "Whether a RoCE v2 GID exists for the primary IPv4 address of the netdev",
+		},
+		[]string{"device", "port", "netdev", "ip"},
+	)
+	roceV2GIDIndexGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_roce_v2_gid_index",
+			Help: "GID index of the RoCE v2 GID for the primary IPv4 address, -1 if missing",
+		},
+		[]string{"device", "port", "netdev", "ip"},
+	)
+	// a vector without labels, so that it can be dropped when the collector
+	// is turned off
+	roceV2GIDConsistentGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_roce_v2_gid_index_consistent",
+			Help: "Whether every RoCE NIC on the node has its primary IPv4 RoCE v2 GID at the same index",
+		},
+		nil,
+	)
+
+	gidMu       sync.Mutex
+	lastGIDInfo = map[string]prometheus.Labels{}
+)
+
+type GIDEntry struct {
+	Device string `json:"device"`
+	Port   string `json:"port"`
+	Index  int    `json:"index"`
+	GID    string `json:"gid"`
+	Type   string `json:"type"`
+	NetDev string `json:"netdev"`
+	VLAN   string `json:"vlan,omitempty"`
+}
+
+// RoceV2GIDCheck is the result of looking up the RoCE v2 GID of the primary
+// IPv4 address of a port's netdev. Index is -1 when the GID is missing.
+type RoceV2GIDCheck struct {
+	Device  string `json:"device"`
+	Port    string `json:"port"`
+	NetDev  string `json:"netdev"`
+	IP      string `json:"ip"`
+	Present bool   `json:"present"`
+	Index   int    `json:"index"`
+}
+
+type GIDReport struct {
+	GIDs       []GIDEntry       `json:"gids"`
+	Checks     []RoceV2GIDCheck `json:"roce_v2_checks"`
+	Consistent bool             `json:"roce_v2_index_consistent"`
+}
+
+// readVLANConfig maps VLAN netdev names to their VLAN ID using
+// /proc/net/vlan/config. A missing file means the 8021q module isn't loaded.
+func readVLANConfig() map[string]string {
+	vlans := map[string]string{}
+	f, err := os.Open(path.Join(PROCFSPATH, "net/vlan/config"))
+	if err != nil {
+		return vlans
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// eth0.100       | 100  | eth0
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSpace(fields[1])); err != nil {
+			continue
+		}
+		vlans[strings.TrimSpace(fields[0])] = strings.TrimSpace(fields[1])
+	}
+	return vlans
+}
+
+func readGIDTable(IBDev, port string, vlans map[string]string) []GIDEntry {
+	portPath := path.Join(IBSYSPATH, IBDev, "ports", port)
+	entries, err := os.ReadDir(path.Join(portPath, "gids"))
+	if err != nil {
+		return nil
+	}
+
+	var gids []GIDEntry
+	for _, entry := range entries {
+		index, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		gid := readSysfsString(path.Join(portPath, "gids", entry.Name()))
+		if gid == "" || isZeroGID(gid) {
+			continue
+		}
+		// unpopulated entries return EINVAL for their attributes
+		netDev := readSysfsString(path.Join(portPath, "gid_attrs/ndevs", entry.Name()))
+		gids = append(gids, GIDEntry{
+			Device: IBDev,
+			Port:   port,
+			Index:  index,
+			GID:    gid,
+			Type:   readSysfsString(path.Join(portPath, "gid_attrs/types", entry.Name())),
+			NetDev: netDev,
+			VLAN:   vlans[netDev],
+		})
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i].Index < gids[j].Index })
+	return gids
+}
+
+// primaryIPv4 returns the first IPv4 address configured on a netdev.
+func primaryIPv4(netDev string) net.IP {
+	iface, err := net.InterfaceByName(netDev)
+	if err != nil {
+		return nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
+}
+
+func checkRoceV2GID(dev IBDevice, port string, gids []GIDEntry) (RoceV2GIDCheck, bool) {
+	ip := primaryIPv4(dev.NetDev)
+	if ip == nil {
+		return RoceV2GIDCheck{}, false
+	}
+	check := RoceV2GIDCheck{Device: dev.Name, Port: port, NetDev: dev.NetDev, IP: ip.String(), Index: -1}
+	for _, g := range gids {
+		if g.Type != roceV2GIDType {
+			continue
+		}
+		if gidIP := net.ParseIP(g.GID); gidIP != nil && gidIP.Equal(ip) {
+			check.Present = true
+			check.Index = g.Index
+			break
+		}
+	}
+	return check, true
+}
+
+func CollectGIDReport(devs []IBDevice) GIDReport {
+	report := GIDReport{Consistent: true}
+	vlans := readVLANConfig()
+	index := -1
+	for _, dev := range devs {
+		for _, port := range listPorts(dev.Name) {
+			gids := readGIDTable(dev.Name, port, vlans)
+			report.GIDs = append(report.GIDs, gids...)
+
+			if readSysfsString(path.Join(IBSYSPATH, dev.Name, "ports", port, "link_layer")) != "Ethernet" {
+				continue
+			}
+			check, ok := checkRoceV2GID(dev, port, gids)
+			if !ok {
+				continue
+			}
+			report.Checks = append(report.Checks, check)
+			switch {
+			case !check.Present:
+				report.Consistent = false
+			case index == -1:
+				index = check.Index
+			case index != check.Index:
+				report.Consistent = false
+			}
+		}
+	}
+	return report
+}
+
+func updateGIDMetrics(devs []IBDevice) GIDReport {
+	report := CollectGIDReport(devs)
+
+	gidMu.Lock()
+	defer gidMu.Unlock()
+
+	current := make(map[string]prometheus.Labels, len(report.GIDs))
+	for _, g := range report.GIDs {
+		index := strconv.Itoa(g.Index)
+		current[g.Device+"/"+g.Port+"/"+index] = prometheus.Labels{
+			"device": g.Device,
+			"port":   g.Port,
+			"index":  index,
+			"gid":    g.GID,
+			"type":   g.Type,
+			"netdev": g.NetDev,
+			"vlan":   g.VLAN,
+		}
+	}
+	for key, labels := range lastGIDInfo {
+		if cur, ok := current[key]; !ok || !labelsEqual(cur, labels) {
+			gidInfoGauge.Delete(labels)
+		}
+	}
+	for _, labels := range current {
+		gidInfoGauge.With(labels).Set(1)
+	}
+	lastGIDInfo = current
+
+	roceV2GIDPresentGauge.Reset()
+	roceV2GIDIndexGauge.Reset()
+	for _, c := range report.Checks {
+		present := 0.0
+		if c.Present {
+			present = 1
+		}
+		roceV2GIDPresentGauge.WithLabelValues(c.Device, c.Port, c.NetDev, c.IP).Set(present)
+		roceV2GIDIndexGauge.WithLabelValues(c.Device, c.Port, c.NetDev, c.IP).Set(float64(c.Index))
+		if !c.Present {
+			log.Printf("IBDev:%s port:%s has no RoCE v2 GID for %s on %s", c.Device, c.Port, c.IP, c.NetDev)
+		}
+	}
+	if report.Consistent {
+		roceV2GIDConsistentGauge.WithLabelValues().Set(1)
+	} else {
+		roceV2GIDConsistentGauge.WithLabelValues().Set(0)
+	}
+	return report
+}
+
+// forgetGIDs drops the GID series of a device that left the inventory.
+func forgetGIDs(IBDev string) {
+	gidMu.Lock()
+	defer gidMu.Unlock()
+
+	gidInfoGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	roceV2GIDPresentGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	roceV2GIDIndexGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	for key := range lastGIDInfo {
+		if strings.HasPrefix(key, IBDev+"/") {
+			delete(lastGIDInfo, key)
+		}
+	}
+}
+
+func gidsHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := takeSnapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	report := snap.GIDs
+	if report == nil {
+		report = &GIDReport{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("fail to encode gid report: %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// The privileged helper does all collection (sysfs, debugfs, ethtool, rdma,
+// setpci) and answers requests on a Unix socket. The HTTP process connects to
+// it, never touches the hardware itself and can run without privileges:
+// there, device discovery refuses to run, so any local collection fails
+// closed instead of reading sysfs.
+//
+// One request per connection: the client writes a single JSON HelperRequest
+// line, the helper answers with a single JSON Snapshot and closes. The
+// "snapshot" method runs a full collection, "counters" only reads the sysfs
+// counters for the live stream, "capture_sample" returns every counter
+// without touching the exported metrics and "inventory" the devices and
+// their identities. "precise_sample" keeps the connection for a capture: the
+// helper opens a precise sampler and answers once it is ready, then with
+// the ticks of one sample for every line the client writes.
+const (
+	defaultHelperSocket   = "/run/ib-exporter/helper.sock"
+	helperProtocolVersion = 1
+	helperMethodSnapshot  = "snapshot"
+	helperMethodCounters  = "counters"
+	helperMethodCapture   = "capture_sample"
+	helperMethodInventory = "inventory"
+	helperMethodPrecise   = "precise_sample"
+	helperMaxRequestBytes = 4096
+	helperRequestTimeout  = 2 * time.Minute
+)
+
+var (
+	helperUpGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ib_helper_up",
+			Help: "Whether the last snapshot request to the privileged collection helper succeeded",
+		},
+	)
+
+	// collectMu serializes collection, concurrent scrapes would only run the
+	// same host commands twice
+	collectMu sync.Mutex
+
+	// throughHelper is set in a process that collects through the helper
+	throughHelper    atomic.Bool
+	errThroughHelper = errors.New("this process collects through the helper and doesn't read the hardware")
+)
+
+type HelperRequest struct {
+	Version int    `json:"version"`
+	Method  string `json:"method"`
+	// a snapshot for the API, which leaves the MRRS to the scrapes
+	SkipMRRS bool `json:"skip_mrrs,omitempty"`
+	// the devices and counters of a precise_sample session and its
+	// interval, in nanoseconds
+	Devices  []string      `json:"devices,omitempty"`
+	Counters []string      `json:"counters,omitempty"`
+	Exclude  []string      `json:"exclude,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// Snapshot is the result of one collection cycle.
+type Snapshot struct {
+	Version     int              `json:"version"`
+	Error       string           `json:"error,omitempty"`
+	CollectedAt time.Time        `json:"collected_at"`
+	Devices     []IBDevice       `json:"devices"`
+	Counters    []IBCounter      `json:"counters"`
+	Identities  []DeviceIdentity `json:"identities,omitempty"`
+	GIDs        *GIDReport       `json:"gids,omitempty"`
+	// "<device>/<port>" to port state, only set by the counters method
+	PortStates map[string]string `json:"port_states,omitempty"`
+	// device to port speed in Mb/s, only set by the counters method
+	PortSpeeds map[string]float64 `json:"port_speeds,omitempty"`
+	// Prometheus text exposition of the helper's collectors, only set when
+	// the snapshot crosses the socket
+	Metrics string `json:"metrics,omitempty"`
+	// one sample of a precise_sample session and the read errors of the
+	// session so far
+	Ticks      []SnapshotTick `json:"ticks,omitempty"`
+	ReadErrors int            `json:"read_errors,omitempty"`
+}
+
+// SnapshotTick is a captureTick crossing the socket.
+type SnapshotTick struct {
+	Device   string      `json:"device"`
+	At       time.Time   `json:"at"`
+	Counters []IBCounter `json:"counters"`
+}
+
+// registerCollectors registers every metric the collection side updates.
+func registerCollectors(reg prometheus.Registerer) {
+	reg.MustRegister(ibcounterGauge, inventoryChangesCounter, deviceInfoGauge, portInfoGauge, portActiveGauge, identityChangesCounter,
+		gidInfoGauge, roceV2GIDPresentGauge, roceV2GIDIndexGauge, roceV2GIDConsistentGauge,
+		numaNodeGauge, completionIRQRateGauge, irqRemoteAffinityGauge,
+		execDurationHistogram, execFailuresCounter)
+}
+
+// collectLocal runs one collection cycle in this process and updates the
+// collector metrics. Only the scrapes fix the MRRS, with fixMRRS.
+func collectLocal(fixMRRS bool) *Snapshot {
+	collectMu.Lock()
+	defer collectMu.Unlock()
+
+	snap := &Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now()}
+	if fixMRRS {
+		snap.Counters = GetAllIBCounter()
+	} else if IBDevs := GetIBDev(); len(IBDevs) > 0 {
+		snap.Counters = collectIBCounters(IBDevs)
+	}
+	updateMetrics(snap.Counters)
+	snap.Devices = inventory.Devices()
+
+	collectors := cfg().Collectors
+	if collectors.Identity {
+		snap.Identities = updateIdentityMetrics(snap.Devices)
+	}
+	if collectors.GID {
+		report := updateGIDMetrics(snap.Devices)
+		snap.GIDs = &report
+	}
+	if collectors.NUMA {
+		updateNUMAMetrics(snap.Devices)
+	}
+	return snap
+}
+
+// forgetDisabledCollectors drops the series of the collectors a reload
+// turned off, which would otherwise keep their last values forever. The
+// counters of the collectors that are still on come back with the next
+// collection.
+func forgetDisabledCollectors(old, cur CollectorsConfig) {
+	collectMu.Lock()
+	defer collectMu.Unlock()
+
+	if old.Counters && !cur.Counters || old.HWCounters && !cur.HWCounters ||
+		old.QP && !cur.QP || old.MR && !cur.MR || old.PortSpeed && !cur.PortSpeed ||
+		old.Optical && !cur.Optical || old.Ethtool.Enabled && !cur.Ethtool.Enabled ||
+		!slices.Equal(old.Ethtool.EthernetFields, cur.Ethtool.EthernetFields) ||
+		!slices.Equal(old.Ethtool.InfiniBandFields, cur.Ethtool.InfiniBandFields) {
+		ibcounterGauge.Reset()
+	}
+	for _, dev := range inventory.Names() {
+		if old.Identity && !cur.Identity {
+			forgetIdentity(dev)
+		}
+		if old.GID && !cur.GID {
+			forgetGIDs(dev)
+		}
+		if old.NUMA && !cur.NUMA {
+			forgetTopology(dev)
+		}
+	}
+	if old.GID && !cur.GID {
+		roceV2GIDConsistentGauge.Reset()
+	}
+}
+
+// takeSnapshot collects through the helper when one is configured and in
+// this process otherwise.
+func takeSnapshot() (*Snapshot, error) {
+	return collectSnapshot(true)
+}
+
+func collectSnapshot(fixMRRS bool) (*Snapshot, error) {
+	if socket := cfg().Helper.Socket; socket != "" {
+		snap, err := sendHelperRequest(socket, HelperRequest{Version: helperProtocolVersion, Method: helperMethodSnapshot, SkipMRRS: !fixMRRS})
+		if err != nil {
+			helperUpGauge.Set(0)
+			return nil, err
+		}
+		helperUpGauge.Set(1)
+		lastSnapshot.advance(snap)
+		return snap, nil
+	}
+	snap := collectLocal(fixMRRS)
+	lastSnapshot.advance(snap)
+	return snap, nil
+}
+
+func requestHelper(socket, method string) (*Snapshot, error) {
+	return sendHelperRequest(socket, HelperRequest{Version: helperProtocolVersion, Method: method})
+}
+
+func sendHelperRequest(socket string, req HelperRequest) (*Snapshot, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connect to helper: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(helperRequestTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("send request to helper: %w", err)
+	}
+	var snap Snapshot
+	if err := json.NewDecoder(conn).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("read snapshot from helper: %w", err)
+	}
+	if snap.Error != "" {
+		return nil, fmt.Errorf("helper: %s", snap.Error)
+	}
+	if snap.Version != helperProtocolVersion {
+		return nil, fmt.Errorf("helper speaks protocol version %d, want %d", snap.Version, helperProtocolVersion)
+	}
+	return &snap, nil
+}
+
+// snapshotGatherer serves the metric families the helper sent.
+func snapshotGatherer(snap *Snapshot) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if snap == nil || snap.Metrics == "" {
+			return nil, nil
+		}
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(strings.NewReader(snap.Metrics))
+		if err != nil {
+			return nil, fmt.Errorf("parse helper metrics: %w", err)
+		}
+		mfs := make([]*dto.MetricFamily, 0, len(families))
+		for _, mf := range families {
+			mfs = append(mfs, mf)
+		}
+		sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+		return mfs, nil
+	})
+}
+
+// RunHelper serves collection requests on the Unix socket until the listener fails.
+func RunHelper(socket string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return fmt.Errorf("create socket directory: %w", err)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket: %w", err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", socket, err)
+	}
+	defer listener.Close()
+	if err := os.Chmod(socket, 0660); err != nil {
+		return fmt.Errorf("chmod socket: %w", err)
+	}
+	if gid := cfg().Helper.SocketGID; gid >= 0 {
+		if err := os.Chown(socket, -1, gid); err != nil {
+			return fmt.Errorf("chown socket: %w", err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	registerCollectors(reg)
+
+	log.Printf("Collection helper listening on %s", socket)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("accept: %w", err)
+		}
+		go serveHelperConn(conn, reg)
+	}
+}
+
+func serveHelperConn(conn net.Conn, reg prometheus.Gatherer) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(helperRequestTimeout))
+
+	br := bufio.NewReaderSize(conn, helperMaxRequestBytes)
+	req, err := readHelperRequest(br)
+	if err == nil && req.Method == helperMethodPrecise {
+		servePreciseSession(conn, br, req)
+		return
+	}
+	var snap *Snapshot
+	if err == nil {
+		snap, err = handleHelperRequest(req, reg)
+	}
+	if err != nil {
+		log.Printf("Helper request rejected: %v", err)
+		snap = &Snapshot{Version: helperProtocolVersion, Error: err.Error()}
+	}
+	if err := json.NewEncoder(conn).Encode(snap); err != nil {
+		log.Printf("Fail to send snapshot: %v", err)
+	}
+}
+
+// readHelperRequest accepts only the fixed request schema on a single line;
+// anything else, including unknown fields, is refused before touching the
+// hardware.
+func readHelperRequest(br *bufio.Reader) (HelperRequest, error) {
+	var req HelperRequest
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return req, fmt.Errorf("request longer than %d bytes", helperMaxRequestBytes)
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return req, fmt.Errorf("read request: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return req, fmt.Errorf("decode request: %w", err)
+	}
+	if req.Version != helperProtocolVersion {
+		return req, fmt.Errorf("unsupported protocol version %d", req.Version)
+	}
+	return req, nil
+}
+
+func handleHelperRequest(req HelperRequest, reg prometheus.Gatherer) (*Snapshot, error) {
+	switch req.Method {
+	case helperMethodSnapshot:
+	case helperMethodCounters:
+		return sampleLocalCounters(), nil
+	case helperMethodCapture:
+		return &Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now(), Counters: captureLocalSample()}, nil
+	case helperMethodInventory:
+		devs := localDevices()
+		return &Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now(), Devices: devs, Identities: readIdentities(devs)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported method %q", req.Method)
+	}
+
+	snap := collectLocal(!req.SkipMRRS)
+	mfs, err := reg.Gather()
+	if err != nil {
+		// a partial gather is still useful, like promhttp's ContinueOnError
+		log.Printf("Gather helper metrics: %v", err)
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, fmt.Errorf("encode metrics: %w", err)
+		}
+	}
+	snap.Metrics = buf.String()
+	return snap, nil
+}
+
+// servePreciseSession samples for a capture with a precise sampler in the
+// helper until the client closes the connection. A tick waits at most an
+// interval longer than a request.
+func servePreciseSession(conn net.Conn, br *bufio.Reader, req HelperRequest) {
+	encoder := json.NewEncoder(conn)
+	selector := newCounterSelector(req.Devices, req.Counters)
+	selector.exclude = stringSet(req.Exclude)
+	sampler, err := newPreciseSampler(selector)
+	if err != nil {
+		encoder.Encode(&Snapshot{Version: helperProtocolVersion, Error: err.Error()})
+		return
+	}
+	defer sampler.close()
+	if err := encoder.Encode(&Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now()}); err != nil {
+		log.Printf("Precise sampling session: %v", err)
+		return
+	}
+	for {
+		conn.SetDeadline(time.Now().Add(req.Interval + helperRequestTimeout))
+		if _, err := br.ReadSlice('\n'); err != nil {
+			if err != io.EOF {
+				log.Printf("Precise sampling session: %v", err)
+			}
+			return
+		}
+		snap := &Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now()}
+		ticks, err := sampler.sample()
+		if err != nil {
+			snap.Error = err.Error()
+		}
+		for _, t := range ticks {
+			snap.Ticks = append(snap.Ticks, SnapshotTick{Device: t.device, At: t.at, Counters: t.counters})
+		}
+		snap.ReadErrors = sampler.readErrors()
+		if err := encoder.Encode(snap); err != nil {
+			log.Printf("Precise sampling session: %v", err)
+			return
+		}
+	}
+}
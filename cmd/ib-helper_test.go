@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// helperExchange sends request to serveHelperConn and returns its answer.
+func helperExchange(t *testing.T, request string) Snapshot {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveHelperConn(server, prometheus.NewRegistry())
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	// the helper stops reading an oversized request and answers right away
+	go client.Write([]byte(request))
+	var snap Snapshot
+	if err := json.NewDecoder(client).Decode(&snap); err != nil {
+		t.Fatalf("read answer to %.40q: %v", request, err)
+	}
+	return snap
+}
+
+func TestHelperRejectsRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name, request, want string
+	}{
+		{"method", `{"version":1,"method":"shell"}` + "\n", "unsupported method"},
+		{"version", `{"version":2,"method":"snapshot"}` + "\n", "unsupported protocol version"},
+		{"unknown field", `{"version":1,"method":"snapshot","command":"setpci"}` + "\n", "unknown field"},
+		{"not json", "snapshot\n", "decode request"},
+		{"oversized", `{"version":1,"method":"` + strings.Repeat("x", helperMaxRequestBytes) + `"}` + "\n", "request"},
+	} {
+		snap := helperExchange(t, tc.request)
+		if !strings.Contains(snap.Error, tc.want) {
+			t.Errorf("%s: error %q, want %q", tc.name, snap.Error, tc.want)
+		}
+		if len(snap.Counters) > 0 || len(snap.Devices) > 0 {
+			t.Errorf("%s: answered with data", tc.name)
+		}
+	}
+}
+
+// A process collecting through the helper doesn't discover devices itself,
+// even where it could read sysfs.
+func TestDiscoveryThroughHelper(t *testing.T) {
+	fakeDiscoverySysfs(t)
+	writeSysfs(t, IBSYSPATH, map[string]string{"mlx5_0/ports/1/state": "4: ACTIVE\n"})
+	previous := inventory
+	inventory = NewDeviceInventory()
+	t.Cleanup(func() { inventory = previous })
+
+	if devs := DiscoverIBDevices(); len(devs) == 0 {
+		t.Fatal("no active device discovered")
+	}
+	throughHelper.Store(true)
+	t.Cleanup(func() { throughHelper.Store(false) })
+	if devs := DiscoverIBDevices(); len(devs) != 0 {
+		t.Errorf("discovered %v through the helper", devs)
+	}
+}
+
+func TestEthtoolThroughHelper(t *testing.T) {
+	throughHelper.Store(true)
+	t.Cleanup(func() { throughHelper.Store(false) })
+	if _, err := openEthtoolStats("lo", func(string) bool { return true }); err != errThroughHelper {
+		t.Errorf("opened ethtool statistics through the helper: %v", err)
+	}
+}
+
+// startTestHelper serves helper requests on a socket in a temporary
+// directory and makes it the configured helper.
+func startTestHelper(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		reg := prometheus.NewRegistry()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveHelperConn(conn, reg)
+		}
+	}()
+	c := *cfg()
+	c.Helper.Socket = socket
+	previous := cfg()
+	currentConfig.Store(&c)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return socket
+}
+
+func TestCaptureIdentitiesThroughHelper(t *testing.T) {
+	fakeDiscoverySysfs(t)
+	writeSysfs(t, IBSYSPATH, map[string]string{
+		"mlx5_0/node_guid":          "0c42:a103:0001:0001\n",
+		"mlx5_0/fw_ver":             "28.39.1002\n",
+		"mlx5_0/ports/1/state":      "4: ACTIVE\n",
+		"mlx5_0/ports/1/link_layer": "Ethernet\n",
+	})
+	previous := inventory
+	inventory = NewDeviceInventory()
+	t.Cleanup(func() { inventory = previous })
+	// the helper's inventory; this process doesn't discover
+	inventory.Update([]IBDevice{describeIBDevice("mlx5_0"), describeIBDevice("mlx5_2")})
+	startTestHelper(t)
+	throughHelper.Store(true)
+	t.Cleanup(func() { throughHelper.Store(false) })
+
+	identities := captureIdentities()
+	if len(identities) != 2 || identities[0].Device != "mlx5_0" || identities[1].Device != "mlx5_2" {
+		t.Fatalf("identities %+v", identities)
+	}
+	if id := identities[0]; id.NodeGUID != "0c42:a103:0001:0001" || id.FWVer != "28.39.1002" || len(id.Ports) != 1 {
+		t.Errorf("mlx5_0 identity %+v", id)
+	}
+
+	// without a helper, no identities rather than reading them here
+	c := *cfg()
+	c.Helper.Socket = filepath.Join(t.TempDir(), "gone.sock")
+	currentConfig.Store(&c)
+	if identities := captureIdentities(); identities != nil {
+		t.Errorf("identities %+v without a helper", identities)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deviceInfoGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_device_info",
+			Help: "Identity of an IB device, value is always 1",
+		},
+		[]string{"device", "node_guid", "sys_image_guid", "fw_ver", "hca_type", "board_id", "node_desc", "bdf", "numa_node", "netdev"},
+	)
+	portInfoGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_port_info",
+			Help: "Addressing of an IB device port, value is always 1",
+		},
+		[]string{"device", "port", "lid", "sm_lid", "sm_sl", "lid_mask_count", "link_layer", "port_guid", "roce_gids"},
+	)
+	portActiveGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_port_active",
+			Help: "Whether the state of an IB device port is ACTIVE",
+		},
+		[]string{"device", "port"},
+	)
+	identityChangesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_identity_changes_total",
+			Help: "Changes of node GUID, port GUID, LID or SM LID seen on a device port",
+		},
+		[]string{"device", "port", "field"},
+	)
+
+	identityMu     sync.Mutex
+	lastDeviceInfo = map[string]prometheus.Labels{}
+	lastPortInfo   = map[string]prometheus.Labels{}
+	// port fields whose change is counted, e.g. a LID reassignment or an SM failover
+	portChangeFields = []string{"port_guid", "lid", "sm_lid"}
+)
+
+type PortIdentity struct {
+	Port         string   `json:"port"`
+	LID          string   `json:"lid"`
+	SMLID        string   `json:"sm_lid"`
+	SMSL         string   `json:"sm_sl"`
+	LIDMaskCount string   `json:"lid_mask_count"`
+	LinkLayer    string   `json:"link_layer"`
+	State        string   `json:"state"`
+	PortGUID     string   `json:"port_guid"`
+	RoceGIDs     []string `json:"roce_gids"`
+}
+
+type DeviceIdentity struct {
+	Device       string         `json:"device"`
+	NodeGUID     string         `json:"node_guid"`
+	SysImageGUID string         `json:"sys_image_guid"`
+	FWVer        string         `json:"fw_ver"`
+	HCAType      string         `json:"hca_type"`
+	BoardID      string         `json:"board_id"`
+	NodeDesc     string         `json:"node_desc"`
+	BDF          string         `json:"bdf"`
+	Function     string         `json:"function"`
+	ParentPF     string         `json:"parent_pf,omitempty"`
+	NUMANode     string         `json:"numa_node"`
+	NetDev       string         `json:"netdev"`
+	Ports        []PortIdentity `json:"ports"`
+}
+
+func listPorts(IBDev string) []string {
+	entries, err := os.ReadDir(path.Join(IBSYSPATH, IBDev, "ports"))
+	if err != nil {
+		log.Printf("Fail to read ports of IBDev:%s, err:%v", IBDev, err)
+		return nil
+	}
+	var ports []string
+	for _, entry := range entries {
+		ports = append(ports, entry.Name())
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// isZeroGID reports whether a GID table entry is unpopulated.
+func isZeroGID(gid string) bool {
+	return strings.Trim(gid, "0:") == ""
+}
+
+// portGUIDFromGID extracts the interface identifier (lower 64 bits) of GID 0,
+// which is the port GUID on InfiniBand ports.
+func portGUIDFromGID(gid string) string {
+	groups := strings.Split(gid, ":")
+	if len(groups) != 8 || isZeroGID(gid) {
+		return ""
+	}
+	return strings.Join(groups[4:], ":")
+}
+
+func readPortIdentity(IBDev, port string) PortIdentity {
+	portPath := path.Join(IBSYSPATH, IBDev, "ports", port)
+	p := PortIdentity{
+		Port:         port,
+		LID:          readSysfsString(path.Join(portPath, "lid")),
+		SMLID:        readSysfsString(path.Join(portPath, "sm_lid")),
+		SMSL:         readSysfsString(path.Join(portPath, "sm_sl")),
+		LIDMaskCount: readSysfsString(path.Join(portPath, "lid_mask_count")),
+		LinkLayer:    readSysfsString(path.Join(portPath, "link_layer")),
+		State:        readSysfsString(path.Join(portPath, "state")),
+		PortGUID:     portGUIDFromGID(readSysfsString(path.Join(portPath, "gids", "0"))),
+	}
+	if p.LinkLayer != "Ethernet" {
+		return p
+	}
+	entries, err := os.ReadDir(path.Join(portPath, "gids"))
+	if err != nil {
+		return p
+	}
+	for _, entry := range entries {
+		gid := readSysfsString(path.Join(portPath, "gids", entry.Name()))
+		if gid != "" && !isZeroGID(gid) {
+			p.RoceGIDs = append(p.RoceGIDs, gid)
+		}
+	}
+	sort.Strings(p.RoceGIDs)
+	return p
+}
+
+func ReadDeviceIdentity(dev IBDevice) DeviceIdentity {
+	devPath := path.Join(IBSYSPATH, dev.Name)
+	id := DeviceIdentity{
+		Device:       dev.Name,
+		NodeGUID:     readSysfsString(path.Join(devPath, "node_guid")),
+		SysImageGUID: readSysfsString(path.Join(devPath, "sys_image_guid")),
+		FWVer:        readSysfsString(path.Join(devPath, "fw_ver")),
+		HCAType:      readSysfsString(path.Join(devPath, "hca_type")),
+		BoardID:      readSysfsString(path.Join(devPath, "board_id")),
+		NodeDesc:     readSysfsString(path.Join(devPath, "node_desc")),
+		BDF:          dev.BDF,
+		Function:     dev.Function,
+		ParentPF:     dev.ParentPF,
+		NUMANode:     readSysfsString(path.Join(devPath, "device", "numa_node")),
+		NetDev:       dev.NetDev,
+	}
+	for _, port := range listPorts(dev.Name) {
+		id.Ports = append(id.Ports, readPortIdentity(dev.Name, port))
+	}
+	return id
+}
+
+// setInfoSeries replaces the info series stored under key when any of its
+// labels changed and returns the previous labels.
+func setInfoSeries(vec *prometheus.GaugeVec, last map[string]prometheus.Labels, key string, labels prometheus.Labels) prometheus.Labels {
+	prev, ok := last[key]
+	if ok && !labelsEqual(prev, labels) {
+		vec.Delete(prev)
+	}
+	vec.With(labels).Set(1)
+	last[key] = labels
+	return prev
+}
+
+func labelsEqual(a, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func updateIdentityMetrics(devs []IBDevice) []DeviceIdentity {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	var ids []DeviceIdentity
+	for _, dev := range devs {
+		id := ReadDeviceIdentity(dev)
+		ids = append(ids, id)
+		prevDevice := setInfoSeries(deviceInfoGauge, lastDeviceInfo, id.Device, prometheus.Labels{
+			"device":         id.Device,
+			"node_guid":      id.NodeGUID,
+			"sys_image_guid": id.SysImageGUID,
+			"fw_ver":         id.FWVer,
+			"hca_type":       id.HCAType,
+			"board_id":       id.BoardID,
+			"node_desc":      id.NodeDesc,
+			"bdf":            id.BDF,
+			"numa_node":      id.NUMANode,
+			"netdev":         id.NetDev,
+		})
+		if prevDevice != nil && prevDevice["node_guid"] != id.NodeGUID {
+			log.Printf("IBDev:%s node_guid changed from %s to %s", id.Device, prevDevice["node_guid"], id.NodeGUID)
+			identityChangesCounter.WithLabelValues(id.Device, "", "node_guid").Inc()
+		}
+
+		for _, p := range id.Ports {
+			labels := prometheus.Labels{
+				"device":         id.Device,
+				"port":           p.Port,
+				"lid":            p.LID,
+				"sm_lid":         p.SMLID,
+				"sm_sl":          p.SMSL,
+				"lid_mask_count": p.LIDMaskCount,
+				"link_layer":     p.LinkLayer,
+				"port_guid":      p.PortGUID,
+				"roce_gids":      strings.Join(p.RoceGIDs, ","),
+			}
+			active := 0.0
+			if strings.Contains(p.State, "ACTIVE") {
+				active = 1
+			}
+			portActiveGauge.WithLabelValues(id.Device, p.Port).Set(active)
+			prevPort := setInfoSeries(portInfoGauge, lastPortInfo, id.Device+"/"+p.Port, labels)
+			if prevPort == nil {
+				continue
+			}
+			for _, field := range portChangeFields {
+				prev, cur := prevPort[field], labels[field]
+				if prev != cur {
+					log.Printf("IBDev:%s port:%s %s changed from %s to %s", id.Device, p.Port, field, prev, cur)
+					identityChangesCounter.WithLabelValues(id.Device, p.Port, field).Inc()
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// forgetIdentity drops the info series of a device that left the inventory.
+func forgetIdentity(IBDev string) {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	deviceInfoGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	portInfoGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	portActiveGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	identityChangesCounter.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	delete(lastDeviceInfo, IBDev)
+	for key := range lastPortInfo {
+		if strings.HasPrefix(key, IBDev+"/") {
+			delete(lastPortInfo, key)
+		}
+	}
+}
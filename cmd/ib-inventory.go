@@ -0,0 +1,160 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	inventoryAdded   = "added"
+	inventoryRemoved = "removed"
+	inventoryRenamed = "renamed"
+)
+
+var (
+	inventoryChangesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_device_inventory_changes_total",
+			Help: "IB devices added, removed or renamed since the exporter started",
+		},
+		[]string{"change"},
+	)
+
+	inventory = NewDeviceInventory()
+)
+
+// inventoryKey identifies a device independently of its kernel name, which
+// can change across driver reloads or hot-plug.
+type inventoryKey struct {
+	NodeGUID string
+	BDF      string
+}
+
+type InventoryChange struct {
+	Change string
+	Old    IBDevice
+	New    IBDevice
+}
+
+// DeviceInventory keeps the set of devices seen by the last discovery cycle
+// and reports what changed between cycles.
+type DeviceInventory struct {
+	mu          sync.RWMutex
+	devices     map[inventoryKey]IBDevice
+	byName      map[string]IBDevice
+	initialized bool
+}
+
+func NewDeviceInventory() *DeviceInventory {
+	return &DeviceInventory{
+		devices: map[inventoryKey]IBDevice{},
+		byName:  map[string]IBDevice{},
+	}
+}
+
+func keyOf(dev IBDevice) inventoryKey {
+	return inventoryKey{NodeGUID: dev.NodeGUID, BDF: dev.BDF}
+}
+
+// Update replaces the inventory with the given devices and returns the
+// changes relative to the previous cycle. The first call only populates the
+// inventory and reports nothing.
+func (inv *DeviceInventory) Update(devs []IBDevice) []InventoryChange {
+	current := make(map[inventoryKey]IBDevice, len(devs))
+	for _, dev := range devs {
+		current[keyOf(dev)] = dev
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var changes []InventoryChange
+	if inv.initialized {
+		for key, dev := range current {
+			old, ok := inv.devices[key]
+			switch {
+			case !ok:
+				changes = append(changes, InventoryChange{Change: inventoryAdded, New: dev})
+			case old.Name != dev.Name:
+				changes = append(changes, InventoryChange{Change: inventoryRenamed, Old: old, New: dev})
+			}
+		}
+		for key, old := range inv.devices {
+			if _, ok := current[key]; !ok {
+				changes = append(changes, InventoryChange{Change: inventoryRemoved, Old: old})
+			}
+		}
+	}
+
+	inv.devices = current
+	inv.byName = make(map[string]IBDevice, len(current))
+	for _, dev := range current {
+		inv.byName[dev.Name] = dev
+	}
+	inv.initialized = true
+	return changes
+}
+
+func (inv *DeviceInventory) Lookup(IBDev string) (IBDevice, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	dev, ok := inv.byName[IBDev]
+	return dev, ok
+}
+
+// Names returns the device names currently in the inventory, sorted.
+func (inv *DeviceInventory) Names() []string {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	names := make([]string, 0, len(inv.byName))
+	for name := range inv.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (inv *DeviceInventory) Devices() []IBDevice {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+	devs := make([]IBDevice, 0, len(inv.byName))
+	for _, dev := range inv.byName {
+		devs = append(devs, dev)
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Name < devs[j].Name })
+	return devs
+}
+
+// deleteDeviceSeries drops every per-device series of a device that is gone
+// or was renamed, so that stale values are not exported forever.
+func deleteDeviceSeries(IBDev string) {
+	ibcounterGauge.DeletePartialMatch(prometheus.Labels{"IBDev": IBDev})
+	forgetIdentity(IBDev)
+	forgetGIDs(IBDev)
+	forgetTopology(IBDev)
+}
+
+func applyInventoryChanges(changes []InventoryChange) {
+	for _, c := range changes {
+		// the old name may already belong to another device, e.g. after a swap
+		_, nameInUse := inventory.Lookup(c.Old.Name)
+		inventoryChangesCounter.WithLabelValues(c.Change).Inc()
+		switch c.Change {
+		case inventoryAdded:
+			log.Printf("Inventory: IBDev:%s added, guid:%s, bdf:%s", c.New.Name, c.New.NodeGUID, c.New.BDF)
+		case inventoryRemoved:
+			log.Printf("Inventory: IBDev:%s removed, guid:%s, bdf:%s", c.Old.Name, c.Old.NodeGUID, c.Old.BDF)
+			if !nameInUse {
+				deleteDeviceSeries(c.Old.Name)
+			}
+		case inventoryRenamed:
+			log.Printf("Inventory: IBDev:%s renamed to %s, guid:%s, bdf:%s", c.Old.Name, c.New.Name, c.New.NodeGUID, c.New.BDF)
+			if !nameInUse {
+				deleteDeviceSeries(c.Old.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// labelValues returns the sorted values of label in the series of c.
+func labelValues(c prometheus.Collector, label string) []string {
+	ch := make(chan prometheus.Metric, 100)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	var values []string
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == label && !slices.Contains(values, l.GetValue()) {
+				values = append(values, l.GetValue())
+			}
+		}
+	}
+	slices.Sort(values)
+	return values
+}
+
+func TestInventoryUpdate(t *testing.T) {
+	dev := func(name, guid, bdf string) IBDevice {
+		return IBDevice{Name: name, NodeGUID: guid, BDF: bdf}
+	}
+	a := dev("mlx5_0", "0c42:a103:0001:0001", "0000:3b:00.0")
+	b := dev("mlx5_1", "0c42:a103:0001:0002", "0000:3b:00.1")
+	c := dev("mlx5_2", "0c42:a103:0001:0003", "0000:5e:00.0")
+	for _, tc := range []struct {
+		name   string
+		cycles [][]IBDevice
+		want   []InventoryChange
+	}{
+		{"first cycle", [][]IBDevice{{a, b}}, nil},
+		{"unchanged", [][]IBDevice{{a, b}, {b, a}}, nil},
+		{"added", [][]IBDevice{{a}, {a, b}},
+			[]InventoryChange{{Change: inventoryAdded, New: b}}},
+		{"removed", [][]IBDevice{{a, b}, {a}},
+			[]InventoryChange{{Change: inventoryRemoved, Old: b}}},
+		{"renamed", [][]IBDevice{{a, b}, {a, dev("mlx5_5", b.NodeGUID, b.BDF)}},
+			[]InventoryChange{{Change: inventoryRenamed, Old: b, New: dev("mlx5_5", b.NodeGUID, b.BDF)}}},
+		// the kernel names of two devices swapped
+		{"swapped", [][]IBDevice{{a, b}, {dev("mlx5_1", a.NodeGUID, a.BDF), dev("mlx5_0", b.NodeGUID, b.BDF)}},
+			[]InventoryChange{
+				{Change: inventoryRenamed, Old: a, New: dev("mlx5_1", a.NodeGUID, a.BDF)},
+				{Change: inventoryRenamed, Old: b, New: dev("mlx5_0", b.NodeGUID, b.BDF)},
+			}},
+		// another card in the same slot, or the same card in another slot,
+		// is another device
+		{"replaced in a slot", [][]IBDevice{{a}, {dev("mlx5_0", "0c42:a103:0002:0001", a.BDF)}},
+			[]InventoryChange{
+				{Change: inventoryAdded, New: dev("mlx5_0", "0c42:a103:0002:0001", a.BDF)},
+				{Change: inventoryRemoved, Old: a},
+			}},
+		{"moved to a slot", [][]IBDevice{{a}, {dev("mlx5_0", a.NodeGUID, "0000:af:00.0")}},
+			[]InventoryChange{
+				{Change: inventoryAdded, New: dev("mlx5_0", a.NodeGUID, "0000:af:00.0")},
+				{Change: inventoryRemoved, Old: a},
+			}},
+		{"everything at once", [][]IBDevice{{a, b}, {dev("mlx5_9", a.NodeGUID, a.BDF), c}},
+			[]InventoryChange{
+				{Change: inventoryAdded, New: c},
+				{Change: inventoryRemoved, Old: b},
+				{Change: inventoryRenamed, Old: a, New: dev("mlx5_9", a.NodeGUID, a.BDF)},
+			}},
+	} {
+		inv := NewDeviceInventory()
+		var changes []InventoryChange
+		for _, devs := range tc.cycles {
+			changes = inv.Update(devs)
+		}
+		// map order, the order of a cycle's changes is not defined
+		slices.SortFunc(changes, func(x, y InventoryChange) int {
+			if x.Change != y.Change {
+				return cmp.Compare(x.Change, y.Change)
+			}
+			return cmp.Compare(x.Old.Name+x.New.Name, y.Old.Name+y.New.Name)
+		})
+		if !slices.Equal(changes, tc.want) {
+			t.Errorf("%s: changes %+v, want %+v", tc.name, changes, tc.want)
+		}
+		last := tc.cycles[len(tc.cycles)-1]
+		var names []string
+		for _, dev := range last {
+			names = append(names, dev.Name)
+			if got, ok := inv.Lookup(dev.Name); !ok || got != dev {
+				t.Errorf("%s: Lookup(%s) = %+v, %v", tc.name, dev.Name, got, ok)
+			}
+		}
+		slices.Sort(names)
+		if got := inv.Names(); !slices.Equal(got, names) {
+			t.Errorf("%s: names %q, want %q", tc.name, got, names)
+		}
+	}
+}
+
+func TestApplyInventoryChanges(t *testing.T) {
+	previous := inventory
+	t.Cleanup(func() {
+		inventory = previous
+		ibcounterGauge.Reset()
+	})
+	a := IBDevice{Name: "mlx5_0", NodeGUID: "0c42:a103:0001:0001", BDF: "0000:3b:00.0"}
+	b := IBDevice{Name: "mlx5_1", NodeGUID: "0c42:a103:0001:0002", BDF: "0000:3b:00.1"}
+	c := IBDevice{Name: "mlx5_2", NodeGUID: "0c42:a103:0001:0003", BDF: "0000:5e:00.0"}
+	for _, tc := range []struct {
+		name string
+		next []IBDevice
+		want []string
+	}{
+		{"unchanged", []IBDevice{a, b, c}, []string{"mlx5_0", "mlx5_1", "mlx5_2"}},
+		{"removed", []IBDevice{a, c}, []string{"mlx5_0", "mlx5_2"}},
+		{"renamed", []IBDevice{a, b, {Name: "mlx5_7", NodeGUID: c.NodeGUID, BDF: c.BDF}}, []string{"mlx5_0", "mlx5_1"}},
+		// both names still belong to a device
+		{"swapped", []IBDevice{{Name: "mlx5_1", NodeGUID: a.NodeGUID, BDF: a.BDF}, {Name: "mlx5_0", NodeGUID: b.NodeGUID, BDF: b.BDF}, c},
+			[]string{"mlx5_0", "mlx5_1", "mlx5_2"}},
+	} {
+		ibcounterGauge.Reset()
+		for _, dev := range []string{"mlx5_0", "mlx5_1", "mlx5_2"} {
+			ibcounterGauge.WithLabelValues("port_rcv_data", dev, functionPF, "").Set(1)
+			ibcounterGauge.WithLabelValues("port_xmit_data", dev, functionPF, "").Set(1)
+		}
+		inventory = NewDeviceInventory()
+		inventory.Update([]IBDevice{a, b, c})
+		applyInventoryChanges(inventory.Update(tc.next))
+		if got := labelValues(ibcounterGauge, "IBDev"); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: series left of %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	numaNodeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_device_numa_node",
+			Help: "NUMA node of the HCA, -1 if the platform doesn't report one",
+		},
+		[]string{"device", "local_cpulist"},
+	)
+	completionIRQRateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_completion_interrupts_per_second",
+			Help: "Completion interrupts per second handled on a CPU, summed over the HCA's completion vectors",
+		},
+		[]string{"device", "cpu"},
+	)
+	irqRemoteAffinityGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ib_irq_affinity_remote",
+			Help: "Whether an HCA interrupt may be handled on CPUs outside the HCA's local NUMA node",
+		},
+		[]string{"device", "irq", "name"},
+	)
+
+	numaMu       sync.Mutex
+	lastCompIRQs = map[string]compIRQSample{}
+)
+
+type compIRQSample struct {
+	at     time.Time
+	perCPU map[int]uint64
+}
+
+type IRQInfo struct {
+	IRQ      int    `json:"irq"`
+	Name     string `json:"name"`
+	Affinity []int  `json:"affinity"`
+	Remote   bool   `json:"remote"`
+	// per-CPU interrupt counts from /proc/interrupts
+	Counts []uint64 `json:"counts"`
+}
+
+type DeviceTopology struct {
+	Device       string    `json:"device"`
+	NUMANode     int       `json:"numa_node"`
+	LocalCPUList string    `json:"local_cpulist"`
+	IRQs         []IRQInfo `json:"irqs"`
+}
+
+// parseCPUList parses the kernel cpulist format, e.g. "0-15,32-47".
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return nil, nil
+	}
+	for _, part := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpulist %q: %w", list, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("invalid cpulist %q: %w", list, err)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+type procInterrupt struct {
+	counts []uint64
+	name   string
+}
+
+// readProcInterrupts parses /proc/interrupts into per-CPU counts and the
+// action name of every numbered IRQ.
+func readProcInterrupts() (map[int]procInterrupt, error) {
+	f, err := os.Open(path.Join(PROCFSPATH, "interrupts"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	irqs := map[int]procInterrupt{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return irqs, scanner.Err()
+	}
+	numCPUs := len(strings.Fields(scanner.Text()))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		irq, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			continue
+		}
+		var entry procInterrupt
+		rest := fields[1:]
+		for i := 0; i < numCPUs && i < len(rest); i++ {
+			v, err := strconv.ParseUint(rest[i], 10, 64)
+			if err != nil {
+				break
+			}
+			entry.counts = append(entry.counts, v)
+		}
+		if len(rest) > len(entry.counts) {
+			entry.name = rest[len(rest)-1]
+		}
+		irqs[irq] = entry
+	}
+	return irqs, scanner.Err()
+}
+
+// listMSIIRQs returns the MSI/MSI-X vectors allocated to the PCI device.
+func listMSIIRQs(IBDev string) []int {
+	entries, err := os.ReadDir(path.Join(IBSYSPATH, IBDev, "device", "msi_irqs"))
+	if err != nil {
+		return nil
+	}
+	var irqs []int
+	for _, entry := range entries {
+		if irq, err := strconv.Atoi(entry.Name()); err == nil {
+			irqs = append(irqs, irq)
+		}
+	}
+	sort.Ints(irqs)
+	return irqs
+}
+
+func isCompletionIRQ(name string) bool {
+	return strings.Contains(name, "comp")
+}
+
+func ReadDeviceTopology(IBDev string, interrupts map[int]procInterrupt) DeviceTopology {
+	topo := DeviceTopology{Device: IBDev, NUMANode: -1}
+	if node, err := strconv.Atoi(readSysfsString(path.Join(IBSYSPATH, IBDev, "device", "numa_node"))); err == nil {
+		topo.NUMANode = node
+	}
+	topo.LocalCPUList = readSysfsString(path.Join(IBSYSPATH, IBDev, "device", "local_cpulist"))
+	localCPUs, err := parseCPUList(topo.LocalCPUList)
+	if err != nil {
+		log.Printf("IBDev:%s %v", IBDev, err)
+	}
+	local := make(map[int]bool, len(localCPUs))
+	for _, cpu := range localCPUs {
+		local[cpu] = true
+	}
+
+	for _, irq := range listMSIIRQs(IBDev) {
+		info := IRQInfo{IRQ: irq, Name: interrupts[irq].name, Counts: interrupts[irq].counts}
+		affinity := readSysfsString(path.Join(PROCFSPATH, "irq", strconv.Itoa(irq), "smp_affinity_list"))
+		if info.Affinity, err = parseCPUList(affinity); err != nil {
+			log.Printf("IBDev:%s irq:%d %v", IBDev, irq, err)
+		}
+		// without a local cpulist there is nothing to compare against
+		for _, cpu := range info.Affinity {
+			if len(local) > 0 && !local[cpu] {
+				info.Remote = true
+				break
+			}
+		}
+		topo.IRQs = append(topo.IRQs, info)
+	}
+	return topo
+}
+
+func CollectTopology(devs []IBDevice) []DeviceTopology {
+	interrupts, err := readProcInterrupts()
+	if err != nil {
+		log.Printf("fail to read interrupts: %v", err)
+	}
+	var topos []DeviceTopology
+	for _, dev := range devs {
+		topos = append(topos, ReadDeviceTopology(dev.Name, interrupts))
+	}
+	return topos
+}
+
+func updateNUMAMetrics(devs []IBDevice) {
+	topos := CollectTopology(devs)
+	now := time.Now()
+
+	numaMu.Lock()
+	defer numaMu.Unlock()
+
+	for _, topo := range topos {
+		numaNodeGauge.DeletePartialMatch(prometheus.Labels{"device": topo.Device})
+		numaNodeGauge.WithLabelValues(topo.Device, topo.LocalCPUList).Set(float64(topo.NUMANode))
+
+		irqRemoteAffinityGauge.DeletePartialMatch(prometheus.Labels{"device": topo.Device})
+		perCPU := map[int]uint64{}
+		for _, irq := range topo.IRQs {
+			remote := 0.0
+			if irq.Remote {
+				remote = 1
+				log.Printf("IBDev:%s irq:%d (%s) affinity %v is outside NUMA node %d", topo.Device, irq.IRQ, irq.Name, irq.Affinity, topo.NUMANode)
+			}
+			irqRemoteAffinityGauge.WithLabelValues(topo.Device, strconv.Itoa(irq.IRQ), irq.Name).Set(remote)
+			if !isCompletionIRQ(irq.Name) {
+				continue
+			}
+			for cpu, count := range irq.Counts {
+				perCPU[cpu] += count
+			}
+		}
+
+		prev, hasPrevious := lastCompIRQs[topo.Device]
+		lastCompIRQs[topo.Device] = compIRQSample{at: now, perCPU: perCPU}
+		if !hasPrevious {
+			continue
+		}
+		duration := now.Sub(prev.at).Seconds()
+		if duration <= 0 {
+			continue
+		}
+		completionIRQRateGauge.DeletePartialMatch(prometheus.Labels{"device": topo.Device})
+		for cpu, count := range perCPU {
+			// idle CPUs report 0; counts restart when the driver reallocates
+			// its vectors, and CPUs without a previous count have no rate yet
+			prevCount, ok := prev.perCPU[cpu]
+			if !ok || count < prevCount {
+				continue
+			}
+			rate := float64(count-prevCount) / duration
+			completionIRQRateGauge.WithLabelValues(topo.Device, strconv.Itoa(cpu)).Set(rate)
+		}
+	}
+}
+
+// forgetTopology drops the NUMA and IRQ series of a device that left the inventory.
+func forgetTopology(IBDev string) {
+	numaMu.Lock()
+	defer numaMu.Unlock()
+
+	numaNodeGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	completionIRQRateGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	irqRemoteAffinityGauge.DeletePartialMatch(prometheus.Labels{"device": IBDev})
+	delete(lastCompIRQs, IBDev)
+}
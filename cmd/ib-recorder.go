@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The flight recorder keeps the last few minutes of sysfs counters and ethtool
+// fields in memory so that a capture of what led up to an incident exists
+// before anyone knew to start one. A dump is written like any other capture,
+// in capture.format plus .json metadata, and is listed under
+// /api/v1/captures.
+const (
+	recorderMaxSamples = 10000
+
+	recorderCauseTrigger   = "trigger"
+	recorderCausePortState = "port_state"
+	recorderCauseSignal    = "signal"
+	recorderCauseAPI       = "api"
+)
+
+var (
+	recorderSamplesGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ib_recorder_samples",
+			Help: "Counter samples held by the flight recorder",
+		},
+	)
+	recorderDumpsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_recorder_dumps_total",
+			Help: "Flight recorder dumps written to the capture directory, by what caused them",
+		},
+		[]string{"cause"},
+	)
+	recorderDumpsSkippedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_recorder_dumps_skipped_total",
+			Help: "Flight recorder dumps not written because of the dump cooldown, an empty recorder or an error",
+		},
+		[]string{"cause"},
+	)
+
+	errRecorderDisabled = errors.New("flight recorder is disabled")
+	errRecorderEmpty    = errors.New("flight recorder holds no samples yet")
+	errRecorderCooldown = errors.New("flight recorder dumped too recently")
+
+	recorder = &flightRecorder{}
+)
+
+// recorderSample holds the values of one sample. The device, counter and link
+// type of each value are in layout, which is shared by consecutive samples
+// with the same counters, so a long window costs 8 bytes per counter.
+type recorderSample struct {
+	at     time.Time
+	layout []IBCounter
+	values []float64
+}
+
+type flightRecorder struct {
+	mu       sync.Mutex
+	ring     []recorderSample
+	next     int
+	count    int
+	layout   []IBCounter
+	lastDump time.Time
+}
+
+func sameLayout(layout, counters []IBCounter) bool {
+	if len(layout) != len(counters) {
+		return false
+	}
+	for i, c := range counters {
+		l := layout[i]
+		if l.IBDev != c.IBDev || l.CounterName != c.CounterName || l.NetDev != c.NetDev || l.DevLinkType != c.DevLinkType {
+			return false
+		}
+	}
+	return true
+}
+
+// record adds a sample, overwriting the oldest one once the ring is full.
+// The ring is resized when a reload changed the window or interval.
+func (r *flightRecorder) record(c RecorderConfig, at time.Time, counters []IBCounter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size := int(c.Window / c.Interval); size != len(r.ring) {
+		kept := r.ordered()
+		if len(kept) > size-1 {
+			kept = kept[len(kept)-(size-1):]
+		}
+		r.ring = make([]recorderSample, size)
+		r.count = copy(r.ring, kept)
+		r.next = r.count % size
+	}
+	if !sameLayout(r.layout, counters) {
+		r.layout = make([]IBCounter, len(counters))
+		for i, c := range counters {
+			r.layout[i] = IBCounter{IBDev: c.IBDev, NetDev: c.NetDev, DevLinkType: c.DevLinkType, CounterName: c.CounterName}
+		}
+	}
+	values := make([]float64, len(counters))
+	for i, c := range counters {
+		values[i] = c.CounterValue
+	}
+	r.ring[r.next] = recorderSample{at: at, layout: r.layout, values: values}
+	r.next = (r.next + 1) % len(r.ring)
+	if r.count < len(r.ring) {
+		r.count++
+	}
+	recorderSamplesGauge.Set(float64(r.count))
+}
+
+// ordered returns the samples oldest first. Callers hold r.mu.
+func (r *flightRecorder) ordered() []recorderSample {
+	samples := make([]recorderSample, 0, r.count)
+	for i := 0; i < r.count; i++ {
+		samples = append(samples, r.ring[(r.next-r.count+i+len(r.ring))%len(r.ring)])
+	}
+	return samples
+}
+
+func (r *flightRecorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ring, r.next, r.count, r.layout = nil, 0, 0, nil
+	recorderSamplesGauge.Set(0)
+}
+
+// dump writes the recorded samples to a new capture file. Cause is what
+// asked for the dump, rule and reason end up in the capture metadata.
+func (r *flightRecorder) dump(cause, rule, reason string) (CaptureInfo, error) {
+	c := cfg()
+	if !c.Recorder.Enabled {
+		return CaptureInfo{}, errRecorderDisabled
+	}
+	r.mu.Lock()
+	samples := r.ordered()
+	if len(samples) == 0 {
+		r.mu.Unlock()
+		return CaptureInfo{}, errRecorderEmpty
+	}
+	if time.Since(r.lastDump) < c.Recorder.DumpCooldown {
+		r.mu.Unlock()
+		return CaptureInfo{}, errRecorderCooldown
+	}
+	r.lastDump = time.Now()
+	r.mu.Unlock()
+
+	if err := os.MkdirAll(c.Capture.DataPath, 0755); err != nil {
+		return CaptureInfo{}, fmt.Errorf("create data directory: %w", err)
+	}
+	id := newCaptureID()
+	first, last := samples[0].at, samples[len(samples)-1].at
+	info := CaptureInfo{
+		ID:         id,
+		State:      captureStateDone,
+		Duration:   last.Sub(first).String(),
+		Interval:   c.Recorder.Interval.String(),
+		StartedAt:  first,
+		FinishedAt: &last,
+		Samples:    len(samples),
+		File:       captureFileName(id, c.Capture),
+		Origin:     captureOriginRecorder,
+		Rule:       rule,
+		Reason:     reason,
+		Identities: captureIdentities(),
+	}
+	info.path = filepath.Join(c.Capture.DataPath, info.File)
+	if err := writeRecorderSamples(info.path, c.Capture, samples); err != nil {
+		releaseCaptureFile(info.path)
+		return CaptureInfo{}, err
+	}
+	if err := writeCaptureMetadata(info); err != nil {
+		log.Printf("Capture %s: %v", id, err)
+	}
+	captures.add(info)
+	return info, nil
+}
+
+func writeRecorderSamples(filename string, c CaptureConfig, samples []recorderSample) error {
+	f, w, err := createCaptureFile(filename, c)
+	if err != nil {
+		return err
+	}
+	for _, s := range samples {
+		counters := make([]IBCounter, len(s.values))
+		copy(counters, s.layout)
+		for i, v := range s.values {
+			counters[i].CounterValue = v
+		}
+		if err = w.WriteSample(s.at, counters); err != nil {
+			break
+		}
+	}
+	if flushErr := w.Close(); err == nil {
+		err = flushErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write data file: %w", err)
+	}
+	return nil
+}
+
+// dumpRecorder is dump for the automatic causes, which only log the outcome.
+func dumpRecorder(cause, rule, reason string) {
+	info, err := recorder.dump(cause, rule, reason)
+	if errors.Is(err, errRecorderDisabled) {
+		return
+	}
+	if err != nil {
+		recorderDumpsSkippedCounter.WithLabelValues(cause).Inc()
+		log.Printf("Skipped flight recorder dump for %s (%s): %v", rule, reason, err)
+		return
+	}
+	recorderDumpsCounter.WithLabelValues(cause).Inc()
+	log.Printf("Flight recorder dumped %d samples to %s for %s: %s", info.Samples, info.path, rule, reason)
+}
+
+// portStateChanges describes the ports whose state differs between two
+// samples. Ports missing from either sample are not compared.
+func portStateChanges(prev, cur map[string]string) []string {
+	var changes []string
+	for port, state := range cur {
+		if before, ok := prev[port]; ok && before != state {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", port, before, state))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// run samples the counters every recorder interval while the recorder is
+// enabled and dumps it when a port changes state. The configuration is read
+// on every round so a SIGHUP reload takes effect.
+func (r *flightRecorder) run() {
+	var prevStates map[string]string
+	next := time.Now()
+	for {
+		c := cfg().Recorder
+		if !c.Enabled {
+			r.reset()
+			prevStates = nil
+			time.Sleep(time.Second)
+			next = time.Now()
+			continue
+		}
+
+		snap, err := sampleCounters()
+		if err != nil {
+			// the helper may be restarting, the gap shows in the dump
+			prevStates = nil
+		} else {
+			r.record(c, snap.CollectedAt, snap.Counters)
+			if changes := portStateChanges(prevStates, snap.PortStates); len(changes) > 0 {
+				for _, change := range changes {
+					log.Printf("Port state changed: %s", change)
+				}
+				go dumpRecorder(recorderCausePortState, recorderCausePortState, changes[0])
+			}
+			prevStates = snap.PortStates
+		}
+
+		// a slow sample skips the ticks it overran instead of catching up
+		next = next.Add(c.Interval)
+		if now := time.Now(); next.Before(now) {
+			next = now
+		}
+		time.Sleep(time.Until(next))
+	}
+}
+
+// watchRecorderSignal dumps the flight recorder on SIGUSR1.
+func watchRecorderSignal() {
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for range sigusr1 {
+			dumpRecorder(recorderCauseSignal, "SIGUSR1", "received SIGUSR1")
+		}
+	}()
+}
+
+type RecorderStatus struct {
+	APIVersion string     `json:"api_version"`
+	Enabled    bool       `json:"enabled"`
+	Window     string     `json:"window"`
+	Interval   string     `json:"interval"`
+	Samples    int        `json:"samples"`
+	OldestAt   *time.Time `json:"oldest_at,omitempty"`
+	NewestAt   *time.Time `json:"newest_at,omitempty"`
+	LastDumpAt *time.Time `json:"last_dump_at,omitempty"`
+}
+
+func apiRecorderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	c := cfg().Recorder
+	status := RecorderStatus{
+		APIVersion: apiVersion,
+		Enabled:    c.Enabled,
+		Window:     c.Window.String(),
+		Interval:   c.Interval.String(),
+	}
+	recorder.mu.Lock()
+	samples := recorder.ordered()
+	if len(samples) > 0 {
+		status.OldestAt, status.NewestAt = &samples[0].at, &samples[len(samples)-1].at
+	}
+	if !recorder.lastDump.IsZero() {
+		lastDump := recorder.lastDump
+		status.LastDumpAt = &lastDump
+	}
+	recorder.mu.Unlock()
+	status.Samples = len(samples)
+	writeAPIJSON(w, http.StatusOK, status)
+}
+
+// apiRecorderDumpsHandler dumps the flight recorder on POST and answers with
+// the capture it wrote.
+func apiRecorderDumpsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "requested through the API"
+	}
+	info, err := recorder.dump(recorderCauseAPI, recorderCauseAPI, reason)
+	switch {
+	case errors.Is(err, errRecorderDisabled), errors.Is(err, errRecorderEmpty):
+		writeAPIError(w, http.StatusConflict, "%v", err)
+		return
+	case errors.Is(err, errRecorderCooldown):
+		recorderDumpsSkippedCounter.WithLabelValues(recorderCauseAPI).Inc()
+		writeAPIError(w, http.StatusTooManyRequests, "%v, at most one dump every %s", err, cfg().Recorder.DumpCooldown)
+		return
+	case err != nil:
+		recorderDumpsSkippedCounter.WithLabelValues(recorderCauseAPI).Inc()
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	recorderDumpsCounter.WithLabelValues(recorderCauseAPI).Inc()
+	log.Printf("Flight recorder dumped %d samples to %s: %s", info.Samples, info.path, reason)
+	w.Header().Set("Location", "../captures/"+info.ID)
+	writeAPIJSON(w, http.StatusCreated, CaptureResponse{APIVersion: apiVersion, Capture: info})
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The report is one HTML file with inline SVG charts and CSS, no scripts or
+// external resources, so it can be attached to a ticket as is.
+const (
+	reportChartWidth  = 960
+	reportChartHeight = 260
+	reportMarginLeft  = 60
+	reportMarginRight = 20
+	reportMarginTop   = 16
+	reportMarginBot   = 28
+	// charts keep the maximum of each bucket beyond this many points, so
+	// short bursts stay visible
+	reportMaxPoints = 1500
+	// error timeline rows need room for the counter names
+	reportTimelineLeft = 200
+	reportTimelineRow  = 22
+)
+
+var (
+	reportPriorityCounter = regexp.MustCompile(`^(rx|tx)_prio(\d)_bytes$`)
+	reportColors          = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#9467bd", "#8c564b", "#e377c2", "#17becf", "#bcbd22", "#7f7f7f", "#d62728"}
+)
+
+type chartPoint struct {
+	t float64
+	v float64
+}
+
+type chartSeries struct {
+	Name   string
+	Color  string
+	points []chartPoint
+}
+
+// chartBand shades the intervals in which a pause or discard counter
+// increased.
+type chartBand struct {
+	from, to float64
+	class    string
+	title    string
+}
+
+type timelineRow struct {
+	counter string
+	events  []chartPoint
+}
+
+type ReportChart struct {
+	Title  string
+	SVG    template.HTML
+	Legend []chartSeries
+	Bands  bool
+}
+
+type ReportDevice struct {
+	Name     string
+	NetDev   string
+	LinkType string
+	FWVer    string
+	NodeGUID string
+	Summary  DeviceAnalysis
+	Charts   []ReportChart
+	Timeline template.HTML
+}
+
+type ReportCapture struct {
+	Name     string
+	Meta     *CaptureInfo
+	Analysis CaptureAnalysis
+	Devices  []ReportDevice
+}
+
+type Report struct {
+	Title     string
+	Generated time.Time
+	Version   string
+	Captures  []ReportCapture
+}
+
+// downsample keeps at most reportMaxPoints points, the largest of each bucket.
+func downsample(points []chartPoint) []chartPoint {
+	if len(points) <= reportMaxPoints {
+		return points
+	}
+	step := int(math.Ceil(float64(len(points)) / reportMaxPoints))
+	out := make([]chartPoint, 0, reportMaxPoints)
+	for i := 0; i < len(points); i += step {
+		best := points[i]
+		for _, p := range points[i:min(i+step, len(points))] {
+			if p.v > best.v {
+				best = p
+			}
+		}
+		out = append(out, best)
+	}
+	return out
+}
+
+// niceCeil rounds up to 1, 2 or 5 times a power of ten.
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	exp := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*exp {
+			return m * exp
+		}
+	}
+	return 10 * exp
+}
+
+func chartX(t, seconds float64, left int) float64 {
+	if seconds <= 0 {
+		return float64(left)
+	}
+	return float64(left) + t/seconds*float64(reportChartWidth-left-reportMarginRight)
+}
+
+func writeTimeAxis(b *strings.Builder, seconds float64, left, bottom int) {
+	fmt.Fprintf(b, `<line class="axis" x1="%d" y1="%d" x2="%d" y2="%d"/>`, left, bottom, reportChartWidth-reportMarginRight, bottom)
+	for i := 0; i <= 6; i++ {
+		t := seconds * float64(i) / 6
+		x := chartX(t, seconds, left)
+		fmt.Fprintf(b, `<text class="tick" x="%.1f" y="%d" text-anchor="middle">%.1fs</text>`, x, bottom+16, t)
+	}
+}
+
+// renderLineChart draws the series over the capture's elapsed seconds, with
+// the bands behind them.
+func renderLineChart(seconds float64, series []chartSeries, bands []chartBand, unit string) template.HTML {
+	top, bottom := reportMarginTop, reportChartHeight-reportMarginBot
+	ymax := 0.0
+	for _, s := range series {
+		for _, p := range s.points {
+			ymax = math.Max(ymax, p.v)
+		}
+	}
+	ymax = niceCeil(ymax)
+	y := func(v float64) float64 {
+		return float64(top) + (1-v/ymax)*float64(bottom-top)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d">`, reportChartWidth, reportChartHeight, reportChartWidth, reportChartHeight)
+	for _, band := range bands {
+		x1, x2 := chartX(band.from, seconds, reportMarginLeft), chartX(band.to, seconds, reportMarginLeft)
+		fmt.Fprintf(&b, `<rect class="%s" x="%.1f" y="%d" width="%.1f" height="%d"><title>%s</title></rect>`,
+			band.class, x1, top, math.Max(x2-x1, 1), bottom-top, html.EscapeString(band.title))
+	}
+	for i := 0; i <= 4; i++ {
+		v := ymax * float64(i) / 4
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" y1="%.1f" x2="%d" y2="%.1f"/>`, reportMarginLeft, y(v), reportChartWidth-reportMarginRight, y(v))
+		fmt.Fprintf(&b, `<text class="tick" x="%d" y="%.1f" text-anchor="end">%.3g</text>`, reportMarginLeft-6, y(v)+4, v)
+	}
+	fmt.Fprintf(&b, `<text class="tick" x="4" y="%d">%s</text>`, top-4, html.EscapeString(unit))
+	writeTimeAxis(&b, seconds, reportMarginLeft, bottom)
+	for _, s := range series {
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, s.Color)
+		for _, p := range downsample(s.points) {
+			fmt.Fprintf(&b, "%.1f,%.1f ", chartX(p.t, seconds, reportMarginLeft), y(p.v))
+		}
+		fmt.Fprintf(&b, `"><title>%s</title></polyline>`, html.EscapeString(s.Name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// renderTimeline draws a row per error counter with a mark for every
+// interval in which it increased.
+func renderTimeline(seconds float64, rows []timelineRow) template.HTML {
+	height := reportMarginTop + len(rows)*reportTimelineRow + reportMarginBot
+	bottom := height - reportMarginBot
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d">`, reportChartWidth, height, reportChartWidth, height)
+	for i, row := range rows {
+		y := reportMarginTop + i*reportTimelineRow + reportTimelineRow/2
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" y1="%d" x2="%d" y2="%d"/>`, reportTimelineLeft, y, reportChartWidth-reportMarginRight, y)
+		fmt.Fprintf(&b, `<text class="label" x="%d" y="%d" text-anchor="end">%s</text>`, reportTimelineLeft-8, y+4, html.EscapeString(row.counter))
+		for _, e := range row.events {
+			fmt.Fprintf(&b, `<circle class="error" cx="%.1f" cy="%d" r="4"><title>+%g at %.3fs</title></circle>`,
+				chartX(e.t, seconds, reportTimelineLeft), y, e.v, e.t)
+		}
+	}
+	writeTimeAxis(&b, seconds, reportTimelineLeft, bottom)
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// rateBands merges the intervals in which any of the tracks increased into
+// bands.
+func rateBands(start time.Time, tracks map[string]*seriesTrack, class string) []chartBand {
+	type interval struct {
+		from, to float64
+		counters []string
+	}
+	byEnd := map[float64]*interval{}
+	for counter, t := range tracks {
+		for i, rate := range t.rates {
+			if rate <= 0 {
+				continue
+			}
+			to := t.times[i].Sub(start).Seconds()
+			from := to - t.intervals[i]
+			iv, ok := byEnd[to]
+			if !ok {
+				iv = &interval{from: from, to: to}
+				byEnd[to] = iv
+			}
+			iv.from = math.Min(iv.from, from)
+			iv.counters = append(iv.counters, counter)
+		}
+	}
+	intervals := make([]*interval, 0, len(byEnd))
+	for _, iv := range byEnd {
+		intervals = append(intervals, iv)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].to < intervals[j].to })
+
+	var bands []chartBand
+	for _, iv := range intervals {
+		sort.Strings(iv.counters)
+		if n := len(bands); n > 0 && bands[n-1].to >= iv.from {
+			bands[n-1].to = iv.to
+			continue
+		}
+		bands = append(bands, chartBand{
+			from:  iv.from,
+			to:    iv.to,
+			class: class,
+			title: fmt.Sprintf("%s from %.3fs: %s", class, iv.from, strings.Join(iv.counters, ", ")),
+		})
+	}
+	return bands
+}
+
+func throughputSeries(start time.Time, counter string, t *seriesTrack, color string) chartSeries {
+	s := chartSeries{Name: counter, Color: color}
+	for i, gbps := range t.gbps(counter) {
+		s.points = append(s.points, chartPoint{t: t.times[i].Sub(start).Seconds(), v: gbps})
+	}
+	return s
+}
+
+func hasTraffic(t *seriesTrack) bool {
+	return t.increase > 0
+}
+
+func reportDevice(a *captureAnalyzer, summary DeviceAnalysis, meta *CaptureInfo) ReportDevice {
+	dev := ReportDevice{Name: summary.IBDev, NetDev: summary.NetDev, LinkType: summary.LinkType, Summary: summary}
+	if meta != nil {
+		for _, id := range meta.Identities {
+			if id.Device == dev.Name {
+				dev.FWVer, dev.NodeGUID = id.FWVer, id.NodeGUID
+			}
+		}
+	}
+
+	var total, priority []chartSeries
+	pauses := map[string]*seriesTrack{}
+	discards := map[string]*seriesTrack{}
+	var timeline []timelineRow
+	for _, key := range a.keys() {
+		if key.IBDev != dev.Name {
+			continue
+		}
+		t := a.tracks[key]
+		if counterBytesPerUnit(key.Counter) > 0 {
+			if reportPriorityCounter.MatchString(key.Counter) {
+				if hasTraffic(t) {
+					priority = append(priority, throughputSeries(a.start, key.Counter, t, reportColors[len(priority)%len(reportColors)]))
+				}
+			} else {
+				total = append(total, throughputSeries(a.start, key.Counter, t, reportColors[len(total)%len(reportColors)]))
+			}
+		}
+		if !hasTraffic(t) {
+			continue
+		}
+		switch counterClass(key.Counter) {
+		case counterClassPause:
+			pauses[key.Counter] = t
+		case counterClassDiscard:
+			discards[key.Counter] = t
+		case counterClassError:
+			row := timelineRow{counter: key.Counter}
+			for i, rate := range t.rates {
+				if rate > 0 {
+					increase := rate * t.intervals[i]
+					row.events = append(row.events, chartPoint{t: t.times[i].Sub(a.start).Seconds(), v: math.Round(increase)})
+				}
+			}
+			timeline = append(timeline, row)
+		}
+	}
+
+	bands := append(rateBands(a.start, pauses, counterClassPause), rateBands(a.start, discards, counterClassDiscard)...)
+	seconds := a.end.Sub(a.start).Seconds()
+	if len(total) > 0 {
+		dev.Charts = append(dev.Charts, ReportChart{Title: "Throughput", SVG: renderLineChart(seconds, total, bands, "Gb/s"), Legend: total, Bands: len(bands) > 0})
+	}
+	if len(priority) > 0 {
+		dev.Charts = append(dev.Charts, ReportChart{Title: "Throughput per priority", SVG: renderLineChart(seconds, priority, bands, "Gb/s"), Legend: priority, Bands: len(bands) > 0})
+	}
+	if len(timeline) > 0 {
+		dev.Timeline = renderTimeline(seconds, timeline)
+	}
+	return dev
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"increases": formatIncreases,
+	"bytes":     formatBytes,
+	"ms":        milliseconds,
+	"time":      func(t time.Time) string { return t.Format(time.RFC3339Nano) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 24px; color: #222; }
+h1 { font-size: 22px; } h2 { font-size: 18px; margin-top: 32px; border-bottom: 1px solid #ccc; } h3 { font-size: 15px; margin-top: 24px; }
+table { border-collapse: collapse; font-size: 13px; margin: 8px 0; }
+th, td { border: 1px solid #ddd; padding: 3px 8px; text-align: right; } th:first-child, td:first-child { text-align: left; }
+.meta { font-size: 13px; color: #555; }
+.legend { font-size: 12px; margin: 4px 0 12px; } .legend span { margin-right: 14px; white-space: nowrap; }
+.swatch { display: inline-block; width: 12px; height: 3px; vertical-align: middle; margin-right: 4px; }
+svg { display: block; max-width: 100%; height: auto; }
+svg .axis { stroke: #888; } svg .grid { stroke: #eee; } svg .tick, svg .label { font-size: 11px; fill: #555; }
+svg .pause { fill: #f4a261; fill-opacity: 0.3; } svg .discard { fill: #e63946; fill-opacity: 0.3; } svg .error { fill: #d62728; }
+.band { display: inline-block; width: 12px; height: 10px; vertical-align: middle; margin-right: 4px; }
+.band.pause { background: rgba(244, 162, 97, 0.3); } .band.discard { background: rgba(230, 57, 70, 0.3); }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Generated {{time .Generated}} by ib-exporter {{.Version}}</p>
+{{range .Captures}}
+<h2>{{.Name}}</h2>
+<p class="meta">
+{{time .Analysis.Start}} to {{time .Analysis.End}}, {{printf "%.1f" .Analysis.DurationSeconds}}s, {{.Analysis.Sampling.Samples}} samples;
+interval {{ms .Analysis.Sampling.MedianIntervalSeconds}} median, jitter p99 {{ms .Analysis.Sampling.JitterSeconds.P99}}, {{.Analysis.Sampling.Gaps}} gaps
+{{with .Meta}}<br>origin {{.Origin}}{{with .Rule}}, rule {{.}}{{end}}{{with .Reason}}: {{.}}{{end}}{{end}}
+</p>
+{{range .Devices}}
+<h3>{{.Name}} ({{.NetDev}}, {{.LinkType}}){{with .FWVer}}, firmware {{.}}{{end}}{{with .NodeGUID}}, GUID {{.}}{{end}}</h3>
+{{with .Summary.Throughput}}
+<table>
+<tr><th>Gb/s</th><th>min</th><th>mean</th><th>p50</th><th>p99</th><th>max</th><th>total</th></tr>
+{{range .}}<tr><td>{{.Counter}}</td><td>{{printf "%.3f" .Gbps.Min}}</td><td>{{printf "%.3f" .Gbps.Mean}}</td><td>{{printf "%.3f" .Gbps.P50}}</td><td>{{printf "%.3f" .Gbps.P99}}</td><td>{{printf "%.3f" .Gbps.Max}}</td><td>{{bytes .Bytes}}</td></tr>
+{{end}}</table>
+{{end}}
+<p class="meta">Errors: {{increases .Summary.Errors}}<br>Discards: {{increases .Summary.Discards}}<br>Pauses: {{increases .Summary.Pauses}}</p>
+{{range .Charts}}
+<h4>{{.Title}}</h4>
+{{.SVG}}
+<div class="legend">{{range .Legend}}<span><i class="swatch" style="background: {{.Color}}"></i>{{.Name}}</span>{{end}}{{if .Bands}}<span><i class="band pause"></i>pause</span><span><i class="band discard"></i>discard</span>{{end}}</div>
+{{end}}
+<h4>Error timeline</h4>
+{{with .Timeline}}{{.}}{{else}}<p class="meta">No error counter increased.</p>{{end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// runReport implements "ib-exporter report [-o report.html] [-title title]
+// <capture|archive>...".
+func runReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	output := fs.String("o", "report.html", "Output HTML file, - for stdout")
+	title := fs.String("title", "", "Report title, defaults to the capture names")
+	files, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("usage: ib-exporter report [-o report.html] [-title title] <capture|archive>...")
+	}
+
+	report := Report{Title: *title, Generated: time.Now(), Version: Version}
+	if report.Title == "" {
+		report.Title = "InfiniBand capture report: " + strings.Join(files, ", ")
+	}
+	for _, path := range files {
+		err := forEachCapture(path, func(name string, r tickReader, meta *CaptureInfo) error {
+			a := newCaptureAnalyzer()
+			if err := a.read(r, meta); err != nil {
+				return err
+			}
+			rc := ReportCapture{Name: name, Meta: meta, Analysis: a.analysis(name)}
+			for _, summary := range rc.Analysis.Devices {
+				rc.Devices = append(rc.Devices, reportDevice(a, summary, meta))
+			}
+			report.Captures = append(report.Captures, rc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+	if err := reportTemplate.Execute(w, report); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
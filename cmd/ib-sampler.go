@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A capture reads its counters with one of two samplers. The full sampler
+// collects what the exporter does, including the ethtool, QP and MR
+// counters that need commands, running only the collectors of the selected
+// counters. The precise sampler discovers the selected sysfs port counters
+// and ethtool statistics once, keeps their files and sockets open and reads
+// them with pread and the ethtool ioctl, all devices in parallel, which
+// sustains 10ms intervals.
+const (
+	captureSamplerFull    = "full"
+	captureSamplerPrecise = "precise"
+)
+
+var (
+	captureMissedTicksCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_capture_missed_ticks_total",
+		Help: "Capture ticks skipped because the previous sample took longer than the interval",
+	})
+	captureJitterHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ib_capture_sample_jitter_seconds",
+		Help:    "Distance of the time between consecutive capture samples from the interval, without the missed ticks",
+		Buckets: []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1},
+	})
+)
+
+// CaptureSampling tells how well a capture kept its interval. Jitter is the
+// distance of the time between consecutive samples from the interval, of
+// the samples on schedule only: a sample overrunning the interval and the
+// ticks it skipped are missed ticks instead. Read is the time a sample took.
+type CaptureSampling struct {
+	Sampler       string `json:"sampler"`
+	MissedTicks   int    `json:"missed_ticks"`
+	ReadErrors    int    `json:"read_errors"`
+	JitterSeconds Stats  `json:"jitter_seconds"`
+	ReadSeconds   Stats  `json:"read_seconds"`
+}
+
+// captureTick is counters read at the same time. device tells the ticks of
+// one sample apart, it is empty when a tick has all devices.
+type captureTick struct {
+	device   string
+	at       time.Time
+	counters []IBCounter
+}
+
+type captureSampler interface {
+	// sample reads the counters once and returns them with when they were
+	// read
+	sample() ([]captureTick, error)
+	readErrors() int
+	close()
+}
+
+// newCaptureSampler creates the sampler of one group of a capture. exclude
+// are the counters of the other groups, which a group without counters
+// leaves to them.
+func newCaptureSampler(devices []string, g CaptureGroup, exclude []string) (captureSampler, error) {
+	selector := newCounterSelector(devices, g.Counters)
+	if len(g.Counters) == 0 {
+		selector.exclude = stringSet(exclude)
+	}
+	if g.Sampler == captureSamplerPrecise {
+		if socket := cfg().Helper.Socket; socket != "" {
+			return newHelperPreciseSampler(socket, HelperRequest{
+				Version:  helperProtocolVersion,
+				Method:   helperMethodPrecise,
+				Devices:  devices,
+				Counters: g.Counters,
+				Exclude:  slices.Collect(maps.Keys(selector.exclude)),
+				Interval: g.Interval,
+			})
+		}
+		return newPreciseSampler(selector)
+	}
+	return fullSampler{selector: selector}, nil
+}
+
+type fullSampler struct {
+	selector counterSelector
+}
+
+// sample takes the middle of the collection as its time, which can take
+// long with the commands involved.
+func (s fullSampler) sample() ([]captureTick, error) {
+	start := time.Now()
+	counters, err := collectCounters(s.selector)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	return []captureTick{{at: start.Add(end.Sub(start) / 2), counters: counters}}, nil
+}
+
+func (fullSampler) readErrors() int { return 0 }
+
+func (fullSampler) close() {}
+
+// collectCounters collects what selector selects. Given counter names it
+// runs only the collectors that produce them, on the selected devices;
+// otherwise, and through the helper, which collects everything at once, it
+// collects everything and picks the selected counters.
+func collectCounters(selector counterSelector) ([]IBCounter, error) {
+	if cfg().Helper.Socket != "" || len(selector.names) == 0 {
+		counters, err := captureSample()
+		if err != nil {
+			return nil, err
+		}
+		return selector.counters(counters), nil
+	}
+
+	collectors := cfg().Collectors
+	ethtoolFields := stringSet(append(collectors.Ethtool.EthernetFields, collectors.Ethtool.InfiniBandFields...))
+	var ethtool, optical, port bool
+	for name := range selector.names {
+		switch {
+		case name == "QPNum" || name == "MRNum" || name == "portSpeed":
+		case ethtoolFields[name]:
+			ethtool = true
+		case strings.HasPrefix(name, "module_"):
+			optical = true
+		default:
+			port = true
+		}
+	}
+	collectMu.Lock()
+	defer collectMu.Unlock()
+	var devs []string
+	for _, dev := range GetIBDev() {
+		if len(selector.devices) == 0 || selector.devices[dev] {
+			devs = append(devs, dev)
+		}
+	}
+	if len(devs) == 0 {
+		return nil, errors.New("no selected device found")
+	}
+
+	var counters []IBCounter
+	if port {
+		counters = append(counters, getIBDevCounter(devs)...)
+	}
+	if collectors.QP && selector.names["QPNum"] {
+		counters = append(counters, getQPNum(devs)...)
+	}
+	if collectors.MR && selector.names["MRNum"] {
+		counters = append(counters, getMRNum(devs)...)
+	}
+	if collectors.Ethtool.Enabled && ethtool {
+		counters = append(counters, GetRoceData(devs)...)
+	}
+	if collectors.PortSpeed && selector.names["portSpeed"] {
+		counters = append(counters, getPortSpeed(devs)...)
+	}
+	if collectors.Optical && optical {
+		counters = append(counters, getPortOpticalInfo(devs)...)
+	}
+	return selector.counters(counters), nil
+}
+
+type counterFile struct {
+	f       *os.File
+	counter IBCounter
+}
+
+// preciseDevice is the open counter files and ethtool statistics of one
+// device and the result of its last read.
+type preciseDevice struct {
+	name, netDev string
+	linkLayer    string
+	files        []counterFile
+	ethtool      *ethtoolStats
+	buf          []byte
+	values       []IBCounter
+	start, end   time.Time
+	errors       int
+}
+
+// read preads every counter file of the device and reads its ethtool
+// statistics.
+func (d *preciseDevice) read() {
+	d.values = d.values[:0]
+	d.start = time.Now()
+	for _, cf := range d.files {
+		n, err := cf.f.ReadAt(d.buf, 0)
+		if err != nil && err != io.EOF {
+			d.errors++
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(d.buf[:n])), 64)
+		if err != nil {
+			d.errors++
+			continue
+		}
+		c := cf.counter
+		c.CounterValue = value
+		d.values = append(d.values, c)
+	}
+	if d.ethtool != nil {
+		err := d.ethtool.read(func(name string, value float64) {
+			d.values = append(d.values, IBCounter{IBDev: d.name, NetDev: d.netDev, DevLinkType: d.linkLayer, CounterName: name, CounterValue: value})
+		})
+		if err != nil {
+			d.errors++
+		}
+	}
+	d.end = time.Now()
+}
+
+type preciseSampler struct {
+	devices []*preciseDevice
+}
+
+// newPreciseSampler opens the sysfs counter files and ethtool statistics
+// of the selected devices and counters. Like the full sampler it reads the
+// ethtool fields of collectors.ethtool only.
+func newPreciseSampler(selector counterSelector) (*preciseSampler, error) {
+	collectors := cfg().Collectors
+	var counterTypes []string
+	if collectors.Counters {
+		counterTypes = append(counterTypes, "counters")
+	}
+	if collectors.HWCounters {
+		counterTypes = append(counterTypes, "hw_counters")
+	}
+	s := &preciseSampler{}
+	for _, dev := range localDevices() {
+		if len(selector.devices) > 0 && !selector.devices[dev.Name] {
+			continue
+		}
+		linkLayer := readSysfsString(path.Join(IBSYSPATH, dev.Name, "ports/1/link_layer"))
+		d := &preciseDevice{name: dev.Name, netDev: dev.NetDev, linkLayer: linkLayer, buf: make([]byte, 64)}
+		for _, ct := range counterTypes {
+			dir := path.Join(IBSYSPATH, dev.Name, "ports/1", ct)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if !selector.match(dev.Name, entry.Name()) {
+					continue
+				}
+				f, err := os.Open(path.Join(dir, entry.Name()))
+				if err != nil {
+					log.Printf("Precise sampler: %v", err)
+					continue
+				}
+				d.files = append(d.files, counterFile{f: f, counter: IBCounter{
+					IBDev:       dev.Name,
+					NetDev:      dev.NetDev,
+					DevLinkType: linkLayer,
+					CounterName: entry.Name(),
+				}})
+			}
+		}
+		if collectors.Ethtool.Enabled && dev.NetDev != "" {
+			wanted := map[string]bool{}
+			if strings.Contains(linkLayer, "Ethernet") {
+				wanted = stringSet(collectors.Ethtool.EthernetFields)
+			} else if strings.Contains(linkLayer, "InfiniBand") {
+				wanted = stringSet(collectors.Ethtool.InfiniBandFields)
+			}
+			stats, err := openEthtoolStats(dev.NetDev, func(name string) bool {
+				return wanted[name] && selector.match(dev.Name, name)
+			})
+			if err == nil {
+				d.ethtool = stats
+			} else if !errors.Is(err, errNoEthtoolStats) {
+				log.Printf("Precise sampler: %v", err)
+			}
+		}
+		if len(d.files) > 0 || d.ethtool != nil {
+			d.values = make([]IBCounter, 0, len(d.files))
+			s.devices = append(s.devices, d)
+		}
+	}
+	if len(s.devices) == 0 {
+		return nil, errors.New("no sysfs or ethtool counters to sample")
+	}
+	return s, nil
+}
+
+// sample reads all devices in parallel. Each device is a tick of its own,
+// timestamped with the middle of its read: the reads start together but a
+// slow device can end well after the others.
+func (s *preciseSampler) sample() ([]captureTick, error) {
+	var wg sync.WaitGroup
+	wg.Add(len(s.devices))
+	for _, d := range s.devices {
+		go func(d *preciseDevice) {
+			defer wg.Done()
+			d.read()
+		}(d)
+	}
+	wg.Wait()
+
+	var ticks []captureTick
+	for _, d := range s.devices {
+		if len(d.values) > 0 {
+			ticks = append(ticks, captureTick{device: d.name, at: d.start.Add(d.end.Sub(d.start) / 2), counters: d.values})
+		}
+	}
+	if len(ticks) == 0 {
+		return nil, fmt.Errorf("no counter could be read")
+	}
+	return ticks, nil
+}
+
+func (s *preciseSampler) readErrors() int {
+	errors := 0
+	for _, d := range s.devices {
+		errors += d.errors
+	}
+	return errors
+}
+
+func (s *preciseSampler) close() {
+	for _, d := range s.devices {
+		for _, cf := range d.files {
+			cf.f.Close()
+		}
+		if d.ethtool != nil {
+			d.ethtool.close()
+		}
+	}
+}
+
+// helperPreciseSampler runs the precise sampler in the helper, in a session
+// of its own, and asks it for every sample.
+type helperPreciseSampler struct {
+	conn    net.Conn
+	decoder *json.Decoder
+	errors  int
+}
+
+func newHelperPreciseSampler(socket string, req HelperRequest) (*helperPreciseSampler, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connect to helper: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(helperRequestTimeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("send request to helper: %w", err)
+	}
+	s := &helperPreciseSampler{conn: conn, decoder: json.NewDecoder(conn)}
+	if _, err := s.receive(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *helperPreciseSampler) receive() (*Snapshot, error) {
+	var snap Snapshot
+	if err := s.decoder.Decode(&snap); err != nil {
+		return nil, fmt.Errorf("read sample from helper: %w", err)
+	}
+	s.errors = snap.ReadErrors
+	if snap.Error != "" {
+		return nil, fmt.Errorf("helper: %s", snap.Error)
+	}
+	if snap.Version != helperProtocolVersion {
+		return nil, fmt.Errorf("helper speaks protocol version %d, want %d", snap.Version, helperProtocolVersion)
+	}
+	return &snap, nil
+}
+
+func (s *helperPreciseSampler) sample() ([]captureTick, error) {
+	s.conn.SetDeadline(time.Now().Add(helperRequestTimeout))
+	if _, err := s.conn.Write([]byte("\n")); err != nil {
+		return nil, fmt.Errorf("ask helper for a sample: %w", err)
+	}
+	snap, err := s.receive()
+	if err != nil {
+		return nil, err
+	}
+	ticks := make([]captureTick, 0, len(snap.Ticks))
+	for _, t := range snap.Ticks {
+		ticks = append(ticks, captureTick{device: t.Device, at: t.At, counters: t.Counters})
+	}
+	return ticks, nil
+}
+
+func (s *helperPreciseSampler) readErrors() int { return s.errors }
+
+func (s *helperPreciseSampler) close() { s.conn.Close() }
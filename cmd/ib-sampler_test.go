@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeCounterSysfs has two devices with port counters and makes them the
+// inventory.
+func fakeCounterSysfs(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	writeSysfs(t, root, map[string]string{
+		"mlx5_0/ports/1/link_layer":                "InfiniBand\n",
+		"mlx5_0/ports/1/counters/port_rcv_data":    "100\n",
+		"mlx5_0/ports/1/counters/port_xmit_data":   "200\n",
+		"mlx5_0/ports/1/hw_counters/np_cnp_sent":   "3\n",
+		"mlx5_1/ports/1/link_layer":                "Ethernet\n",
+		"mlx5_1/ports/1/counters/port_rcv_data":    "400\n",
+		"mlx5_1/ports/1/counters/port_xmit_data":   "500\n",
+		"mlx5_1/ports/1/hw_counters/rx_icrc_error": "0\n",
+	})
+	useIBSysPath(t, root)
+	previous := inventory
+	inventory = NewDeviceInventory()
+	inventory.Update([]IBDevice{{Name: "mlx5_0", NodeGUID: "0c42:a103:0001:0001"}, {Name: "mlx5_1", NodeGUID: "0c42:a103:0001:0002"}})
+	t.Cleanup(func() { inventory = previous })
+	return root
+}
+
+// tickValues returns "<device>/<counter>" to value of ticks.
+func tickValues(t *testing.T, ticks []captureTick) map[string]float64 {
+	t.Helper()
+	values := map[string]float64{}
+	for _, tick := range ticks {
+		for _, c := range tick.counters {
+			if c.IBDev != tick.device {
+				t.Errorf("counter of %s in the tick of %s", c.IBDev, tick.device)
+			}
+			values[c.IBDev+"/"+c.CounterName] = c.CounterValue
+		}
+	}
+	return values
+}
+
+func TestPreciseSamplerThroughHelper(t *testing.T) {
+	root := fakeCounterSysfs(t)
+	startTestHelper(t)
+	g := CaptureGroup{Interval: 10 * time.Millisecond, Sampler: captureSamplerPrecise}
+	sampler, err := newCaptureSampler([]string{"mlx5_1"}, g, []string{"rx_icrc_error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampler.close()
+	if _, ok := sampler.(*helperPreciseSampler); !ok {
+		t.Fatalf("sampler %T, want the helper's", sampler)
+	}
+
+	for _, want := range []map[string]float64{
+		{"mlx5_1/port_rcv_data": 400, "mlx5_1/port_xmit_data": 500},
+		{"mlx5_1/port_rcv_data": 401, "mlx5_1/port_xmit_data": 500},
+	} {
+		ticks, err := sampler.sample()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ticks) != 1 || ticks[0].device != "mlx5_1" || ticks[0].at.IsZero() {
+			t.Fatalf("ticks %+v", ticks)
+		}
+		if got := tickValues(t, ticks); !maps.Equal(got, want) {
+			t.Errorf("sampled %v, want %v", got, want)
+		}
+		writeSysfs(t, root, map[string]string{"mlx5_1/ports/1/counters/port_rcv_data": "401\n"})
+	}
+	if errors := sampler.readErrors(); errors != 0 {
+		t.Errorf("%d read errors", errors)
+	}
+
+	// the helper's error fails the capture's start
+	if _, err := newCaptureSampler([]string{"mlx5_9"}, g, nil); err == nil {
+		t.Error("sampler of a missing device")
+	}
+}
+
+func TestPreciseSampler(t *testing.T) {
+	root := fakeCounterSysfs(t)
+	g := CaptureGroup{Interval: 10 * time.Millisecond, Sampler: captureSamplerPrecise}
+	sampler, err := newCaptureSampler(nil, g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sampler.close()
+	if _, ok := sampler.(*preciseSampler); !ok {
+		t.Fatalf("sampler %T, want the precise one", sampler)
+	}
+
+	ticks, err := sampler.sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tick per device
+	if len(ticks) != 2 || ticks[0].device != "mlx5_0" || ticks[1].device != "mlx5_1" {
+		t.Fatalf("ticks %+v", ticks)
+	}
+	want := map[string]float64{
+		"mlx5_0/port_rcv_data": 100, "mlx5_0/port_xmit_data": 200, "mlx5_0/np_cnp_sent": 3,
+		"mlx5_1/port_rcv_data": 400, "mlx5_1/port_xmit_data": 500, "mlx5_1/rx_icrc_error": 0,
+	}
+	if got := tickValues(t, ticks); !maps.Equal(got, want) {
+		t.Errorf("sampled %v, want %v", got, want)
+	}
+	if ticks[0].counters[0].DevLinkType != "InfiniBand" || ticks[1].counters[0].DevLinkType != "Ethernet" {
+		t.Errorf("link layers %s, %s", ticks[0].counters[0].DevLinkType, ticks[1].counters[0].DevLinkType)
+	}
+
+	// the open files are read again, a value that doesn't parse is a read
+	// error and left out
+	writeSysfs(t, root, map[string]string{
+		"mlx5_0/ports/1/counters/port_rcv_data": "150\n",
+		"mlx5_1/ports/1/counters/port_rcv_data": "garbage\n",
+	})
+	ticks, err = sampler.sample()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want["mlx5_0/port_rcv_data"] = 150
+	delete(want, "mlx5_1/port_rcv_data")
+	if got := tickValues(t, ticks); !maps.Equal(got, want) {
+		t.Errorf("sampled %v, want %v", got, want)
+	}
+	if errors := sampler.readErrors(); errors != 1 {
+		t.Errorf("%d read errors, want 1", errors)
+	}
+}
+
+func TestPreciseSamplerSelection(t *testing.T) {
+	fakeCounterSysfs(t)
+	for _, tc := range []struct {
+		name     string
+		devices  []string
+		counters []string
+		exclude  []string
+		want     []string
+	}{
+		{"devices", []string{"mlx5_1"}, nil, nil,
+			[]string{"mlx5_1/port_rcv_data", "mlx5_1/port_xmit_data", "mlx5_1/rx_icrc_error"}},
+		{"counters", nil, []string{"port_rcv_data"}, nil,
+			[]string{"mlx5_0/port_rcv_data", "mlx5_1/port_rcv_data"}},
+		// the counters of the other groups
+		{"exclude", []string{"mlx5_0"}, nil, []string{"port_rcv_data", "port_xmit_data"},
+			[]string{"mlx5_0/np_cnp_sent"}},
+	} {
+		g := CaptureGroup{Interval: 10 * time.Millisecond, Counters: tc.counters, Sampler: captureSamplerPrecise}
+		sampler, err := newCaptureSampler(tc.devices, g, tc.exclude)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ticks, err := sampler.sample()
+		sampler.close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := slices.Sorted(maps.Keys(tickValues(t, ticks)))
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: sampled %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	g := CaptureGroup{Interval: 10 * time.Millisecond, Counters: []string{"QPNum"}, Sampler: captureSamplerPrecise}
+	if _, err := newCaptureSampler(nil, g, nil); err == nil {
+		t.Error("precise sampler of no sysfs counter")
+	}
+}
+
+// slowSampler takes longer than the interval for the samples in slow.
+type slowSampler struct {
+	n    int
+	slow map[int]time.Duration
+}
+
+func (s *slowSampler) sample() ([]captureTick, error) {
+	s.n++
+	time.Sleep(s.slow[s.n])
+	return []captureTick{{at: time.Now(), counters: []IBCounter{{IBDev: "mlx5_0", CounterName: "port_rcv_data"}}}}, nil
+}
+
+func (s *slowSampler) readErrors() int { return 0 }
+
+func (s *slowSampler) close() {}
+
+type countingWriter struct{ samples int }
+
+func (w *countingWriter) WriteSample(time.Time, []IBCounter) error {
+	w.samples++
+	return nil
+}
+
+func (w *countingWriter) Close() error { return nil }
+
+// A sample overrunning its interval makes missed ticks, not jitter.
+func TestCaptureGroupMissedTicks(t *testing.T) {
+	interval := 20 * time.Millisecond
+	g := CaptureGroup{Interval: interval, Sampler: captureSamplerFull}
+	sampler := &slowSampler{slow: map[int]time.Duration{3: 3 * interval}}
+	w := &countingWriter{}
+	start := time.Now()
+	samples, sampling, err := runCaptureGroup(context.Background(), g, sampler, w, start, start.Add(15*interval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if samples != w.samples || samples < 8 {
+		t.Errorf("%d samples, %d written", samples, w.samples)
+	}
+	if sampling.MissedTicks < 2 || sampling.MissedTicks > 4 {
+		t.Errorf("%d missed ticks, want about 3", sampling.MissedTicks)
+	}
+	// the overrun is 60ms, the timer's lateness a few at most
+	if max := sampling.JitterSeconds.Max; max >= interval.Seconds() {
+		t.Errorf("jitter up to %.1fms", max*1000)
+	}
+}
+
+// fakeBenchSysfs has devices with the port counters of a ConnectX-7: 20
+// counters and 60 hw_counters each.
+func fakeBenchSysfs(b *testing.B, devices int) {
+	root := b.TempDir()
+	files := map[string]string{}
+	var devs []IBDevice
+	for d := range devices {
+		dev := fmt.Sprintf("mlx5_%d", d)
+		devs = append(devs, IBDevice{Name: dev, NodeGUID: fmt.Sprintf("0c42:a103:0001:%04x", d)})
+		files[dev+"/ports/1/link_layer"] = "Ethernet\n"
+		for i := range 20 {
+			files[fmt.Sprintf("%s/ports/1/counters/counter_%d", dev, i)] = "1234567890123\n"
+		}
+		for i := range 60 {
+			files[fmt.Sprintf("%s/ports/1/hw_counters/hw_counter_%d", dev, i)] = "1234567\n"
+		}
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	previousPath, previous := IBSYSPATH, inventory
+	IBSYSPATH = root
+	inventory = NewDeviceInventory()
+	inventory.Update(devs)
+	b.Cleanup(func() { IBSYSPATH, inventory = previousPath, previous })
+}
+
+// The precise sampler preads the open files of all devices in parallel; the
+// stream's sampler opens and reads every file in turn.
+func BenchmarkPreciseSample(b *testing.B) {
+	fakeBenchSysfs(b, 8)
+	sampler, err := newPreciseSampler(counterSelector{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sampler.close()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := sampler.sample(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStreamSample(b *testing.B) {
+	fakeBenchSysfs(b, 8)
+	b.ResetTimer()
+	for range b.N {
+		sampleLocalCounters()
+	}
+}
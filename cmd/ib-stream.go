@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The live stream samples only the sysfs counters and ethtool fields, which
+// are cheap enough to read every 100ms; the host tools of a full collection
+// are not. One sampler
+// runs per requested interval and is shared by all clients asking for it.
+const (
+	streamDefaultInterval = time.Second
+	streamWriteTimeout    = 10 * time.Second
+)
+
+var (
+	streamClientsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ib_stream_clients",
+			Help: "Clients connected to the live counter stream",
+		},
+	)
+	streamDroppedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ib_stream_clients_dropped_total",
+			Help: "Live stream clients disconnected because they could not keep up",
+		},
+	)
+
+	errTooManyStreamClients = errors.New("too many stream clients")
+
+	streams = &streamHub{samplers: map[time.Duration]*streamSampler{}}
+
+	streamEthtool = &ethtoolReaders{devices: map[string]*ethtoolReader{}}
+)
+
+// StreamEvent is one interval of the live stream: the rates of the cumulative
+// counters between two consecutive samples.
+type StreamEvent struct {
+	APIVersion      string        `json:"api_version"`
+	Seq             uint64        `json:"seq"`
+	CollectedAt     time.Time     `json:"collected_at"`
+	IntervalSeconds float64       `json:"interval_seconds"`
+	Rates           []CounterRate `json:"rates"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// ethtoolReaders keeps the ethtool statistics of each device resolved
+// between samples, so a sample is one ioctl per device instead of running
+// ethtool -S. A reader is resolved again when the device's net device or
+// the configured fields change, or after a read failed.
+type ethtoolReaders struct {
+	mu      sync.Mutex
+	devices map[string]*ethtoolReader
+}
+
+type ethtoolReader struct {
+	netDev string
+	fields []string
+	// nil when the net device has none of the fields
+	stats *ethtoolStats
+}
+
+// read passes the configured ethtool fields of devs to fn.
+func (r *ethtoolReaders) read(devs []IBDevice, linkLayers map[string]string, config EthtoolConfig, fn func(dev IBDevice, name string, value float64)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]bool{}
+	for _, dev := range devs {
+		var fields []string
+		if strings.Contains(linkLayers[dev.Name], "Ethernet") {
+			fields = config.EthernetFields
+		} else if strings.Contains(linkLayers[dev.Name], "InfiniBand") {
+			fields = config.InfiniBandFields
+		}
+		if !config.Enabled || dev.NetDev == "" || len(fields) == 0 {
+			continue
+		}
+		seen[dev.Name] = true
+		reader := r.devices[dev.Name]
+		if reader == nil || reader.netDev != dev.NetDev || !slices.Equal(reader.fields, fields) {
+			r.close(dev.Name)
+			wanted := stringSet(fields)
+			stats, err := openEthtoolStats(dev.NetDev, func(name string) bool { return wanted[name] })
+			if err != nil && !errors.Is(err, errNoEthtoolStats) {
+				log.Printf("Counter sample: %v", err)
+			}
+			reader = &ethtoolReader{netDev: dev.NetDev, fields: fields, stats: stats}
+			r.devices[dev.Name] = reader
+		}
+		if reader.stats == nil {
+			continue
+		}
+		if err := reader.stats.read(func(name string, value float64) { fn(dev, name, value) }); err != nil {
+			log.Printf("Counter sample: %v", err)
+			r.close(dev.Name)
+		}
+	}
+	for name := range r.devices {
+		if !seen[name] {
+			r.close(name)
+		}
+	}
+}
+
+func (r *ethtoolReaders) close(name string) {
+	if reader := r.devices[name]; reader != nil && reader.stats != nil {
+		reader.stats.close()
+	}
+	delete(r.devices, name)
+}
+
+// sampleLocalCounters reads the sysfs port counters, the configured ethtool
+// fields and the port states of the inventory without the logging of
+// GetIBCounter, which would flood the log at stream rates. On mlx5 the PFC
+// pause and discard counters exist only as ethtool statistics.
+func sampleLocalCounters() *Snapshot {
+	devs := localDevices()
+	snap := &Snapshot{Version: helperProtocolVersion, CollectedAt: time.Now(), PortStates: readPortStates(devs), PortSpeeds: readPortSpeeds(devs)}
+	var counterTypes []string
+	if cfg().Collectors.Counters {
+		counterTypes = append(counterTypes, "counters")
+	}
+	if cfg().Collectors.HWCounters {
+		counterTypes = append(counterTypes, "hw_counters")
+	}
+
+	linkLayers := map[string]string{}
+	for _, dev := range devs {
+		linkLayer := readSysfsString(path.Join(IBSYSPATH, dev.Name, "ports/1/link_layer"))
+		linkLayers[dev.Name] = linkLayer
+		for _, ct := range counterTypes {
+			dir := path.Join(IBSYSPATH, dev.Name, "ports/1", ct)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				content, err := os.ReadFile(path.Join(dir, entry.Name()))
+				if err != nil {
+					continue
+				}
+				value, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+				if err != nil {
+					continue
+				}
+				snap.Counters = append(snap.Counters, IBCounter{
+					IBDev:        dev.Name,
+					NetDev:       dev.NetDev,
+					DevLinkType:  linkLayer,
+					CounterName:  entry.Name(),
+					CounterValue: value,
+				})
+			}
+		}
+	}
+	streamEthtool.read(devs, linkLayers, cfg().Collectors.Ethtool, func(dev IBDevice, name string, value float64) {
+		snap.Counters = append(snap.Counters, IBCounter{
+			IBDev:        dev.Name,
+			NetDev:       dev.NetDev,
+			DevLinkType:  linkLayers[dev.Name],
+			CounterName:  name,
+			CounterValue: value,
+		})
+	})
+	return snap
+}
+
+// readPortStates maps "<device>/<port>" to the port's state, e.g. "ACTIVE",
+// for the devices of the inventory, which keeps the devices whose port is
+// down and drops the ones that are gone.
+func readPortStates(devs []IBDevice) map[string]string {
+	states := map[string]string{}
+	for _, dev := range devs {
+		for _, port := range listPorts(dev.Name) {
+			state := readSysfsString(path.Join(IBSYSPATH, dev.Name, "ports", port, "state"))
+			// "4: ACTIVE"
+			if _, s, ok := strings.Cut(state, ": "); ok {
+				state = s
+			}
+			if state != "" {
+				states[dev.Name+"/"+port] = state
+			}
+		}
+	}
+	return states
+}
+
+// readPortSpeeds maps the devices whose first port has a known rate to its
+// speed in Mb/s, the value of the portSpeed counter.
+func readPortSpeeds(devs []IBDevice) map[string]float64 {
+	speeds := map[string]float64{}
+	for _, dev := range devs {
+		if speed, ok := parsePortRate(readSysfsString(path.Join(IBSYSPATH, dev.Name, "ports/1/rate"))); ok {
+			speeds[dev.Name] = speed
+		}
+	}
+	return speeds
+}
+
+// sampleCounters reads the sysfs counters, port states and port speeds,
+// through the helper when one is configured.
+func sampleCounters() (*Snapshot, error) {
+	if socket := cfg().Helper.Socket; socket != "" {
+		return requestHelper(socket, helperMethodCounters)
+	}
+	return sampleLocalCounters(), nil
+}
+
+type streamClient struct {
+	selector counterSelector
+	events   chan StreamEvent
+	// closed by the sampler when it gives up on the client
+	dropped chan struct{}
+}
+
+type streamSampler struct {
+	interval time.Duration
+	clients  map[*streamClient]bool
+	stop     chan struct{}
+}
+
+type streamHub struct {
+	mu       sync.Mutex
+	samplers map[time.Duration]*streamSampler
+	clients  int
+}
+
+func (h *streamHub) subscribe(interval time.Duration, selector counterSelector) (*streamClient, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clients >= cfg().Stream.MaxClients {
+		return nil, errTooManyStreamClients
+	}
+	c := &streamClient{
+		selector: selector,
+		events:   make(chan StreamEvent, cfg().Stream.ClientBuffer),
+		dropped:  make(chan struct{}),
+	}
+	s, ok := h.samplers[interval]
+	if !ok {
+		s = &streamSampler{interval: interval, clients: map[*streamClient]bool{}, stop: make(chan struct{})}
+		h.samplers[interval] = s
+		go h.run(s)
+	}
+	s.clients[c] = true
+	h.clients++
+	streamClientsGauge.Set(float64(h.clients))
+	return c, nil
+}
+
+// remove detaches a client, stopping its sampler when it was the last one.
+// Callers hold h.mu.
+func (h *streamHub) remove(s *streamSampler, c *streamClient) {
+	if !s.clients[c] {
+		return
+	}
+	delete(s.clients, c)
+	h.clients--
+	streamClientsGauge.Set(float64(h.clients))
+	if len(s.clients) == 0 {
+		close(s.stop)
+		delete(h.samplers, s.interval)
+	}
+}
+
+func (h *streamHub) unsubscribe(interval time.Duration, c *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.samplers[interval]; ok {
+		h.remove(s, c)
+	}
+}
+
+func (h *streamHub) run(s *streamSampler) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var prev []IBCounter
+	var prevAt time.Time
+	var seq uint64
+	for {
+		var counters []IBCounter
+		var at time.Time
+		snap, err := sampleCounters()
+		if err == nil {
+			counters, at = snap.Counters, snap.CollectedAt
+		}
+		switch {
+		case err != nil:
+			seq++
+			h.broadcast(s, StreamEvent{APIVersion: apiVersion, Seq: seq, CollectedAt: time.Now(), Error: err.Error()})
+			prev = nil
+		case prev != nil:
+			seq++
+			seconds := at.Sub(prevAt).Seconds()
+			h.broadcast(s, StreamEvent{
+				APIVersion:      apiVersion,
+				Seq:             seq,
+				CollectedAt:     at,
+				IntervalSeconds: seconds,
+				Rates:           computeRates(prev, counters, seconds),
+			})
+			prev, prevAt = counters, at
+		default:
+			prev, prevAt = counters, at
+		}
+
+		// ticks missed while sampling are dropped by the ticker
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// broadcast never blocks: a client with a full buffer is dropped.
+func (h *streamHub) broadcast(s *streamSampler, ev StreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range s.clients {
+		clientEv := ev
+		clientEv.Rates = []CounterRate{}
+		for _, r := range ev.Rates {
+			if c.selector.match(r.IBDev, r.CounterName) {
+				clientEv.Rates = append(clientEv.Rates, r)
+			}
+		}
+		select {
+		case c.events <- clientEv:
+		default:
+			h.remove(s, c)
+			close(c.dropped)
+			streamDroppedCounter.Inc()
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// apiStreamHandler serves the live stream as server-sent events: a "sample"
+// event per interval and a final "dropped" event when the client fell behind.
+// Accepts device, name and interval.
+func apiStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	interval := streamDefaultInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		minInterval := cfg().Stream.MinInterval
+		if err != nil || d < minInterval || d > apiMaxRateWindow {
+			writeAPIError(w, http.StatusBadRequest, "interval must be a duration between %s and %s", minInterval, apiMaxRateWindow)
+			return
+		}
+		interval = d
+	}
+
+	client, err := streams.subscribe(interval, selectorFromRequest(r))
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "%v", err)
+		return
+	}
+	defer streams.unsubscribe(interval, client)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep reverse proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.dropped:
+			writeSSE(w, rc, "dropped", APIError{APIVersion: apiVersion, Error: "client too slow for the stream interval"})
+			return
+		case ev := <-client.events:
+			if err := writeSSE(w, rc, "sample", ev); err != nil {
+				return
+			}
+		}
+	}
+}
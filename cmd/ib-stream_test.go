@@ -0,0 +1,69 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestSamplePortStates(t *testing.T) {
+	root := t.TempDir()
+	writeSysfs(t, root, map[string]string{
+		"mlx5_0/ports/1/state": "4: ACTIVE\n",
+		"mlx5_1/ports/1/state": "1: DOWN\n",
+		"mlx5_2/ports/1/state": "4: ACTIVE\n",
+	})
+	useIBSysPath(t, root)
+	previous := inventory
+	inventory = NewDeviceInventory()
+	t.Cleanup(func() { inventory = previous })
+
+	dev := func(name string) IBDevice {
+		return IBDevice{Name: name, NodeGUID: "0c42:a103:0001:000" + name[len(name)-1:]}
+	}
+	for _, tc := range []struct {
+		name string
+		devs []IBDevice
+		want map[string]string
+	}{
+		// a port that is down is still read
+		{"down", []IBDevice{dev("mlx5_0"), dev("mlx5_1"), dev("mlx5_2")},
+			map[string]string{"mlx5_0/1": "ACTIVE", "mlx5_1/1": "DOWN", "mlx5_2/1": "ACTIVE"}},
+		// a device that is gone is not
+		{"removed", []IBDevice{dev("mlx5_0"), dev("mlx5_1")},
+			map[string]string{"mlx5_0/1": "ACTIVE", "mlx5_1/1": "DOWN"}},
+	} {
+		inventory.Update(tc.devs)
+		if got := sampleLocalCounters().PortStates; !maps.Equal(got, tc.want) {
+			t.Errorf("%s: port states %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSamplePortSpeeds(t *testing.T) {
+	root := t.TempDir()
+	rates := map[string]string{
+		"mlx5_0": "400 Gb/sec (4X NDR)\n",
+		"mlx5_1": "100 Gb/sec (2X HDR)\n",
+		"mlx5_2": "2.5 Gb/sec (1X SDR)\n",
+		"mlx5_3": "53.125 Gb/sec (1X HDR)\n",
+		"mlx5_4": "Invalid\n",
+		"mlx5_5": "",
+	}
+	files := map[string]string{}
+	var devs []IBDevice
+	for dev, rate := range rates {
+		files[dev+"/ports/1/rate"] = rate
+		devs = append(devs, IBDevice{Name: dev, NodeGUID: "0c42:a103:0001:000" + dev[len(dev)-1:]})
+	}
+	writeSysfs(t, root, files)
+	useIBSysPath(t, root)
+	previous := inventory
+	inventory = NewDeviceInventory()
+	inventory.Update(devs)
+	t.Cleanup(func() { inventory = previous })
+
+	want := map[string]float64{"mlx5_0": 400000, "mlx5_1": 100000, "mlx5_2": 2500, "mlx5_3": 53125}
+	if got := sampleLocalCounters().PortSpeeds; !maps.Equal(got, want) {
+		t.Errorf("port speeds %v, want %v", got, want)
+	}
+}
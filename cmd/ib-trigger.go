@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schedules and trigger rules start captures without anyone calling the API.
+// Both loops read the active configuration on every round, so a SIGHUP
+// reload takes effect without restarting them.
+const (
+	triggerIncrease        = "increase"
+	triggerRateAbove       = "rate_above"
+	triggerRateBelow       = "rate_below"
+	triggerThroughputBelow = "throughput_below"
+
+	triggerDefaultCooldown = 10 * time.Minute
+)
+
+var (
+	triggerConditions = map[string]bool{
+		triggerIncrease:        true,
+		triggerRateAbove:       true,
+		triggerRateBelow:       true,
+		triggerThroughputBelow: true,
+	}
+
+	captureTriggersCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ib_capture_triggers_fired_total",
+			Help: "Trigger rules whose condition held long enough to start a capture",
+		},
+		[]string{"rule"},
+	)
+)
+
+func (t CaptureTemplate) spec(c CaptureConfig) CaptureSpec {
+	spec := CaptureSpec{Duration: t.Duration, Interval: t.Interval, Devices: t.Devices, Counters: t.Counters, Sampler: t.Sampler}
+	if spec.Duration == 0 {
+		spec.Duration = c.Duration
+	}
+	if spec.Sampler == "" {
+		spec.Sampler = c.Sampler
+	}
+	if spec.Interval == 0 {
+		spec.Interval = max(c.Interval, c.minInterval(spec.Sampler))
+	}
+	groups := t.Groups
+	if len(groups) == 0 && len(t.Counters) == 0 {
+		groups = c.Groups
+	}
+	if len(groups) > 0 {
+		spec.setGroups(groups, c.minInterval)
+	}
+	return spec
+}
+
+func startAutomaticCapture(origin, rule, reason string, t CaptureTemplate) {
+	if _, err := captures.start(t.spec(cfg().Capture), origin, rule, reason); err != nil {
+		capturesSkippedCounter.WithLabelValues(origin).Inc()
+		log.Printf("Skipped capture of %s %s (%s): %v", origin, rule, reason, err)
+	}
+}
+
+// runCaptureScheduler wakes up at the start of every minute and starts the
+// captures whose cron expression matches it.
+func runCaptureScheduler() {
+	for {
+		minute := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(minute))
+		for _, s := range cfg().Capture.Schedules {
+			if s.schedule.matches(minute) {
+				startAutomaticCapture(captureOriginSchedule, s.Name, "cron "+s.Cron, s.CaptureTemplate)
+			}
+		}
+	}
+}
+
+func (t TriggerConfig) matches(IBDev, counter string) bool {
+	if t.device != nil && !t.device.MatchString(IBDev) {
+		return false
+	}
+	return t.counter.MatchString(counter)
+}
+
+func (t TriggerConfig) cooldown() time.Duration {
+	if t.Cooldown == 0 {
+		return triggerDefaultCooldown
+	}
+	return t.Cooldown
+}
+
+// triggerState remembers the previous check and since when each condition
+// has held, keyed by rule, device and counter.
+type triggerState struct {
+	prev      map[string]float64
+	prevAt    time.Time
+	holding   map[string]time.Time
+	lastFired map[string]time.Time
+	// "<rule>/<device>" of the throughput rules logged for a device
+	// without a port speed
+	noSpeed map[string]bool
+}
+
+// conditions returns the keys of the rule's conditions that hold in this
+// check, with a description of each.
+func (st *triggerState) conditions(t TriggerConfig, counters []IBCounter, seconds float64) map[string]string {
+	held := map[string]string{}
+	if t.Condition == triggerThroughputBelow {
+		gbps := map[string]float64{}
+		speed := map[string]float64{}
+		for _, c := range counters {
+			if c.CounterName == "portSpeed" {
+				// Mb/s
+				speed[c.IBDev] = c.CounterValue / 1000
+			}
+			unit := counterBytesPerUnit(c.CounterName)
+			before, ok := st.prev[c.IBDev+"/"+c.CounterName]
+			if unit == 0 || !ok || c.CounterValue < before || !t.matches(c.IBDev, c.CounterName) {
+				continue
+			}
+			gbps[c.IBDev] += (c.CounterValue - before) * unit * 8 / seconds / 1e9
+		}
+		for dev, g := range gbps {
+			if speed[dev] <= 0 {
+				if key := t.Name + "/" + dev; !st.noSpeed[key] {
+					if st.noSpeed == nil {
+						st.noSpeed = map[string]bool{}
+					}
+					st.noSpeed[key] = true
+					log.Printf("Capture trigger %s: port speed of %s unknown, its throughput is not checked", t.Name, dev)
+				}
+				continue
+			}
+			if percent := g / speed[dev] * 100; percent < t.Threshold {
+				held[t.Name+"/"+dev] = fmt.Sprintf("%s throughput %.2f Gb/s is %.1f%% of %.0f Gb/s, below %.1f%%", dev, g, percent, speed[dev], t.Threshold)
+			}
+		}
+		return held
+	}
+
+	for _, c := range counters {
+		if !t.matches(c.IBDev, c.CounterName) {
+			continue
+		}
+		before, ok := st.prev[c.IBDev+"/"+c.CounterName]
+		if !ok || (c.CounterValue < before && !isGaugeCounter(c.CounterName)) {
+			continue
+		}
+		delta := c.CounterValue - before
+		key := t.Name + "/" + c.IBDev + "/" + c.CounterName
+		switch t.Condition {
+		case triggerIncrease:
+			if delta > t.Threshold {
+				held[key] = fmt.Sprintf("%s %s increased by %g", c.IBDev, c.CounterName, delta)
+			}
+		case triggerRateAbove:
+			if rate := delta / seconds; rate > t.Threshold {
+				held[key] = fmt.Sprintf("%s %s at %.2f/s, above %g/s", c.IBDev, c.CounterName, rate, t.Threshold)
+			}
+		case triggerRateBelow:
+			if rate := delta / seconds; rate < t.Threshold {
+				held[key] = fmt.Sprintf("%s %s at %.2f/s, below %g/s", c.IBDev, c.CounterName, rate, t.Threshold)
+			}
+		}
+	}
+	return held
+}
+
+func (st *triggerState) check(triggers []TriggerConfig, counters []IBCounter, now time.Time) {
+	seconds := now.Sub(st.prevAt).Seconds()
+	holding := map[string]time.Time{}
+	for _, t := range triggers {
+		held := st.conditions(t, counters, seconds)
+		keys := make([]string, 0, len(held))
+		for key := range held {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fired := false
+		for _, key := range keys {
+			since, ok := st.holding[key]
+			if !ok {
+				since = now
+			}
+			holding[key] = since
+			if fired || now.Sub(since) < t.For || now.Sub(st.lastFired[t.Name]) < t.cooldown() {
+				continue
+			}
+			fired = true
+			st.lastFired[t.Name] = now
+			captureTriggersCounter.WithLabelValues(t.Name).Inc()
+			reason := held[key]
+			if t.For > 0 {
+				reason += fmt.Sprintf(" for %s", now.Sub(since).Round(time.Millisecond))
+			}
+			log.Printf("Capture trigger %s fired: %s", t.Name, reason)
+			startAutomaticCapture(captureOriginTrigger, t.Name, reason, t.CaptureTemplate)
+			// the capture only starts now, the recorder has what led up to it
+			go dumpRecorder(recorderCauseTrigger, t.Name, reason)
+		}
+	}
+	st.holding = holding
+}
+
+// triggerCounters are the sampled counters plus the port speeds as portSpeed
+// counters.
+func triggerCounters(snap *Snapshot) []IBCounter {
+	counters := slices.Clip(snap.Counters)
+	for dev, speed := range snap.PortSpeeds {
+		counters = append(counters, IBCounter{IBDev: dev, CounterName: "portSpeed", CounterValue: speed})
+	}
+	return counters
+}
+
+// runCaptureTriggers samples the counters every trigger interval while any
+// trigger rule is configured and evaluates the rules against the change
+// since the previous sample. The rules see what the stream and the flight
+// recorder sample, the sysfs counters, the ethtool fields and portSpeed,
+// without running the commands of a full collection.
+func runCaptureTriggers() {
+	st := &triggerState{holding: map[string]time.Time{}, lastFired: map[string]time.Time{}}
+	for {
+		time.Sleep(cfg().Capture.TriggerInterval)
+		triggers := cfg().Capture.Triggers
+		if len(triggers) == 0 {
+			st.prev = nil
+			continue
+		}
+		snap, err := sampleCounters()
+		if err != nil {
+			log.Printf("Capture trigger sample failed: %v", err)
+			continue
+		}
+		counters, now := triggerCounters(snap), snap.CollectedAt
+		if st.prev != nil {
+			st.check(triggers, counters, now)
+		}
+		st.prev = make(map[string]float64, len(counters))
+		for _, c := range counters {
+			st.prev[c.IBDev+"/"+c.CounterName] = c.CounterValue
+		}
+		st.prevAt = now
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func testTrigger(name, device, counter, condition string, threshold float64) TriggerConfig {
+	t := TriggerConfig{Name: name, Device: device, Counter: counter, Condition: condition, Threshold: threshold}
+	t.counter = regexp.MustCompile("^(?:" + counter + ")$")
+	if device != "" {
+		t.device = regexp.MustCompile("^(?:" + device + ")$")
+	}
+	return t
+}
+
+func TestTriggerConditions(t *testing.T) {
+	// a Gb/s of port_rcv_data over the 2s between the checks
+	gbit := 1e9 / 8 / apiInfiniBandDataUnit * 2
+	prev := map[string]float64{
+		"mlx5_0/rx_prio3_discards": 10,
+		"mlx5_1/rx_prio3_discards": 10,
+		"mlx5_0/rx_prio5_discards": 10,
+		"mlx5_0/np_cnp_sent":       100,
+		"mlx5_0/QPNum":             50,
+		"mlx5_0/port_rcv_data":     1000,
+		"mlx5_0/port_xmit_data":    1000,
+		"mlx5_1/port_rcv_data":     1000,
+		"mlx5_2/port_rcv_data":     1000,
+	}
+	counters := []IBCounter{
+		{IBDev: "mlx5_0", CounterName: "rx_prio3_discards", CounterValue: 15},
+		{IBDev: "mlx5_1", CounterName: "rx_prio3_discards", CounterValue: 10},
+		// reset by the driver
+		{IBDev: "mlx5_0", CounterName: "rx_prio5_discards", CounterValue: 2},
+		// not seen in the previous check
+		{IBDev: "mlx5_1", CounterName: "rx_prio5_discards", CounterValue: 50},
+		{IBDev: "mlx5_0", CounterName: "np_cnp_sent", CounterValue: 300},
+		// a gauge going down is not a reset
+		{IBDev: "mlx5_0", CounterName: "QPNum", CounterValue: 10},
+		{IBDev: "mlx5_0", CounterName: "portSpeed", CounterValue: 100000},
+		{IBDev: "mlx5_0", CounterName: "port_rcv_data", CounterValue: 1000 + 5*gbit},
+		{IBDev: "mlx5_0", CounterName: "port_xmit_data", CounterValue: 1000 + 10*gbit},
+		{IBDev: "mlx5_1", CounterName: "portSpeed", CounterValue: 100000},
+		{IBDev: "mlx5_1", CounterName: "port_rcv_data", CounterValue: 1000 + 50*gbit},
+		// no speed, no percentage
+		{IBDev: "mlx5_2", CounterName: "port_rcv_data", CounterValue: 1000},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		trigger TriggerConfig
+		want    []string
+	}{
+		{"increase", testTrigger("r", "", "rx_prio(3|5)_discards", triggerIncrease, 0),
+			[]string{"r/mlx5_0/rx_prio3_discards"}},
+		{"increase above threshold", testTrigger("r", "", "rx_prio3_discards", triggerIncrease, 5),
+			nil},
+		{"increase on a device", testTrigger("r", "mlx5_1", "rx_prio3_discards", triggerIncrease, -1),
+			[]string{"r/mlx5_1/rx_prio3_discards"}},
+		{"rate above", testTrigger("r", "", "np_cnp_sent", triggerRateAbove, 99),
+			[]string{"r/mlx5_0/np_cnp_sent"}},
+		{"rate not above", testTrigger("r", "", "np_cnp_sent", triggerRateAbove, 100),
+			nil},
+		{"rate below", testTrigger("r", "", "np_cnp_sent|rx_prio3_discards", triggerRateBelow, 1),
+			[]string{"r/mlx5_1/rx_prio3_discards"}},
+		{"gauge rate below", testTrigger("r", "", "QPNum", triggerRateBelow, 0),
+			[]string{"r/mlx5_0/QPNum"}},
+		// 15 of 100 Gb/s on mlx5_0, 50 on mlx5_1
+		{"throughput below", testTrigger("r", "", "port_(rcv|xmit)_data", triggerThroughputBelow, 20),
+			[]string{"r/mlx5_0"}},
+		{"throughput not below", testTrigger("r", "", "port_(rcv|xmit)_data", triggerThroughputBelow, 15),
+			nil},
+		{"throughput of one counter", testTrigger("r", "", "port_xmit_data", triggerThroughputBelow, 15),
+			[]string{"r/mlx5_0"}},
+		{"throughput on a device", testTrigger("r", "mlx5_1", "port_rcv_data", triggerThroughputBelow, 60),
+			[]string{"r/mlx5_1"}},
+	} {
+		st := &triggerState{prev: prev}
+		held := st.conditions(tc.trigger, counters, 2)
+		if got := slices.Sorted(maps.Keys(held)); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: conditions hold for %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// The sampled counters carry the port speeds beside the counters.
+func TestTriggerThroughputSampled(t *testing.T) {
+	// 10 Gb/s of port_rcv_data over 2s
+	delta := 10 * 1e9 / 8 / apiInfiniBandDataUnit * 2
+	st := &triggerState{prev: map[string]float64{"mlx5_0/port_rcv_data": 1000, "mlx5_1/port_rcv_data": 1000}}
+	snap := &Snapshot{
+		Counters: []IBCounter{
+			{IBDev: "mlx5_0", CounterName: "port_rcv_data", CounterValue: 1000 + delta},
+			{IBDev: "mlx5_1", CounterName: "port_rcv_data", CounterValue: 1000 + delta},
+		},
+		// mlx5_1's rate is unknown
+		PortSpeeds: map[string]float64{"mlx5_0": 100000},
+	}
+	held := st.conditions(testTrigger("r", "", "port_rcv_data", triggerThroughputBelow, 20), triggerCounters(snap), 2)
+	if got, want := slices.Sorted(maps.Keys(held)), []string{"r/mlx5_0"}; !slices.Equal(got, want) {
+		t.Errorf("conditions hold for %q, want %q", got, want)
+	}
+	if !st.noSpeed["r/mlx5_1"] {
+		t.Error("device without a port speed not noted")
+	}
+}
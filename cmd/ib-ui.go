@@ -0,0 +1,30 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is plain HTML and JavaScript without external assets, so it
+// works on isolated clusters. It only talks to the JSON API and the stream,
+// through relative URLs, and keeps working behind a path-prefixing proxy.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
+
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "ui/", http.StatusFound)
+}
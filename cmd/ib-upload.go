@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_uploads_total",
+		Help: "Capture archives uploaded and verified",
+	})
+	uploadFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_upload_failures_total",
+		Help: "Capture archive uploads that failed after all retries",
+	})
+	uploadRetriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_upload_retries_total",
+		Help: "Capture archive upload attempts that were retried",
+	})
+	uploadBytesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ib_upload_bytes_total",
+		Help: "Bytes of capture archives uploaded",
+	})
+	uploadLastSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ib_upload_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful upload",
+	})
+)
+
+// uploadWake starts an upload pass right away, archiveCaptures sends to it.
+var uploadWake = make(chan struct{}, 1)
+
+// An archive that was uploaded and kept gets a marker file next to it, so
+// that neither a restarted daemon nor the next -runonce uploads it again.
+const uploadMarkerExtension = ".uploaded"
+
+// uploadMarker is the content of a marker: where the archive went and the
+// size and time it had then. A marker that doesn't match the archive or its
+// key any more is ignored.
+type uploadMarker struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// uploadedBefore reports whether a marker says the archive was uploaded to
+// key as it is now.
+func uploadedBefore(path, key string, stat os.FileInfo) bool {
+	content, err := os.ReadFile(path + uploadMarkerExtension)
+	if err != nil {
+		return false
+	}
+	var m uploadMarker
+	if err := json.Unmarshal(content, &m); err != nil {
+		return false
+	}
+	return m.Key == key && m.Size == stat.Size() && m.ModTime.Equal(stat.ModTime())
+}
+
+// writeUploadMarker records that the archive was uploaded to key. It is
+// written under a temporary name and renamed, so a marker is never partial.
+func writeUploadMarker(path, key string, stat os.FileInfo) error {
+	content, err := json.Marshal(uploadMarker{Key: key, Size: stat.Size(), ModTime: stat.ModTime(), UploadedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	tmpPath := path + uploadMarkerExtension + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path+uploadMarkerExtension)
+}
+
+func wakeUploader() {
+	select {
+	case uploadWake <- struct{}{}:
+	default:
+	}
+}
+
+// uploadCredentials are the configured keys, or the AWS_* environment
+// variables when the config has none.
+type uploadCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+func (c UploadConfig) credentials() uploadCredentials {
+	if c.AccessKeyID != "" {
+		return uploadCredentials{accessKeyID: c.AccessKeyID, secretAccessKey: c.SecretAccessKey}
+	}
+	return uploadCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func (c UploadConfig) nodeName() string {
+	if c.NodeName != "" {
+		return c.NodeName
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// objectKey is key_prefix with {node}, {date} and {timestamp} filled in,
+// followed by the archive's name. The times are the archive's in UTC.
+func (c UploadConfig) objectKey(archive string, modTime time.Time) string {
+	t := modTime.UTC()
+	prefix := strings.NewReplacer(
+		"{node}", c.nodeName(),
+		"{date}", t.Format("2006-01-02"),
+		"{timestamp}", t.Format("20060102_150405"),
+	).Replace(c.KeyPrefix)
+	return prefix + filepath.Base(archive)
+}
+
+// s3Escape escapes an object key for a request path and its SigV4 canonical
+// form, everything but the unreserved characters and "/".
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// objectURL is the URL of the object and its escaped path, path style or
+// virtual hosted style.
+func (c UploadConfig) objectURL(key string) (*url.URL, string, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Endpoint, "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	escaped := u.Path + "/" + s3Escape(key)
+	if c.PathStyle {
+		escaped = u.Path + "/" + s3Escape(c.Bucket) + "/" + s3Escape(key)
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+	}
+	u, err = url.Parse(u.Scheme + "://" + u.Host + escaped)
+	return u, escaped, err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3Request signs req with AWS Signature Version 4. All x-amz-* and
+// content-* headers are signed along with the host.
+func signS3Request(req *http.Request, escapedPath, payloadHash, region string, creds uploadCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || strings.HasPrefix(name, "content-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, escapedPath, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+// errUploadPermanent marks errors that retrying won't fix, like a denied
+// request.
+var errUploadPermanent = errors.New("not retried")
+
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", errUploadPermanent, err)
+	}
+	return err
+}
+
+// fileDigests returns the size, SHA-256 and MD5 of a file.
+func fileDigests(path string) (int64, []byte, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer f.Close()
+	sha, md := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(sha, md), f)
+	return size, sha.Sum(nil), md.Sum(nil), err
+}
+
+// putArchive uploads an archive once and verifies it with a HEAD request:
+// S3 checks the body against the signed SHA-256 and Content-MD5, and the
+// object must have the size and the sha256 metadata that were sent.
+func putArchive(ctx context.Context, c UploadConfig, path, key string, size int64, sha, md []byte) error {
+	u, escapedPath, err := c.objectURL(key)
+	if err != nil {
+		return fmt.Errorf("%w: endpoint: %w", errUploadPermanent, err)
+	}
+	creds := c.credentials()
+	client := &http.Client{Timeout: c.Timeout}
+	shaHex := hex.EncodeToString(sha)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUploadPermanent, err)
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md))
+	req.Header.Set("X-Amz-Meta-Sha256", shaHex)
+	signS3Request(req, escapedPath, shaHex, c.Region, creds, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	emptyHash := sha256.Sum256(nil)
+	req, err = http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	signS3Request(req, escapedPath, hex.EncodeToString(emptyHash[:]), c.Region, creds, time.Now())
+	resp, err = client.Do(req)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("verify: %s", resp.Status)
+	}
+	if resp.ContentLength != size || resp.Header.Get("X-Amz-Meta-Sha256") != shaHex {
+		return fmt.Errorf("verify: object has %d bytes and sha256 %q, uploaded %d bytes with %s",
+			resp.ContentLength, resp.Header.Get("X-Amz-Meta-Sha256"), size, shaHex)
+	}
+	return nil
+}
+
+// uploadArchive uploads an archive, retrying with exponential backoff.
+func uploadArchive(ctx context.Context, c UploadConfig, path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	size, sha, md, err := fileDigests(path)
+	if err != nil {
+		return "", err
+	}
+	key := c.objectKey(path, stat.ModTime())
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		// an attempt that started is completed, only retries are cancelled
+		err = putArchive(context.WithoutCancel(ctx), c, path, key, size, sha, md)
+		if err == nil {
+			uploadBytesCounter.Add(float64(size))
+			return key, nil
+		}
+		if errors.Is(err, errUploadPermanent) || attempt >= c.Retries || ctx.Err() != nil {
+			return key, err
+		}
+		log.Printf("Upload of %s failed, retrying in %s: %v", filepath.Base(path), backoff, err)
+		uploadRetriesCounter.Inc()
+		select {
+		case <-ctx.Done():
+			return key, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// uploadArchives uploads the archives next to the data directory that
+// weren't uploaded before, oldest first.
+func uploadArchives(ctx context.Context) {
+	c := cfg().Upload
+	if !c.Enabled {
+		return
+	}
+	archiveDir := filepath.Dir(cfg().Capture.DataPath)
+	matches, err := filepath.Glob(filepath.Join(archiveDir, archivePrefix+"*"))
+	if err != nil {
+		log.Printf("Could not list archives to upload: %v", err)
+		return
+	}
+	sort.Strings(matches)
+	for _, path := range matches {
+		if ctx.Err() != nil {
+			return
+		}
+		if !isArchiveFile(path) {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if uploadedBefore(path, c.objectKey(path, stat.ModTime()), stat) {
+			continue
+		}
+		key, err := uploadArchive(ctx, c, path)
+		if err != nil {
+			uploadFailuresCounter.Inc()
+			log.Printf("Upload of %s to s3://%s/%s failed: %v", filepath.Base(path), c.Bucket, key, err)
+			continue
+		}
+		uploadsCounter.Inc()
+		uploadLastSuccessGauge.SetToCurrentTime()
+		log.Printf("Uploaded %s to s3://%s/%s", filepath.Base(path), c.Bucket, key)
+		if !c.DeleteAfterUpload {
+			if err := writeUploadMarker(path, key, stat); err != nil {
+				log.Printf("Could not record the upload of %s, it will be uploaded again: %v", filepath.Base(path), err)
+			}
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Could not delete uploaded archive %s: %v", path, err)
+		}
+		os.Remove(path + uploadMarkerExtension)
+	}
+	// markers of archives that are gone, e.g. deleted by hand
+	markers, _ := filepath.Glob(filepath.Join(archiveDir, archivePrefix+"*"+uploadMarkerExtension))
+	for _, marker := range markers {
+		if _, err := os.Stat(strings.TrimSuffix(marker, uploadMarkerExtension)); os.IsNotExist(err) {
+			os.Remove(marker)
+		}
+	}
+}
+
+// runUploader uploads finished archives right away and then every
+// upload.interval or when an archive was created, until ctx is done.
+func runUploader(ctx context.Context) {
+	for {
+		// archives created until now are picked up by this pass
+		select {
+		case <-uploadWake:
+		default:
+		}
+		uploadArchives(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-uploadWake:
+		case <-time.After(cfg().Upload.Interval):
+		}
+	}
+}
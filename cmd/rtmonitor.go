@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path"
-	"sort"
 	"strings"
 	"time"
 
@@ -129,10 +128,7 @@ func initialModel() model {
 		}
 	}
 
-	discoveredDevices := GetIBDev()
-	sort.Strings(discoveredDevices)
-
-	initialRows, initialMetrics := updateAndCalculateRates(make(map[string]DeviceMetrics), discoveredDevices)
+	initialRows, initialMetrics, discoveredDevices := updateAndCalculateRates(make(map[string]DeviceMetrics))
 
 	initialTableWidth := 120
 	initialColumns := recalculateColumnWidths(columnWeights, initialTableWidth)
@@ -157,12 +153,17 @@ func initialModel() model {
 	}
 }
 
-func updateAndCalculateRates(previousMetrics map[string]DeviceMetrics, deviceOrder []string) ([]table.Row, map[string]DeviceMetrics) {
+// updateAndCalculateRates 每次都按最新的设备清单生成表格行，热插拔或重命名的设备会实时增删
+func updateAndCalculateRates(previousMetrics map[string]DeviceMetrics) ([]table.Row, map[string]DeviceMetrics, []string) {
 	newRows := []table.Row{}
 	newMetricsMap := make(map[string]DeviceMetrics)
 
 	allCounters := GetAllIBCounter()
 	currentTime := time.Now()
+	deviceOrder := inventory.Names()
+	if len(allCounters) == 0 {
+		return newRows, newMetricsMap, deviceOrder
+	}
 
 	currentRawMetrics := make(map[string]DeviceMetrics)
 	for _, c := range allCounters {
@@ -316,11 +317,11 @@ func updateAndCalculateRates(previousMetrics map[string]DeviceMetrics, deviceOrd
 		}
 	}
 
-	return newRows, newMetricsMap
+	return newRows, newMetricsMap, deviceOrder
 }
 
 func tickCmd() tea.Cmd {
-	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
+	return tea.Tick(cfg().Monitor.Interval, func(t time.Time) tea.Msg {
 		return tickMsg(t)
 	})
 }
@@ -347,9 +348,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case tickMsg:
-		newRows, newMetrics := updateAndCalculateRates(m.devices, m.deviceOrder)
+		newRows, newMetrics, newOrder := updateAndCalculateRates(m.devices)
 		m.tbl.SetRows(newRows)
+		if m.tbl.Cursor() >= len(newRows) && len(newRows) > 0 {
+			m.tbl.SetCursor(len(newRows) - 1)
+		}
 		m.devices = newMetrics
+		m.deviceOrder = newOrder
 		return m, tickCmd()
 	}
 
@@ -0,0 +1,351 @@
+// ib-exporter dashboard. The tables poll /api/v1/counters, which runs a full
+// collection like the -monitor TUI does; the charts follow /api/v1/stream.
+"use strict";
+
+const API = "../api/v1/";
+const POLL_MS = 2000;
+const HISTORY_POINTS = 300;
+const DATA_WORD_BYTES = 4; // port_rcv_data and port_xmit_data count 4-byte words
+
+const ERROR_COUNTER = /err|discard|drop|out_of_sequence|downed|recovery|timeout|retry_exceeded|duplicate_request|local_ack/;
+const GAUGE_COUNTER = /^(portSpeed|QPNum|MRNum|module_)/;
+
+// the same columns as the rtmonitor table, per link layer
+const COLUMNS = {
+  Ethernet: [
+    ["Speed", (d) => gauge(d, "portSpeed")],
+    ["Queue 0 RX(Gbps)", (d) => gbps(d, "rx_prio0_bytes", 1)],
+    ["Queue 0 TX(Gbps)", (d) => gbps(d, "tx_prio0_bytes", 1)],
+    ["Q0 Discard", (d) => delta(d, "rx_prio0_discards")],
+    ["Queue 5 RX(Gbps)", (d) => gbps(d, "rx_prio5_bytes", 1)],
+    ["Queue 5 TX(Gbps)", (d) => gbps(d, "tx_prio5_bytes", 1)],
+    ["Q5 Discard", (d) => delta(d, "rx_prio5_discards")],
+    ["OOS", (d) => delta(d, "out_of_sequence")],
+    ["QP Num", (d) => gauge(d, "QPNum")],
+    ["MR Num", (d) => gauge(d, "MRNum")],
+    ["RX Pause", (d) => gauge(d, "rx_prio5_pause")],
+    ["TX Pause", (d) => gauge(d, "tx_prio5_pause")],
+    ["NP CNP Sent", (d) => gauge(d, "np_cnp_sent")],
+    ["RP CNP Handled", (d) => gauge(d, "rp_cnp_handled")],
+  ],
+  InfiniBand: [
+    ["Speed", (d) => gauge(d, "portSpeed")],
+    ["RX(Gbps)", (d) => gbps(d, "port_rcv_data", DATA_WORD_BYTES)],
+    ["TX(Gbps)", (d) => gbps(d, "port_xmit_data", DATA_WORD_BYTES)],
+    ["OOS", (d) => delta(d, "out_of_sequence")],
+    ["QP Num", (d) => gauge(d, "QPNum")],
+    ["MR Num", (d) => gauge(d, "MRNum")],
+  ],
+};
+
+const state = {
+  current: null, // latest /api/v1/counters response
+  previous: null,
+  devices: [], // /api/v1/devices
+  history: {}, // device -> {t: [], rx: [], tx: []} in Gbps, from the stream
+  stream: null,
+};
+
+function esc(s) {
+  return String(s).replace(/[&<>"']/g, (c) => "&#" + c.charCodeAt(0) + ";");
+}
+
+function fmt(v, digits) {
+  if (v === undefined || v === null || Number.isNaN(v)) {
+    return "-";
+  }
+  return Number.isInteger(v) && digits === undefined ? String(v) : v.toFixed(digits === undefined ? 2 : digits);
+}
+
+// per-device view of the two latest polls
+function deviceView(name) {
+  const cur = {};
+  const prev = {};
+  let linkType = "";
+  let netDev = "";
+  for (const c of state.current ? state.current.counters : []) {
+    if (c.ib_dev === name) {
+      cur[c.counter_name] = c.counter_value;
+      linkType = c.dev_link_type;
+      netDev = c.net_dev;
+    }
+  }
+  for (const c of state.previous ? state.previous.counters : []) {
+    if (c.ib_dev === name) {
+      prev[c.counter_name] = c.counter_value;
+    }
+  }
+  let seconds = 0;
+  if (state.current && state.previous) {
+    seconds = (Date.parse(state.current.collected_at) - Date.parse(state.previous.collected_at)) / 1000;
+  }
+  return { name, cur, prev, seconds, linkType, netDev };
+}
+
+function gauge(d, name) {
+  return { text: fmt(d.cur[name]) };
+}
+
+function deltaOf(d, name) {
+  if (!(name in d.cur) || !(name in d.prev) || d.cur[name] < d.prev[name]) {
+    return undefined;
+  }
+  return d.cur[name] - d.prev[name];
+}
+
+function delta(d, name) {
+  const v = deltaOf(d, name);
+  return { text: fmt(v), error: v > 0 && ERROR_COUNTER.test(name) };
+}
+
+function gbps(d, name, bytesPerUnit) {
+  const v = deltaOf(d, name);
+  if (v === undefined || d.seconds <= 0) {
+    return { text: "-" };
+  }
+  return { text: fmt((v * bytesPerUnit * 8) / d.seconds / 1e9, 2) };
+}
+
+function hasNewErrors(d) {
+  return Object.keys(d.cur).some((name) => ERROR_COUNTER.test(name) && deltaOf(d, name) > 0);
+}
+
+function deviceNames() {
+  const names = new Set();
+  for (const c of state.current ? state.current.counters : []) {
+    names.add(c.ib_dev);
+  }
+  return [...names].sort();
+}
+
+function renderOverview(app) {
+  const byType = {};
+  for (const name of deviceNames()) {
+    const d = deviceView(name);
+    (byType[d.linkType] = byType[d.linkType] || []).push(d);
+  }
+  const time = state.current ? new Date(state.current.collected_at).toLocaleTimeString() : "";
+
+  let html = "";
+  for (const [linkType, devs] of Object.entries(byType)) {
+    const columns = COLUMNS[linkType] || COLUMNS.InfiniBand;
+    html += `<section><h2>${esc(linkType || "Unknown")} devices</h2><table><tr><th>Device</th>`;
+    html += columns.map(([title]) => `<th>${esc(title)}</th>`).join("") + "<th>Time</th></tr>";
+    for (const d of devs) {
+      html += `<tr class="${hasNewErrors(d) ? "errors" : ""}"><td><a href="#/device/${encodeURIComponent(d.name)}">${esc(d.name)}</a></td>`;
+      for (const [, cell] of columns) {
+        const v = cell(d);
+        html += `<td class="${v.error ? "errors" : ""}">${esc(v.text)}</td>`;
+      }
+      html += `<td>${esc(time)}</td></tr>`;
+    }
+    html += "</table></section>";
+  }
+  if (!html) {
+    html = `<section class="muted">${state.current ? "No devices found." : "Loading…"}</section>`;
+  }
+
+  html += '<section><h2>Throughput</h2><div class="charts">';
+  for (const name of deviceNames()) {
+    html += chartHTML(name);
+  }
+  html += "</div></section>";
+  app.innerHTML = html;
+  drawCharts();
+}
+
+function chartHTML(name) {
+  return `<div class="chart"><h3><a href="#/device/${encodeURIComponent(name)}">${esc(name)}</a>
+    <span class="legend"><span class="rx">■ RX</span><span class="tx">■ TX</span></span></h3>
+    <canvas data-device="${esc(name)}"></canvas></div>`;
+}
+
+function renderDevice(app, name) {
+  const d = deviceView(name);
+  const dev = state.devices.find((x) => x.name === name);
+  let html = `<p><a href="#/">← all devices</a></p>`;
+
+  html += `<section><h2>${esc(name)}</h2><dl>`;
+  const fields = [["Link layer", d.linkType], ["Netdev", d.netDev]];
+  if (dev) {
+    fields.push(["Node GUID", dev.node_guid], ["Driver", dev.driver], ["PCI", `${dev.bdf} (${dev.pci_vendor}:${dev.pci_device})`],
+      ["Function", dev.function + (dev.parent_pf ? ` of ${dev.parent_pf}` : "")]);
+    if (dev.identity) {
+      fields.push(["Firmware", dev.identity.fw_ver], ["HCA type", dev.identity.hca_type], ["Board ID", dev.identity.board_id],
+        ["Node description", dev.identity.node_desc], ["NUMA node", dev.identity.numa_node]);
+    }
+  }
+  html += fields.map(([k, v]) => `<dt>${esc(k)}</dt><dd>${esc(v || "-")}</dd>`).join("") + "</dl></section>";
+
+  if (dev && dev.identity && dev.identity.ports) {
+    html += "<section><h2>Ports</h2><table><tr><th>Port</th><th>LID</th><th>SM LID</th><th>Link layer</th><th>Port GUID</th><th>RoCE GIDs</th></tr>";
+    for (const p of dev.identity.ports) {
+      html += `<tr><td>${esc(p.port)}</td><td>${esc(p.lid)}</td><td>${esc(p.sm_lid)}</td><td>${esc(p.link_layer)}</td>
+        <td>${esc(p.port_guid)}</td><td>${esc((p.roce_gids || []).join(", "))}</td></tr>`;
+    }
+    html += "</table></section>";
+  }
+
+  html += `<section><h2>Throughput</h2><div class="charts">${chartHTML(name)}</div></section>`;
+
+  html += "<section><h2>Counters</h2><table><tr><th>Counter</th><th>Value</th><th>Delta</th><th>Per second</th></tr>";
+  for (const counter of Object.keys(d.cur).sort()) {
+    const isGauge = GAUGE_COUNTER.test(counter);
+    const v = isGauge ? undefined : deltaOf(d, counter);
+    const rate = v !== undefined && d.seconds > 0 ? v / d.seconds : undefined;
+    const error = ERROR_COUNTER.test(counter) && v > 0;
+    html += `<tr class="${error ? "errors" : ""}"><td>${esc(counter)}</td><td>${esc(fmt(d.cur[counter]))}</td>
+      <td>${esc(fmt(v))}</td><td>${esc(fmt(rate))}</td></tr>`;
+  }
+  html += "</table></section>";
+  app.innerHTML = html;
+  drawCharts();
+}
+
+function render() {
+  const app = document.getElementById("app");
+  const m = location.hash.match(/^#\/device\/(.+)$/);
+  if (m) {
+    renderDevice(app, decodeURIComponent(m[1]));
+  } else {
+    renderOverview(app);
+  }
+}
+
+function drawCharts() {
+  for (const canvas of document.querySelectorAll("canvas[data-device]")) {
+    drawChart(canvas, state.history[canvas.dataset.device]);
+  }
+}
+
+function drawChart(canvas, h) {
+  const ratio = window.devicePixelRatio || 1;
+  const width = canvas.clientWidth;
+  const height = canvas.clientHeight;
+  canvas.width = width * ratio;
+  canvas.height = height * ratio;
+  const ctx = canvas.getContext("2d");
+  ctx.scale(ratio, ratio);
+  ctx.clearRect(0, 0, width, height);
+  ctx.font = "11px system-ui, sans-serif";
+  ctx.fillStyle = "#6b7280";
+  if (!h || h.t.length < 2) {
+    ctx.fillText("waiting for stream…", 8, 16);
+    return;
+  }
+
+  const max = Math.max(...h.rx, ...h.tx, 0.001);
+  const t0 = h.t[0];
+  const span = h.t[h.t.length - 1] - t0 || 1;
+  const left = 48;
+  const plotWidth = width - left - 4;
+  const plotHeight = height - 20;
+  const x = (t) => left + ((t - t0) / span) * plotWidth;
+  const y = (v) => 4 + plotHeight - (v / max) * plotHeight;
+
+  ctx.strokeStyle = "#eceef1";
+  ctx.beginPath();
+  ctx.moveTo(left, y(0));
+  ctx.lineTo(width - 4, y(0));
+  ctx.moveTo(left, y(max));
+  ctx.lineTo(width - 4, y(max));
+  ctx.stroke();
+  ctx.fillText(`${max.toFixed(2)} Gb/s`, 0, y(max) + 4);
+  ctx.fillText("0", left - 12, y(0) + 4);
+  ctx.fillText(`last ${Math.round(span / 1000)}s`, left, height - 2);
+
+  for (const [series, color] of [[h.rx, "#2563eb"], [h.tx, "#ea580c"]]) {
+    ctx.strokeStyle = color;
+    ctx.beginPath();
+    series.forEach((v, i) => (i ? ctx.lineTo(x(h.t[i]), y(v)) : ctx.moveTo(x(h.t[i]), y(v))));
+    ctx.stroke();
+  }
+}
+
+function setStatus(text, cls) {
+  const el = document.getElementById("status");
+  el.textContent = text;
+  el.className = "status " + (cls || "");
+}
+
+function openStream() {
+  if (state.stream) {
+    state.stream.close();
+  }
+  state.history = {};
+  const interval = document.getElementById("interval").value;
+  const es = new EventSource(`${API}stream?name=port_rcv_data,port_xmit_data&interval=${encodeURIComponent(interval)}`);
+  es.addEventListener("sample", (e) => {
+    const ev = JSON.parse(e.data);
+    if (ev.error) {
+      setStatus("stream: " + ev.error, "error");
+      return;
+    }
+    setStatus("live", "live");
+    const t = Date.parse(ev.collected_at);
+    const points = {};
+    for (const r of ev.rates) {
+      const p = (points[r.ib_dev] = points[r.ib_dev] || { rx: 0, tx: 0 });
+      if (r.counter_name === "port_rcv_data") {
+        p.rx = r.gbps;
+      } else {
+        p.tx = r.gbps;
+      }
+    }
+    for (const [dev, p] of Object.entries(points)) {
+      const h = (state.history[dev] = state.history[dev] || { t: [], rx: [], tx: [] });
+      h.t.push(t);
+      h.rx.push(p.rx);
+      h.tx.push(p.tx);
+      if (h.t.length > HISTORY_POINTS) {
+        h.t.shift();
+        h.rx.shift();
+        h.tx.shift();
+      }
+    }
+    drawCharts();
+  });
+  // the server drops clients that fall behind, EventSource reconnects by itself
+  es.addEventListener("dropped", () => setStatus("stream dropped, reconnecting", "error"));
+  es.onerror = () => setStatus("stream disconnected", "error");
+  state.stream = es;
+}
+
+async function getJSON(path) {
+  const resp = await fetch(API + path);
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+async function poll() {
+  try {
+    const counters = await getJSON("counters");
+    state.previous = state.current;
+    state.current = counters;
+    render();
+  } catch (err) {
+    setStatus("api: " + err.message, "error");
+  }
+  setTimeout(poll, POLL_MS);
+}
+
+async function loadDevices() {
+  try {
+    state.devices = (await getJSON("devices")).devices;
+    render();
+  } catch (err) {
+    setStatus("api: " + err.message, "error");
+  }
+}
+
+window.addEventListener("hashchange", () => {
+  loadDevices();
+  render();
+});
+document.getElementById("interval").addEventListener("change", openStream);
+loadDevices();
+poll();
+openStream();